@@ -0,0 +1,138 @@
+package unipitt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// AckTopicSuffix is appended to the command topic to reply on, for JSON commands without reply_to
+	AckTopicSuffix = "/ack"
+	// AckContentType is the MQTT 5 content type of the acknowledgements
+	AckContentType = "application/json"
+)
+
+// Command represents a request to update a digital output, optionally asking for an acknowledgement
+type Command struct {
+	Value bool
+	// CorrelationID is passed along in the acknowledgement; no acknowledgement is sent without one, unless over an MQTT 5 response topic
+	CorrelationID string
+	// ReplyTo is the topic to send the acknowledgement on, defaults to the command topic with AckTopicSuffix
+	ReplyTo string
+}
+
+// commandPayload is the JSON form of a command
+type commandPayload struct {
+	Value         string `json:"value"`
+	CorrelationID string `json:"correlation_id"`
+	ReplyTo       string `json:"reply_to"`
+}
+
+// Ack is the reply to a command, with the value read back from the digital output after updating it
+type Ack struct {
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Name          string `json:"name"`
+	Success       bool   `json:"success"`
+	Value         string `json:"value,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// ParseCommand parses either a plain payload, where anything but MsgTrueValue switches the output off, or a JSON command like {"value": "ON", "correlation_id": "42"}
+func ParseCommand(payload []byte) (command Command, err error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		command.Value = string(payload) == MsgTrueValue
+		return
+	}
+
+	var p commandPayload
+	if err = json.Unmarshal(trimmed, &p); err != nil {
+		return command, fmt.Errorf("invalid JSON command: %s", err)
+	}
+	command.CorrelationID, command.ReplyTo = p.CorrelationID, p.ReplyTo
+	switch p.Value {
+	case MsgTrueValue:
+		command.Value = true
+	case MsgFalseValue:
+		command.Value = false
+	default:
+		err = fmt.Errorf("invalid value %q, should be %s or %s", p.Value, MsgTrueValue, MsgFalseValue)
+	}
+	return
+}
+
+// formatValue formats a digital output value as MQTT payload
+func formatValue(value bool) string {
+	if value {
+		return MsgTrueValue
+	}
+	return MsgFalseValue
+}
+
+// execute updates the digital output and verifies the value read back from it
+func execute(name string, writer DigitalOutput, value bool) (ack Ack) {
+	ack.Name = name
+	if err := writer.Update(value); err != nil {
+		outputsLog.Error("Error updating digital output", "name", name, "err", err)
+		ack.Error = err.Error()
+		return
+	}
+	current, err := writer.Read()
+	if err != nil {
+		outputsLog.Error("Error reading back digital output", "name", name, "err", err)
+		ack.Error = fmt.Sprintf("reading back: %s", err)
+		return
+	}
+	ack.Value = formatValue(current)
+	if current != value {
+		outputsLog.Error("Digital output did not take the new value", "name", name, "value", value)
+		ack.Error = fmt.Sprintf("read back %s after writing %s", ack.Value, formatValue(value))
+		return
+	}
+	ack.Success = true
+	return
+}
+
+// acknowledge replies to a command asking for it, on the client it came in on: over the MQTT 5 response topic with the correlation data, or for JSON commands with a correlation ID on the reply_to topic
+func (h *Handler) acknowledge(c mqtt.Client, msg mqtt.Message, command Command, ack Ack) {
+	var properties *PublishProperties
+	topic := command.ReplyTo
+	if topic == "" {
+		topic = msg.Topic() + AckTopicSuffix
+	}
+	if m, ok := msg.(PropertiesMessage); ok && m.Properties().ResponseTopic != "" {
+		topic = m.Properties().ResponseTopic
+		status := "ok"
+		if !ack.Success {
+			status = "error"
+		}
+		properties = &PublishProperties{
+			ContentType:     AckContentType,
+			CorrelationData: m.Properties().CorrelationData,
+			UserProperties:  []UserProperty{{Key: "status", Value: status}},
+		}
+	} else if command.CorrelationID == "" {
+		return
+	}
+
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		mqttLog.Error("Error encoding acknowledgement", "err", err)
+		return
+	}
+	var token mqtt.Token
+	if publisher, ok := c.(PropertiesPublisher); ok && properties != nil {
+		token = publisher.PublishWithProperties(topic, 1, false, payload, properties)
+	} else {
+		token = c.Publish(topic, 0, false, payload)
+	}
+	// Waiting in the message handler could hold up the client receiving the acknowledgement from the broker
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			mqttLog.Error("Error acknowledging command", "topic", topic, "err", token.Error())
+		}
+	}()
+}
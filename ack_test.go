@@ -0,0 +1,97 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		Payload  string
+		Expected Command
+		HasError bool
+	}{
+		{Payload: "ON", Expected: Command{Value: true}},
+		{Payload: "OFF", Expected: Command{Value: false}},
+		{Payload: "foo", Expected: Command{Value: false}},
+		{Payload: `{"value": "ON", "correlation_id": "42"}`, Expected: Command{Value: true, CorrelationID: "42"}},
+		{Payload: `{"value": "OFF", "correlation_id": "42", "reply_to": "replies"}`, Expected: Command{CorrelationID: "42", ReplyTo: "replies"}},
+		{Payload: `{"value": "foo", "correlation_id": "42"}`, Expected: Command{CorrelationID: "42"}, HasError: true},
+		{Payload: `{"value": `, HasError: true},
+	}
+	for _, testCase := range cases {
+		command, err := ParseCommand([]byte(testCase.Payload))
+		if (err != nil) != testCase.HasError {
+			t.Fatalf("Expected error %t for %s, got %v\n", testCase.HasError, testCase.Payload, err)
+		}
+		if command != testCase.Expected {
+			t.Fatalf("Expected command %+v for %s, got %+v\n", testCase.Expected, testCase.Payload, command)
+		}
+	}
+}
+
+func TestHandlerAcknowledge(t *testing.T) {
+	root, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	folder := path.Join(root, "do_1_01")
+	if err := os.Mkdir(folder, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeClient()
+	h := &Handler{
+		brokers: []*broker{{name: "test", client: client}},
+		writerMap: map[string]DigitalOutput{
+			"do_1_01": &DigitalOutputWriter{Name: "do_1_01", Path: folder},
+			"do_1_02": &DigitalOutputWriter{Name: "do_1_02", Path: path.Join(root, "do_1_02")},
+		},
+		config: Configuration{Topics: map[string]string{"do_1_01": "kitchen light"}},
+	}
+	h.subscribe(client, h.subscriptions(h.configuration()))
+
+	cases := []struct {
+		Topic    string
+		Payload  string
+		AckTopic string
+		Expected Ack
+	}{
+		{Topic: "kitchen light", Payload: "ON"},
+		{Topic: "kitchen light", Payload: `{"value": "OFF", "correlation_id": "1"}`, AckTopic: "kitchen light/ack", Expected: Ack{CorrelationID: "1", Name: "do_1_01", Success: true, Value: "OFF"}},
+		{Topic: "do_1_01", Payload: `{"value": "ON", "correlation_id": "2", "reply_to": "replies"}`, AckTopic: "replies", Expected: Ack{CorrelationID: "2", Name: "do_1_01", Success: true, Value: "ON"}},
+		{Topic: "do_1_01", Payload: `{"value": "foo", "correlation_id": "3"}`, AckTopic: "do_1_01/ack", Expected: Ack{CorrelationID: "3", Name: "do_1_01", Error: `invalid value "foo", should be ON or OFF`}},
+	}
+	for _, testCase := range cases {
+		client.published = nil
+		client.deliver(testCase.Topic, testCase.Payload)
+		if testCase.AckTopic == "" {
+			if len(client.published) != 0 {
+				t.Fatalf("Expected no acknowledgement for %s, got %v\n", testCase.Payload, client.published)
+			}
+			continue
+		}
+		if len(client.published) != 1 || client.published[0].topic != testCase.AckTopic {
+			t.Fatalf("Expected an acknowledgement on %s, got %v\n", testCase.AckTopic, client.published)
+		}
+		var ack Ack
+		if err := json.Unmarshal(client.published[0].payload, &ack); err != nil {
+			t.Fatal(err)
+		}
+		if ack != testCase.Expected {
+			t.Fatalf("Expected acknowledgement %+v, got %+v\n", testCase.Expected, ack)
+		}
+	}
+
+	// The missing folder makes the update fail
+	client.published = nil
+	client.deliver("do_1_02", `{"value": "ON", "correlation_id": "4"}`)
+	var ack Ack
+	if len(client.published) != 1 || json.Unmarshal(client.published[0].payload, &ack) != nil || ack.Success || ack.Error == "" {
+		t.Fatalf("Expected a failed acknowledgement, got %v\n", client.published)
+	}
+}
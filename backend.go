@@ -0,0 +1,133 @@
+package unipitt
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// BackendSysFs takes the digital inputs and outputs from the sys fs, as exposed by the UniPi kernel driver
+	BackendSysFs = "sysfs"
+)
+
+// Event is a rising edge on a digital input, or the error which stopped watching it
+type Event struct {
+	Name  string
+	Value bool
+	Err   error
+}
+
+// DigitalInput is a digital input channel, as provided by a backend
+type DigitalInput interface {
+	// Read reads the current value of the input
+	Read() (bool, error)
+	// Watch sends an event on every rising edge of the input, until done is closed or an error event was sent. Polling backends poll at the given interval in millis.
+	Watch(events chan<- Event, interval int, done <-chan bool)
+	// Close releases the input
+	Close() error
+}
+
+// Backend provides the digital inputs and outputs of a board
+type Backend interface {
+	// Discover finds the digital inputs and outputs of the board, by their names with the board prefix
+	Discover() (inputs map[string]DigitalInput, outputs map[string]DigitalOutput, err error)
+	// Channels lists the names of the digital inputs and outputs of the board, with the board prefix, without claiming them
+	Channels() (names []string, err error)
+	// Close releases the board, after its inputs got closed
+	Close() error
+}
+
+// Backends maps the backend names to the constructors setting them up for a board
+var Backends = map[string]func(b BoardConfiguration) (Backend, error){
+	BackendSysFs:     NewSysFsBackend,
+	BackendModbus:    NewModbusBackend,
+	BackendEvok:      NewEvokBackend,
+	BackendGPIO:      NewGPIOBackend,
+	BackendSimulator: NewSimulatorBackend,
+}
+
+// backendName returns the name of the backend of a board, defaulting to the sys fs
+func (b BoardConfiguration) backendName() string {
+	if b.Backend == "" {
+		return BackendSysFs
+	}
+	return b.Backend
+}
+
+// NewBackend sets up the backend for a board
+func NewBackend(b BoardConfiguration) (Backend, error) {
+	newBackend, ok := Backends[b.backendName()]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", b.Backend)
+	}
+	return newBackend(b)
+}
+
+// backendNames lists the names of the available backends in sorted order
+func backendNames() (names []string) {
+	for name := range Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// SysFsBackend implements the backend for the sys fs, reading and writing the di_value and do_value files under the root
+type SysFsBackend struct {
+	Root   string
+	Prefix string
+}
+
+// NewSysFsBackend sets up the sys fs backend for a board
+func NewSysFsBackend(b BoardConfiguration) (Backend, error) {
+	return &SysFsBackend{Root: b.Root, Prefix: b.Prefix}, nil
+}
+
+// Discover sets up the digital input readers, output writers and user LEDs found under the root
+func (s *SysFsBackend) Discover() (inputs map[string]DigitalInput, outputs map[string]DigitalOutput, err error) {
+	inputs = make(map[string]DigitalInput)
+	outputs = make(map[string]DigitalOutput)
+	writers, err := FindDigitalOutputWriters(s.Root)
+	if err != nil {
+		outputsLog.Error("Error creating a map of digital output writers", "root", s.Root, "err", err)
+	}
+	for name, writer := range writers {
+		writer := writer
+		writer.Name = s.Prefix + name
+		outputs[writer.Name] = &writer
+	}
+	leds, err := FindLedWriters(s.Root)
+	if err != nil {
+		outputsLog.Error("Error creating a map of user LEDs", "root", s.Root, "err", err)
+	}
+	for name, led := range leds {
+		led := led
+		led.Name = s.Prefix + name
+		outputs[led.Name] = &led
+	}
+
+	readers, err := FindDigitalInputReaders(s.Root)
+	if err != nil {
+		return
+	}
+	for k := range readers {
+		readers[k].Name = s.Prefix + readers[k].Name
+		inputs[readers[k].Name] = &readers[k]
+	}
+	pollerLog.Info("Created digital input reader instances", "count", len(readers), "root", s.Root)
+	return
+}
+
+// Channels lists the names of the digital inputs and outputs and the user LEDs found under the root
+func (s *SysFsBackend) Channels() (names []string, err error) {
+	channels, err := DiscoverChannels(s.Root)
+	for _, name := range sortedKeys(channels) {
+		names = append(names, s.Prefix+name)
+	}
+	return
+}
+
+// Close is a no-op, the files are closed along with the inputs
+func (s *SysFsBackend) Close() error {
+	return nil
+}
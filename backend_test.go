@@ -0,0 +1,154 @@
+package unipitt
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeInput is a digital input sending the rising edges pushed on it
+type fakeInput struct {
+	name  string
+	edges chan bool
+}
+
+func (f *fakeInput) Read() (bool, error) {
+	return true, nil
+}
+
+func (f *fakeInput) Watch(events chan<- Event, interval int, done <-chan bool) {
+	for {
+		select {
+		case <-f.edges:
+			events <- Event{Name: f.name, Value: true}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (f *fakeInput) Close() error {
+	return nil
+}
+
+// fakeBackend is a backend with a single digital input and output
+type fakeBackend struct {
+	input  *fakeInput
+	output *DigitalOutputWriter
+}
+
+func (f *fakeBackend) Discover() (map[string]DigitalInput, map[string]DigitalOutput, error) {
+	return map[string]DigitalInput{f.input.name: f.input}, map[string]DigitalOutput{f.output.Name: f.output}, nil
+}
+
+func (f *fakeBackend) Channels() ([]string, error) {
+	return []string{f.input.name, f.output.Name}, nil
+}
+
+func (f *fakeBackend) Close() error {
+	return nil
+}
+
+func TestNewBackend(t *testing.T) {
+	cases := []struct {
+		Backend  string
+		Expected bool
+	}{
+		{Backend: "", Expected: true},
+		{Backend: BackendSysFs, Expected: true},
+		{Backend: "foo", Expected: false},
+	}
+	for _, testCase := range cases {
+		_, err := NewBackend(BoardConfiguration{Backend: testCase.Backend, Root: "/tmp"})
+		if (err == nil) != testCase.Expected {
+			t.Fatalf("Expected backend %q to be found %t, got %v\n", testCase.Backend, testCase.Expected, err)
+		}
+	}
+
+	problems := (&Configuration{Boards: []BoardConfiguration{{Backend: "foo", Root: "/tmp"}}}).boardProblems()
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "unknown backend") {
+		t.Fatalf("Expected a problem for the unknown backend, got %v\n", problems)
+	}
+}
+
+func TestSysFsBackendDiscover(t *testing.T) {
+	root := makeBoard(t, "di_1_01", "do_1_01")
+	defer os.RemoveAll(root)
+	f, err := os.Create(root + "/di_1_01/" + DiFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("1\n")
+	f.Close()
+
+	backend, err := NewSysFsBackend(BoardConfiguration{Root: root, Prefix: "ext_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, outputs, err := backend.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBackends(inputs, []Backend{backend})
+	input, ok := inputs["ext_di_1_01"]
+	if !ok || len(inputs) != 1 {
+		t.Fatalf("Expected the prefixed digital input, got %v\n", inputs)
+	}
+	if value, err := input.Read(); err != nil || !value {
+		t.Fatalf("Expected to read %t, got %t (%v)\n", true, value, err)
+	}
+	output, ok := outputs["ext_do_1_01"]
+	if !ok || len(outputs) != 1 {
+		t.Fatalf("Expected the prefixed digital output, got %v\n", outputs)
+	}
+	if err := output.Update(true); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := output.Read(); err != nil || !value {
+		t.Fatalf("Expected to read back %t, got %t (%v)\n", true, value, err)
+	}
+}
+
+func TestHandlerBackend(t *testing.T) {
+	folder := makeBoard(t)
+	defer os.RemoveAll(folder)
+	input := &fakeInput{name: "fake_di_1_01", edges: make(chan bool)}
+	Backends["fake"] = func(b BoardConfiguration) (Backend, error) {
+		return &fakeBackend{input: input, output: &DigitalOutputWriter{Name: b.Prefix + "do_1_01", Path: folder}}, nil
+	}
+	defer delete(Backends, "fake")
+
+	inputs, writerMap, backends, problems, err := FindBoards([]BoardConfiguration{{Backend: "fake", Prefix: "fake_"}})
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Expected the fake board to be found, got %v (%v)\n", err, problems)
+	}
+	client := newFakeClient()
+	h := &Handler{
+		inputs:    inputs,
+		writerMap: writerMap,
+		backends:  backends,
+		brokers:   []*broker{{name: "test", client: client}},
+		config:    Configuration{Topics: map[string]string{"fake_di_1_01": "kitchen"}},
+	}
+	defer h.Close()
+
+	done := make(chan bool)
+	defer close(done)
+	go h.Poll(done, 50, "trigger")
+	input.edges <- true
+	for k := 0; k < 100; k++ {
+		client.Lock()
+		count := len(client.published)
+		client.Unlock()
+		if count > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Lock()
+	defer client.Unlock()
+	if len(client.published) != 1 || client.published[0].topic != "kitchen" {
+		t.Fatalf("Expected a trigger on %s, got %v\n", "kitchen", client.published)
+	}
+}
@@ -0,0 +1,151 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// DirectSwitchEnableFilename enables (1) the hardware binding of a digital input to its digital output, next to the di_value file
+	DirectSwitchEnableFilename = "direct_switch_enable"
+	// DirectSwitchToggleFilename makes the bound output toggle on each rising edge (1) instead of following the input (0)
+	DirectSwitchToggleFilename = "direct_switch_toggle"
+	// DirectSwitchPolarityFilename inverts (1) the input for the bound output
+	DirectSwitchPolarityFilename = "direct_switch_polarity"
+	// BindingDirect has the output follow the input
+	BindingDirect = "direct"
+	// BindingToggle has the output toggle on each rising edge of the input
+	BindingToggle = "toggle"
+)
+
+// Binding is a hardware binding of a digital input to the digital output with the same group and number, which keeps working without unipitt or even Linux running
+type Binding struct {
+	Input  string `yaml:"input" json:"input"`
+	Output string `yaml:"output" json:"output"`
+	// Mode is BindingDirect (the default) or BindingToggle
+	Mode string `yaml:"mode" json:"mode"`
+	// Invert reverses the polarity of the input
+	Invert bool `yaml:"invert" json:"invert"`
+}
+
+// toggle tells whether the binding toggles the output
+func (b Binding) toggle() bool {
+	return b.Mode == BindingToggle
+}
+
+// pairedOutput returns the name of the digital output the firmware can bind the input to, empty if none
+func pairedOutput(input string) string {
+	k := strings.LastIndex(input, "di_")
+	if k < 0 {
+		return ""
+	}
+	return input[:k] + "do_" + input[k+3:]
+}
+
+// bindingProblems checks the bindings: the mode, and the inputs being bound once, to their paired output
+func (c *Configuration) bindingProblems() (problems []Problem) {
+	bound := make(map[string]bool)
+	for _, b := range c.Bindings {
+		if b.Mode != "" && b.Mode != BindingDirect && b.Mode != BindingToggle {
+			problems = append(problems, Problem{Key: b.Input, Message: fmt.Sprintf("binding of %s: mode %q should be %s or %s", b.Input, b.Mode, BindingDirect, BindingToggle)})
+		}
+		if bound[b.Input] {
+			problems = append(problems, Problem{Key: b.Input, Message: fmt.Sprintf("input %s is bound more than once", b.Input)})
+		}
+		bound[b.Input] = true
+		if paired := pairedOutput(b.Input); paired == "" || b.Output != paired {
+			problems = append(problems, Problem{Key: b.Input, Message: fmt.Sprintf("input %s can only be bound to the output with the same group and number, not %s", b.Input, b.Output)})
+		}
+	}
+	return
+}
+
+// applyBindings programs the configured bindings on the sys fs inputs, reporting the ones which drifted from the configuration. Bindings which were in the previous configuration, if any, but are no longer get disabled; so do all other bindings found on the board, but only with bindings configured (even an empty list), leaving the ones set by hand or by evok otherwise.
+func (h *Handler) applyBindings(previous *Configuration, c *Configuration) {
+	configured := make(map[string]bool)
+	for _, b := range c.Bindings {
+		configured[b.Input] = true
+		reader, ok := h.inputs[b.Input].(*DigitalInputReader)
+		if !ok {
+			configLog.Error("Error applying binding", "name", b.Input, "err", fmt.Sprintf("no sys fs digital input %s", b.Input))
+			continue
+		}
+		if _, ok := h.writerMap[b.Output]; !ok {
+			configLog.Error("Error applying binding", "name", b.Input, "err", fmt.Sprintf("no digital output %s", b.Output))
+			continue
+		}
+		// Enable last, so the output never follows a partially set up binding
+		for _, setting := range []struct{ file, value string }{
+			{DirectSwitchToggleFilename, formatBit(b.toggle())},
+			{DirectSwitchPolarityFilename, formatBit(b.Invert)},
+			{DirectSwitchEnableFilename, formatBit(true)},
+		} {
+			previous, err := applyFile(reader.Path, setting.file, setting.value)
+			if err != nil {
+				configLog.Error("Error applying binding", "name", b.Input, "file", setting.file, "err", err)
+				break
+			}
+			if previous != setting.value {
+				configLog.Warn("Binding drifted from the configuration, applied it", "name", b.Input, "file", setting.file, "found", previous, "value", setting.value)
+			}
+		}
+	}
+	programmed := make(map[string]bool)
+	if previous != nil {
+		for _, b := range previous.Bindings {
+			programmed[b.Input] = true
+		}
+	}
+	for _, b := range h.bindingTable() {
+		if configured[b.Input] || (c.Bindings == nil && !programmed[b.Input]) {
+			continue
+		}
+		reader := h.inputs[b.Input].(*DigitalInputReader)
+		if _, err := applyFile(reader.Path, DirectSwitchEnableFilename, formatBit(false)); err != nil {
+			configLog.Error("Error disabling binding", "name", b.Input, "err", err)
+			continue
+		}
+		configLog.Warn("Disabled binding on the board which is not in the configuration", "name", b.Input, "output", b.Output)
+	}
+}
+
+// bindingTable reads the bindings in effect on the sys fs inputs, in the order of the input names
+func (h *Handler) bindingTable() (table []Binding) {
+	table = []Binding{}
+	for _, name := range sortedKeys(h.inputs) {
+		reader, ok := h.inputs[name].(*DigitalInputReader)
+		if !ok {
+			continue
+		}
+		if enabled, err := readSetting(reader.Path, DirectSwitchEnableFilename); err != nil || enabled != formatBit(true) {
+			continue
+		}
+		b := Binding{Input: name, Output: pairedOutput(name), Mode: BindingDirect}
+		if toggle, _ := readSetting(reader.Path, DirectSwitchToggleFilename); toggle == formatBit(true) {
+			b.Mode = BindingToggle
+		}
+		polarity, _ := readSetting(reader.Path, DirectSwitchPolarityFilename)
+		b.Invert = polarity == formatBit(true)
+		table = append(table, b)
+	}
+	return
+}
+
+// publishBindings publishes the bindings in effect as JSON (retained) on the bindings topic, if any
+func (h *Handler) publishBindings(client mqtt.Client) {
+	topic := h.configuration().BindingsTopic
+	if topic == "" {
+		return
+	}
+	payload, err := json.Marshal(h.bindingTable())
+	if err != nil {
+		configLog.Error("Error formatting bindings", "err", err)
+		return
+	}
+	if token := client.Publish(topic, 0, true, payload); token.Wait() && token.Error() != nil {
+		mqttLog.Error("Error publishing bindings", "topic", topic, "err", token.Error())
+	}
+}
@@ -0,0 +1,138 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPairedOutput(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Expected string
+	}{
+		{Input: "di_2_03", Expected: "do_2_03"},
+		{Input: "fake_di_1_01", Expected: "fake_do_1_01"},
+		{Input: "doorbell"},
+	}
+	for _, testCase := range cases {
+		if paired := pairedOutput(testCase.Input); paired != testCase.Expected {
+			t.Fatalf("Expected %v for %s, got %v\n", testCase.Expected, testCase.Input, paired)
+		}
+	}
+}
+
+func TestBindingProblems(t *testing.T) {
+	c := Configuration{Bindings: []Binding{
+		{Input: "di_1_01", Output: "do_1_01"},
+		{Input: "di_2_01", Output: "do_2_01", Mode: BindingToggle, Invert: true},
+		{Input: "di_1_02", Output: "do_1_02", Mode: "pulse"},
+		{Input: "di_1_01", Output: "do_1_01"},
+		{Input: "di_1_03", Output: "do_1_04"},
+	}}
+	problems := c.bindingProblems()
+	expected := []string{"mode", "more than once", "same group and number"}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v\n", len(expected), problems)
+	}
+	for k, fragment := range expected {
+		if !strings.Contains(problems[k].Message, fragment) {
+			t.Fatalf("Expected problem %d to mention %q, got %s\n", k, fragment, problems[k].Message)
+		}
+	}
+}
+
+func TestApplyBindings(t *testing.T) {
+	root := makeBoard(t, "di_1_01", "di_1_02", "di_1_03", "do_1_01", "do_1_02")
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"di_1_01/" + DiFilename: "0",
+		"di_1_02/" + DiFilename: "0",
+		"do_1_01/" + DoFilename: DoFalseValue,
+		"do_1_02/" + DoFilename: DoFalseValue,
+		// Enabled by hand, not in the configuration
+		"di_1_03/" + DiFilename:                 "0",
+		"di_1_03/" + DirectSwitchEnableFilename: "1",
+	}
+	for _, name := range []string{"di_1_01", "di_1_02"} {
+		for _, file := range []string{DirectSwitchEnableFilename, DirectSwitchToggleFilename, DirectSwitchPolarityFilename} {
+			files[name+"/"+file] = "0\n"
+		}
+	}
+	for file, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputs, outputs, backends, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfiguration()
+	c.BindingsTopic = "unipitt/bindings"
+	c.Bindings = []Binding{
+		{Input: "di_1_01", Output: "do_1_01"},
+		{Input: "di_1_02", Output: "do_1_02", Mode: BindingToggle, Invert: true},
+	}
+	h := &Handler{inputs: inputs, writerMap: outputs, backends: backends, config: c}
+	defer h.Close()
+	h.applyBindings(nil, &c)
+
+	client := newFakeClient()
+	h.publishBindings(client)
+	if len(client.published) != 1 || client.published[0].topic != c.BindingsTopic {
+		t.Fatalf("Expected the binding table to be published, got %v\n", client.published)
+	}
+	var table []Binding
+	if err := json.Unmarshal(client.published[0].payload, &table); err != nil {
+		t.Fatal(err)
+	}
+	// The binding not in the configuration got disabled
+	expected := []Binding{
+		{Input: "di_1_01", Output: "do_1_01", Mode: BindingDirect},
+		{Input: "di_1_02", Output: "do_1_02", Mode: BindingToggle, Invert: true},
+	}
+	if len(table) != len(expected) {
+		t.Fatalf("Expected %d bindings, got %v\n", len(expected), table)
+	}
+	for k, b := range expected {
+		if table[k] != b {
+			t.Fatalf("Expected binding %v, got %v\n", b, table[k])
+		}
+	}
+}
+
+func TestApplyBindingsUnconfigured(t *testing.T) {
+	cases := []struct {
+		Bindings []Binding
+		Expected string
+	}{
+		// Without bindings key, the bindings set by hand are left
+		{Bindings: nil, Expected: "1"},
+		{Bindings: []Binding{}, Expected: "0"},
+	}
+	for _, testCase := range cases {
+		root := makeBoard(t, "di_1_01", "do_1_01")
+		defer os.RemoveAll(root)
+		for file, content := range map[string]string{"di_1_01/" + DiFilename: "0", "di_1_01/" + DirectSwitchEnableFilename: "1\n"} {
+			if err := ioutil.WriteFile(filepath.Join(root, file), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		inputs, outputs, backends, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := DefaultConfiguration()
+		c.Bindings = testCase.Bindings
+		h := &Handler{inputs: inputs, writerMap: outputs, backends: backends, config: c}
+		h.applyBindings(nil, &c)
+		h.Close()
+		if enabled, err := readSetting(filepath.Join(root, "di_1_01"), DirectSwitchEnableFilename); err != nil || enabled != testCase.Expected {
+			t.Fatalf("Expected the binding set by hand to be enabled %s for bindings %v, got %s (%v)\n", testCase.Expected, testCase.Bindings, enabled, err)
+		}
+	}
+}
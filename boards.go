@@ -0,0 +1,197 @@
+package unipitt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BoardConfiguration represents a board to take digital inputs and outputs from
+type BoardConfiguration struct {
+	// Backend is the name of the backend talking to the board, defaults to the sys fs
+	Backend string `yaml:"backend"`
+	// Root is the sys fs root to search, for the sysfs backend
+	Root string `yaml:"root"`
+	// Address is the host and optional port of the Modbus TCP server for the modbus backend, the base URL of evok for the evok backend
+	Address string `yaml:"address"`
+	// UnitID is the Modbus unit identifier of the board
+	UnitID uint8 `yaml:"unit_id"`
+	// Groups is the number of channels per group of the Neuron register map, for the modbus and simulator backends; defaults to a Neuron S103
+	Groups []ModbusGroup `yaml:"groups"`
+	// Scenario is the file with the input changes to play, for the simulator backend
+	Scenario string `yaml:"scenario"`
+	// Chip is the GPIO character device, for the gpio backend
+	Chip string `yaml:"chip"`
+	// Lines maps the lines of the GPIO chip to channel names, for the gpio backend
+	Lines []GPIOLine `yaml:"lines"`
+	// Alias is the board ID filled in for the board placeholder in the topic and command prefixes
+	Alias string `yaml:"alias"`
+	// Prefix is put in front of the channel names, to keep them unique across boards
+	Prefix string `yaml:"prefix"`
+}
+
+// BoardList returns the boards to take the digital inputs and outputs from, with the board ID as default alias. Without a boards list, the single sys fs root is used; when simulating, the simulated board.
+func (c *Configuration) BoardList() []BoardConfiguration {
+	if c.Simulate {
+		return []BoardConfiguration{{Backend: BackendSimulator, Alias: c.BoardID, Groups: c.Simulator.Groups, Scenario: c.Simulator.Scenario}}
+	}
+	if len(c.Boards) == 0 {
+		return []BoardConfiguration{{Root: c.SysFsRoot, Alias: c.BoardID}}
+	}
+	boards := make([]BoardConfiguration, len(c.Boards))
+	for k, b := range c.Boards {
+		if b.Alias == "" {
+			b.Alias = c.BoardID
+		}
+		boards[k] = b
+	}
+	return boards
+}
+
+// label identifies the board in logs and problems
+func (b BoardConfiguration) label() string {
+	switch b.backendName() {
+	case BackendSysFs:
+		return b.Root
+	case BackendGPIO:
+		return b.Chip
+	case BackendSimulator:
+		return BackendSimulator
+	}
+	return b.Address
+}
+
+// board finds the board a channel name belongs to: the one with the longest prefix matching the name, or the board without prefix
+func (c *Configuration) board(name string) (board BoardConfiguration) {
+	boards := c.BoardList()
+	board = boards[0]
+	found := false
+	for _, b := range boards {
+		if strings.HasPrefix(name, b.Prefix) && (!found || len(b.Prefix) > len(board.Prefix)) {
+			board, found = b, true
+		}
+	}
+	return
+}
+
+// boardProblems checks every board has a root, and the prefixes tell the boards apart
+func (c *Configuration) boardProblems() (problems []Problem) {
+	prefixes := make(map[string]string)
+	boards := c.Boards
+	if c.Simulate {
+		boards = c.BoardList()
+	}
+	for k, b := range boards {
+		if _, ok := Backends[b.backendName()]; !ok {
+			problems = append(problems, Problem{Key: "boards", Message: fmt.Sprintf("board %d: unknown backend %q, should be one of %s", k+1, b.Backend, strings.Join(backendNames(), ", "))})
+			continue
+		}
+		if b.backendName() == BackendSysFs && b.Root == "" {
+			problems = append(problems, Problem{Key: "boards", Message: fmt.Sprintf("board %d: empty root", k+1)})
+			continue
+		}
+		if (b.backendName() == BackendModbus || b.backendName() == BackendEvok) && b.Address == "" {
+			problems = append(problems, Problem{Key: "boards", Message: fmt.Sprintf("board %d: empty address", k+1)})
+			continue
+		}
+		if b.backendName() == BackendGPIO && b.Chip == "" {
+			problems = append(problems, Problem{Key: "boards", Message: fmt.Sprintf("board %d: empty chip", k+1)})
+			continue
+		}
+		if other, ok := prefixes[b.Prefix]; ok {
+			problems = append(problems, Problem{Key: "boards", Message: fmt.Sprintf("boards %s and %s have the same prefix %q", other, b.label(), b.Prefix)})
+			continue
+		}
+		prefixes[b.Prefix] = b.label()
+		if strings.ContainsAny(b.Alias, "/+#") {
+			problems = append(problems, Problem{Key: "boards", Message: fmt.Sprintf("board %s: alias %q should not contain /, + or #", b.label(), b.Alias)})
+		}
+		if b.backendName() == BackendGPIO {
+			problems = append(problems, gpioLineProblems(b)...)
+		}
+		for g, group := range b.Groups {
+			if group.DI < 0 || group.DO < 0 || group.RO < 0 || group.DI > ModbusMaxChannels || group.DO+group.RO > ModbusMaxChannels {
+				problems = append(problems, Problem{Key: "groups", Message: fmt.Sprintf("board %s: group %d should have between 0 and %d inputs and outputs", b.label(), g+1, ModbusMaxChannels)})
+			}
+		}
+	}
+	return
+}
+
+// collision reports a channel name found on more than one board
+func collision(name string, first string, second string) Problem {
+	return Problem{Key: "boards", Message: fmt.Sprintf("name %s found on both %s and %s, keeping the first", name, first, second)}
+}
+
+// FindBoards sets up the backends for all boards, with the names of their digital inputs and outputs prefixed. A name found on more than one board is reported as a problem and only the first one is kept.
+func FindBoards(boards []BoardConfiguration) (inputs map[string]DigitalInput, writerMap map[string]DigitalOutput, backends []Backend, problems []Problem, err error) {
+	inputs = make(map[string]DigitalInput)
+	writerMap = make(map[string]DigitalOutput)
+	roots := make(map[string]string)
+	for _, b := range boards {
+		backend, err := NewBackend(b)
+		if err != nil {
+			return inputs, writerMap, backends, problems, fmt.Errorf("board %s: %s", b.label(), err)
+		}
+		backends = append(backends, backend)
+		found, outputs, err := backend.Discover()
+		for _, name := range sortedKeys(outputs) {
+			if root, ok := roots[name]; ok {
+				problems = append(problems, collision(name, root, b.label()))
+				continue
+			}
+			roots[name] = b.label()
+			writerMap[name] = outputs[name]
+		}
+		if err != nil {
+			return inputs, writerMap, backends, problems, fmt.Errorf("board %s: %s", b.label(), err)
+		}
+		for _, name := range sortedKeys(found) {
+			if root, ok := roots[name]; ok {
+				problems = append(problems, collision(name, root, b.label()))
+				found[name].Close()
+				continue
+			}
+			roots[name] = b.label()
+			inputs[name] = found[name]
+		}
+	}
+	return
+}
+
+// DiscoverBoardChannels finds the (prefixed) names of all digital input and output channels on all boards, reporting the names found on more than one board. The channels are only listed, not claimed, so this works next to a running unipitt.
+func DiscoverBoardChannels(boards []BoardConfiguration) (channels map[string]bool, problems []Problem, err error) {
+	channels = make(map[string]bool)
+	roots := make(map[string]string)
+	for _, b := range boards {
+		backend, err := NewBackend(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not discover channels: board %s: %s", b.label(), err)
+		}
+		names, err := backend.Channels()
+		backend.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not discover channels: board %s: %s", b.label(), err)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if root, ok := roots[name]; ok {
+				problems = append(problems, collision(name, root, b.label()))
+				continue
+			}
+			roots[name] = b.label()
+			channels[name] = true
+		}
+	}
+	return
+}
+
+// closeBackends closes the digital inputs, followed by the backends providing them
+func closeBackends(inputs map[string]DigitalInput, backends []Backend) {
+	for _, name := range sortedKeys(inputs) {
+		inputs[name].Close()
+	}
+	for _, backend := range backends {
+		backend.Close()
+	}
+}
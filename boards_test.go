@@ -0,0 +1,142 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeBoard creates a temporary sys fs root with the given channel folders
+func makeBoard(t *testing.T, channels ...string) string {
+	root, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, channel := range channels {
+		if err := os.Mkdir(filepath.Join(root, channel), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestConfigurationBoardTopics(t *testing.T) {
+	c := Configuration{
+		TopicPrefix:   "unipitt/{board}",
+		CommandPrefix: "unipitt/{board}",
+		BoardID:       "neuron",
+		Boards: []BoardConfiguration{
+			{Root: "/sys/devices/platform/unipi_plc"},
+			{Root: "/tmp/fake", Alias: "fake", Prefix: "fake_"},
+		},
+	}
+	cases := []struct {
+		Name  string
+		Topic string
+	}{
+		{Name: "di_1_01", Topic: "unipitt/neuron/di_1_01"},
+		{Name: "fake_di_1_01", Topic: "unipitt/fake/fake_di_1_01"},
+	}
+	for _, testCase := range cases {
+		if topic := c.Topic(testCase.Name); topic != testCase.Topic {
+			t.Fatalf("Expected topic %s for %s, got %s\n", testCase.Topic, testCase.Name, topic)
+		}
+		if name := c.Name(testCase.Topic); name != testCase.Name {
+			t.Fatalf("Expected name %s for %s, got %s\n", testCase.Name, testCase.Topic, name)
+		}
+	}
+	filters := c.CommandFilters()
+	if len(filters) != 2 || filters[0] != "unipitt/fake/#" || filters[1] != "unipitt/neuron/#" {
+		t.Fatalf("Expected a command filter per board, got %v\n", filters)
+	}
+	if name := c.CommandName("unipitt/fake/fake_do_1_01/set"); name != "fake_do_1_01" {
+		t.Fatalf("Expected name %s, got %s\n", "fake_do_1_01", name)
+	}
+}
+
+func TestBoardProblems(t *testing.T) {
+	c := Configuration{Boards: []BoardConfiguration{
+		{Root: "/sys/devices/platform/unipi_plc"},
+		{Root: "/tmp/fake"},
+		{Root: ""},
+		{Root: "/tmp/other", Prefix: "other_", Alias: "other/1"},
+	}}
+	problems := c.boardProblems()
+	expected := []string{"same prefix", "empty root", "alias"}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v\n", len(expected), problems)
+	}
+	for k, fragment := range expected {
+		if !strings.Contains(problems[k].Message, fragment) {
+			t.Fatalf("Expected problem %d to mention %q, got %s\n", k, fragment, problems[k].Message)
+		}
+	}
+}
+
+func TestFindBoards(t *testing.T) {
+	neuron := makeBoard(t, "di_1_01", "do_1_01")
+	defer os.RemoveAll(neuron)
+	extension := makeBoard(t, "di_1_01", "do_2_01")
+	defer os.RemoveAll(extension)
+
+	// Without prefix, the names of the extension collide with the ones of the neuron
+	inputs, writerMap, _, problems, err := FindBoards([]BoardConfiguration{{Root: neuron}, {Root: extension, Prefix: ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "di_1_01") {
+		t.Fatalf("Expected a collision on di_1_01, got %v\n", problems)
+	}
+	if reader, ok := inputs["di_1_01"].(*DigitalInputReader); len(inputs) != 1 || !ok || reader.Path != filepath.Join(neuron, "di_1_01") || len(writerMap) != 2 {
+		t.Fatalf("Expected the first board to be kept, got %v and %v\n", inputs, writerMap)
+	}
+
+	inputs, writerMap, _, problems, err = FindBoards([]BoardConfiguration{{Root: neuron}, {Root: extension, Prefix: "ext_"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := inputs["ext_di_1_01"]; len(problems) != 0 || len(inputs) != 2 || !ok {
+		t.Fatalf("Expected the prefixed names, got %v (%v)\n", inputs, problems)
+	}
+	if writer, ok := writerMap["ext_do_2_01"].(*DigitalOutputWriter); !ok || writer.Path != filepath.Join(extension, "do_2_01") {
+		t.Fatalf("Expected the prefixed writer, got %v\n", writerMap)
+	}
+
+	channels, problems, err := DiscoverBoardChannels([]BoardConfiguration{{Root: neuron}, {Root: extension, Prefix: "ext_"}})
+	if err != nil || len(problems) != 0 || len(channels) != 4 || !channels["ext_di_1_01"] {
+		t.Fatalf("Expected 4 channels, got %v (%v, %v)\n", channels, problems, err)
+	}
+}
+
+func TestDiscoverBoardChannelsUnclaimed(t *testing.T) {
+	openGPIOChip = func(path string) (gpioChip, error) {
+		t.Fatalf("Expected %s not to be opened\n", path)
+		return nil, nil
+	}
+	defer func() { openGPIOChip = openChardev }()
+
+	boards := []BoardConfiguration{
+		// Nothing listening, nor dialed
+		{Backend: BackendModbus, Address: "127.0.0.1:1", Groups: []ModbusGroup{{DI: 2, DO: 1, RO: 1}}},
+		{Backend: BackendGPIO, Chip: "/dev/gpiochip0", Prefix: "pi_", Lines: []GPIOLine{{Name: "di_1_01", Line: 17}, {Name: "do_1_01", Line: 27, Direction: GPIOOutput}}},
+		{Backend: BackendSimulator, Groups: []ModbusGroup{{DI: 1}}},
+	}
+	channels, problems, err := DiscoverBoardChannels(boards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"di_1_01", "di_1_02", "do_1_01", "ro_1_01", "pi_di_1_01", "pi_do_1_01"}
+	if len(channels) != len(expected) {
+		t.Fatalf("Expected channels %v, got %v\n", expected, channels)
+	}
+	for _, name := range expected {
+		if !channels[name] {
+			t.Fatalf("Expected channel %s, got %v\n", name, channels)
+		}
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "di_1_01") {
+		t.Fatalf("Expected a collision on di_1_01, got %v\n", problems)
+	}
+}
@@ -0,0 +1,228 @@
+package unipitt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// BrokerModeFailover publishes on the first connected broker, in the configured order
+	BrokerModeFailover = "failover"
+	// BrokerModeMirror publishes on all configured brokers at once
+	BrokerModeMirror = "mirror"
+)
+
+// BrokerConfiguration represents the connection settings for a single MQTT broker
+type BrokerConfiguration struct {
+	URI string `yaml:"uri"`
+	// TLS and credentials for this broker only
+	AuthConfiguration `yaml:",inline"`
+}
+
+// BrokerList returns the brokers to connect to, in order of preference. Without a brokers list, the single broker is used with the top-level TLS and credential settings.
+func (c *Configuration) BrokerList() []BrokerConfiguration {
+	if len(c.Brokers) > 0 {
+		return c.Brokers
+	}
+	return []BrokerConfiguration{{URI: c.Broker, AuthConfiguration: c.AuthConfiguration}}
+}
+
+// broker is the connection to one of the configured MQTT brokers
+type broker struct {
+	name   string
+	client mqtt.Client
+	// disconnectedSince holds the unix nano timestamp since when the broker got disconnected, zero when connected; accessed atomically
+	disconnectedSince int64
+	// reconnecting is set while retrying to connect in the background, accessed atomically
+	reconnecting int32
+}
+
+// brokerName formats the broker URI for logging and health reporting, leaving out any credentials in it
+func brokerName(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return uri
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// newBroker sets up the MQTT client for the broker configuration, which (re)subscribes the handler on connect
+func (h *Handler) newBroker(c *Configuration, bc BrokerConfiguration) (b *broker, err error) {
+	b = &broker{name: brokerName(bc.URI), disconnectedSince: time.Now().UnixNano()}
+
+	var tlsConfig *tls.Config
+	if bc.UsesTLS() {
+		if tlsConfig, err = bc.TLSConfig(); err != nil {
+			mqttLog.Error("Error setting up MQTT TLS", "broker", b.name, "err", err)
+			return
+		}
+	}
+	username, password, err := bc.Credentials()
+	if err != nil {
+		mqttLog.Error("Error reading MQTT password file", "broker", b.name, "file", bc.PasswordFile, "err", err)
+		return
+	}
+
+	onConnect := func(client mqtt.Client) {
+		atomic.StoreInt64(&b.disconnectedSince, 0)
+		h.record(TraceEntry{Kind: TraceConnect, Broker: b.name})
+		h.subscribe(client, h.subscriptions(h.configuration()))
+		h.publishBindings(client)
+		h.publishPwmStates(client)
+	}
+	onConnectionLost := func(client mqtt.Client, err error) {
+		mqttLog.Warn("Lost connection to MQTT broker", "broker", b.name, "err", err)
+		atomic.CompareAndSwapInt64(&b.disconnectedSince, 0, time.Now().UnixNano())
+		h.record(TraceEntry{Kind: TraceDisconnect, Broker: b.name, Error: err.Error()})
+	}
+
+	if c.MQTTVersion == MQTTVersion5 {
+		b.client = NewMQTT5Client(MQTT5Options{
+			Broker:           bc.URI,
+			ClientID:         c.ClientID,
+			Username:         username,
+			Password:         password,
+			TLSConfig:        tlsConfig,
+			AutoReconnect:    true,
+			OnConnect:        onConnect,
+			OnConnectionLost: onConnectionLost,
+		})
+	} else {
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker(bc.URI)
+		opts.SetClientID(c.ClientID)
+		opts.SetProtocolVersion(uint(c.MQTTVersion))
+		if tlsConfig != nil {
+			opts.SetTLSConfig(tlsConfig)
+		}
+		if username != "" {
+			opts.SetUsername(username)
+			opts.SetPassword(password)
+		}
+		opts.OnConnectionLost = onConnectionLost
+		opts.OnConnect = onConnect
+		b.client = mqtt.NewClient(opts)
+	}
+	mqttLog.Info("Setting up MQTT client", "broker", b.name, "client_id", c.ClientID, "version", c.MQTTVersion)
+	return
+}
+
+// connected checks whether the client is connected to the broker. Paho reports being connected while reconnecting by itself, silently dropping QoS 0 messages meanwhile, so the connection state kept by the callbacks has to agree.
+func (b *broker) connected() bool {
+	return b.client != nil && atomic.LoadInt64(&b.disconnectedSince) == 0 && b.client.IsConnected()
+}
+
+// connect tries to (re)connect the MQTT client to the broker
+func (b *broker) connect() error {
+	mqttLog.Debug("Connecting to MQTT broker ...", "broker", b.name)
+	token := b.client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		if hint := connectHint(err); hint != "" {
+			mqttLog.Warn("Error connecting to MQTT broker", "broker", b.name, "err", err, "hint", hint)
+		} else {
+			mqttLog.Warn("Error connecting to MQTT broker", "broker", b.name, "err", err)
+		}
+		return err
+	}
+	mqttLog.Info("Connected to MQTT broker", "broker", b.name)
+	return nil
+}
+
+// selfReconnecting is implemented by MQTT clients which reconnect by themselves after a lost connection
+type selfReconnecting interface {
+	Reconnecting() bool
+}
+
+// reconnect keeps retrying to connect to the broker in the background, unless already doing so, either here or by the client itself
+func (b *broker) reconnect() {
+	if client, ok := b.client.(selfReconnecting); ok && client.Reconnecting() {
+		return
+	}
+	// Paho only reports being connected after a lost connection while reconnecting by itself
+	if b.client.IsConnected() && atomic.LoadInt64(&b.disconnectedSince) != 0 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&b.reconnecting, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&b.reconnecting, 0)
+		backoff.Retry(b.connect, backoff.NewExponentialBackOff())
+	}()
+}
+
+// publish publishes the trigger for a digital input on the brokers
+func (h *Handler) publish(topic string, payload string, e Event) {
+	h.send(topic, func(client mqtt.Client) error {
+		return h.publishTrigger(client, topic, payload, e)
+	})
+}
+
+// publishRetained publishes a value to keep on the topic, like the total of a counter, on the brokers the same way as the triggers
+func (h *Handler) publishRetained(topic string, payload string) {
+	h.send(topic, func(client mqtt.Client) error {
+		token := client.Publish(topic, 0, true, payload)
+		token.Wait()
+		return token.Error()
+	})
+}
+
+// send publishes on all brokers when mirroring, otherwise on the first connected broker taking it. Disconnected brokers are reconnected in the background.
+func (h *Handler) send(topic string, publish func(client mqtt.Client) error) {
+	mirror := h.configuration().BrokerMode == BrokerModeMirror
+	for _, b := range h.brokers {
+		if !mirror && !b.connected() {
+			b.reconnect()
+			continue
+		}
+		err := publish(b.client)
+		if err == nil {
+			if !mirror {
+				return
+			}
+			continue
+		}
+		if _, rejected := err.(*ReasonCodeError); rejected {
+			mqttLog.Error("Publish rejected by MQTT broker", "broker", b.name, "topic", topic, "err", err)
+		} else {
+			mqttLog.Warn("Error publishing to MQTT broker", "broker", b.name, "topic", topic, "err", err)
+			b.reconnect()
+		}
+	}
+	if !mirror {
+		mqttLog.Error("No MQTT broker available to publish on", "topic", topic)
+	}
+}
+
+// brokerProblems checks the brokers list and broker mode, the auth settings of each broker included
+func (c *Configuration) brokerProblems() (problems []Problem) {
+	if len(c.Brokers) == 0 && c.Broker == "" {
+		problems = append(problems, Problem{Key: "broker", Message: "empty broker"})
+	}
+	if c.BrokerMode != BrokerModeFailover && c.BrokerMode != BrokerModeMirror {
+		problems = append(problems, Problem{Key: "broker_mode", Message: fmt.Sprintf("broker mode %q should be %s or %s", c.BrokerMode, BrokerModeFailover, BrokerModeMirror)})
+	}
+	uris := make(map[string]bool)
+	for k, b := range c.Brokers {
+		if b.URI == "" {
+			problems = append(problems, Problem{Key: "brokers", Message: fmt.Sprintf("broker %d: empty uri", k+1)})
+			continue
+		}
+		if uris[b.URI] {
+			problems = append(problems, Problem{Key: "brokers", Message: fmt.Sprintf("broker %s listed more than once", b.URI)})
+		}
+		uris[b.URI] = true
+		for _, p := range b.AuthConfiguration.Problems() {
+			p.Message = fmt.Sprintf("broker %s: %s", b.URI, p.Message)
+			problems = append(problems, p)
+		}
+	}
+	return
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mhemeryck/unipitt"
+)
+
+// checkConfig validates a config file and reports the problems found, returning the exit code
+func checkConfig(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s check-config [flags] <config file>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var configFile string
+	flags.StringVar(&configFile, "config", "", "Config file name")
+	var sysFsRoot string
+	flags.StringVar(&sysFsRoot, "sysfs_root", unipitt.SysFsRoot, "Root folder to discover the digital inputs and outputs in")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if configFile == "" && flags.NArg() == 1 {
+		configFile = flags.Arg(0)
+	}
+	if configFile == "" {
+		flags.Usage()
+		return 2
+	}
+
+	problems, err := unipitt.CheckConfig(configFile, sysFsRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, err)
+		return 1
+	}
+	for _, problem := range problems {
+		if problem.Line > 0 {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", configFile, problem.Line, problem.Message)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", configFile, problem.Message)
+		}
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	fmt.Printf("%s: OK\n", configFile)
+	return 0
+}
@@ -2,7 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/mhemeryck/unipitt"
 )
@@ -10,11 +16,6 @@ import (
 // Current program version info, injected at build time
 var version, commit, date string
 
-const (
-	// Payload default MQTT payload
-	Payload = "trigger"
-)
-
 // printVersionInfo prints the current version info, where the values are injected at build time with goreleaser
 func printVersionInfo() {
 	log.Println("UnipiTT")
@@ -29,23 +30,27 @@ func printVersionInfo() {
 }
 
 func main() {
-	// Arguments
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+
+	// Arguments; all options can also be given as environment variable or in the config file
 	var showVersion bool
 	flag.BoolVar(&showVersion, "version", false, "Print version info and exit")
-	var pollingInterval int
-	flag.IntVar(&pollingInterval, "polling_interval", 50, "Polling interval per digital input in millis")
-	var caFile string
-	flag.StringVar(&caFile, "cafile", "", "CA certificate used for MQTT TLS setup")
-	var broker string
-	flag.StringVar(&broker, "broker", "ssl://raspberrypi.lan:8883", "MQTT broker URI")
-	var clientID string
-	flag.StringVar(&clientID, "client_id", "unipitt", "MQTT host client ID")
-	var sysFsRoot string
-	flag.StringVar(&sysFsRoot, "sysfs_root", unipitt.SysFsRoot, "Root folder to search for digital inputs")
-	var payload string
-	flag.StringVar(&payload, "payload", Payload, "Default MQTT message payload")
+	var printConfig bool
+	flag.BoolVar(&printConfig, "print_config", false, "Print the resolved configuration and exit")
 	var configFile string
-	flag.StringVar(&configFile, "config", "", "Config file name")
+	flag.StringVar(&configFile, "config", os.Getenv(unipitt.EnvConfigFile), fmt.Sprintf("Config file name (env %s)", unipitt.EnvConfigFile))
+	defaults := unipitt.DefaultConfiguration()
+	for _, option := range unipitt.Options {
+		usage := fmt.Sprintf("%s (env %s)", option.Usage, option.Env())
+		if option.Bool {
+			flag.Bool(option.Name, option.Get(&defaults) == "true", usage)
+		} else {
+			flag.String(option.Name, option.Get(&defaults), usage)
+		}
+	}
 	flag.Parse()
 
 	// Show version and exit
@@ -54,15 +59,108 @@ func main() {
 		return
 	}
 
+	// Only explicitly given flags take precedence over the environment and the config file
+	overrides := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		overrides[f.Name] = f.Value.String()
+	})
+
+	// Show the resolved configuration and exit
+	if printConfig {
+		c, err := unipitt.LoadConfiguration(configFile, overrides)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, err := c.Dump()
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(out)
+		return
+	}
+
 	// Setup handler
-	handler, err := unipitt.NewHandler(broker, clientID, caFile, sysFsRoot, configFile)
+	handler, err := unipitt.NewHandlerFromConfig(configFile, overrides)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer handler.Close()
+	c := handler.Config()
 
-	// Start polling (blocking)
+	// Serve health checks
+	if c.HealthAddress != "" {
+		go func() {
+			log.Fatal(handler.ServeHealth(c.HealthAddress))
+		}()
+	}
+
+	// Serve the digital inputs and outputs over Modbus TCP
+	if c.ModbusAddress != "" {
+		go func() {
+			log.Fatal(handler.ServeModbus(c.ModbusAddress))
+		}()
+	}
+
+	// Serve the control API of the simulated board
+	if c.Simulate && c.Simulator.Address != "" {
+		go func() {
+			log.Fatal(handler.ServeSimulator(c.Simulator.Address))
+		}()
+	}
+
+	// Stop on SIGTERM or SIGINT: closing done returns from polling, and waits for the background tasks to wind down before the handler gets closed
 	done := make(chan bool)
-	defer close(done)
-	handler.Poll(done, pollingInterval, payload)
+	var stopping sync.Once
+	stop := func() { stopping.Do(func() { close(done) }) }
+	var background sync.WaitGroup
+	defer func() {
+		stop()
+		background.Wait()
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		log.Printf("Received %s, stopping\n", <-sig)
+		stop()
+	}()
+
+	// Start polling (blocking)
+	for _, task := range []func(){
+		func() { handler.Watchdog(done) },
+		func() { handler.Meter(done, c.CounterInterval) },
+		func() { handler.Sense(done, c.SensorInterval) },
+		func() { handler.Indicate(done) },
+	} {
+		background.Add(1)
+		go func(task func()) {
+			defer background.Done()
+			task()
+		}(task)
+	}
+
+	// Replay a trace while polling, and exit once replayed
+	if c.Replay != "" {
+		entries, err := unipitt.ReadTrace(c.Replay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go handler.Poll(done, c.PollingInterval, c.Payload)
+		if err := handler.Replay(entries, c.ReplaySpeed, done); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Reload the configuration on SIGHUP or when the file changes
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			handler.Reload()
+		}
+	}()
+	if c.ConfigWatchInterval > 0 {
+		go handler.WatchConfig(done, time.Duration(c.ConfigWatchInterval)*time.Second)
+	}
+	handler.Poll(done, c.PollingInterval, c.Payload)
 }
@@ -2,24 +2,84 @@ package unipitt
 
 import (
 	"io/ioutil"
-	"log"
+	"strings"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
-// Configuration represents the topic name for the MQTT message for a given instance name
+// Configuration represents all settings: the MQTT brokers (including TLS and credentials) and sys fs setup, the topic name for the MQTT message for a given instance name, as well as the logging setup
 type Configuration struct {
-	Topics map[string]string
+	Broker          string               `yaml:"broker"`
+	ClientID        string               `yaml:"client_id"`
+	SysFsRoot       string               `yaml:"sysfs_root"`
+	Boards          []BoardConfiguration `yaml:"boards"`
+	PollingInterval int                  `yaml:"polling_interval"`
+	Payload         string               `yaml:"payload"`
+	HealthAddress   string               `yaml:"health_address"`
+	ModbusAddress   string               `yaml:"modbus_address"`
+	// ModbusAddresses maps channel names to the Modbus address to serve them on, instead of the one numbered by board, group and number
+	ModbusAddresses     map[string]int        `yaml:"modbus_addresses"`
+	ConfigWatchInterval int                   `yaml:"config_watch_interval"`
+	BrokerMode          string                `yaml:"broker_mode"`
+	Brokers             []BrokerConfiguration `yaml:"brokers"`
+	MQTTVersion         int                   `yaml:"mqtt_version"`
+	MessageExpiry       int                   `yaml:"message_expiry"`
+	BoardSerial         string                `yaml:"board_serial"`
+	TopicPrefix         string                `yaml:"topic_prefix"`
+	BoardID             string                `yaml:"board_id"`
+	CommandPrefix       string                `yaml:"command_prefix"`
+	ConfigPrefix        string                `yaml:"config_prefix"`
+	Topics              map[string]string     `yaml:"topics"`
+	// Inputs holds the hardware settings of the inputs, by name
+	Inputs  map[string]InputSettings `yaml:"inputs"`
+	Logging LoggingConfiguration     `yaml:"logging"`
+	// Simulate replaces the boards with a simulated one, as set up by Simulator
+	Simulate  bool                   `yaml:"simulate"`
+	Simulator SimulatorConfiguration `yaml:"simulator"`
+	// Pwm sets up the digital outputs for PWM, by name
+	Pwm map[string]PwmConfiguration `yaml:"pwm"`
+	// StatusLeds are the user LEDs showing the status, by name
+	StatusLeds []string `yaml:"status_leds"`
+	// Bindings are programmed on the board, their effective table is published on the bindings topic
+	Bindings      []Binding `yaml:"bindings"`
+	BindingsTopic string    `yaml:"bindings_topic"`
+	// Counters meter the pulses on the hardware counters of the inputs, by name
+	Counters        map[string]CounterConfiguration `yaml:"counters"`
+	CounterInterval int                             `yaml:"counter_interval"`
+	CounterState    string                          `yaml:"counter_state"`
+	// W1Root is the folder with the 1-Wire devices to read the temperature sensors from; temperatures are published when changed by at least the deadband
+	W1Root         string  `yaml:"w1_root"`
+	SensorInterval int     `yaml:"sensor_interval"`
+	SensorDeadband float64 `yaml:"sensor_deadband"`
+	// Record and Replay are trace files; the replay speed divides the time between the entries
+	Record      string `yaml:"record"`
+	Replay      string `yaml:"replay"`
+	ReplaySpeed int    `yaml:"replay_speed"`
+	// TLS and credentials for the broker, at the top level of the config file
+	AuthConfiguration `yaml:",inline"`
 }
 
-// Topic gets a topic (value) for a given name (key). Return the name itself as fallback
+// Topic gets a topic (value) for a given name (key). Mapped topics are used as is; otherwise the name itself is the fallback, behind the topic prefix if any
 func (c *Configuration) Topic(name string) string {
 	if value, ok := c.Topics[name]; ok {
 		return value
 	}
+	return c.prefixed(name)
+}
+
+// prefixed puts the topic prefix (with the alias of the board of the name filled in) in front of the name, if any
+func (c *Configuration) prefixed(name string) string {
+	if prefix := expand(c.TopicPrefix, c.board(name).Alias); prefix != "" {
+		return prefix + "/" + name
+	}
 	return name
 }
 
+// expand fills in the board alias for the board placeholder
+func expand(prefix string, alias string) string {
+	return strings.Replace(prefix, BoardPlaceholder, alias, -1)
+}
+
 // reverseTopics construct reverse mapping of topics
 func (c *Configuration) reverseTopics() map[string]string {
 	r := make(map[string]string)
@@ -29,25 +89,88 @@ func (c *Configuration) reverseTopics() map[string]string {
 	return r
 }
 
-// Name reverse mapping of topic for given name. In case nothing is found, just return the topic itself, hoping there's a mapped instance for it
+// Name reverse mapping of topic for given name. In case nothing is found, just return the topic itself without the topic prefix, hoping there's a mapped instance for it
 func (c *Configuration) Name(topic string) string {
 	if name, ok := c.reverseTopics()[topic]; ok {
 		return name
 	}
+	for _, b := range c.BoardList() {
+		if prefix := expand(c.TopicPrefix, b.Alias); prefix != "" && strings.HasPrefix(topic, prefix+"/") {
+			return strings.TrimPrefix(topic, prefix+"/")
+		}
+	}
 	return topic
 }
 
-// configFromFile reads a configuration from a yaml file
+// commandPrefixes lists the command prefixes with the board aliases filled in, empty without command prefix
+func (c *Configuration) commandPrefixes() map[string]bool {
+	prefixes := make(map[string]bool)
+	if c.CommandPrefix == "" {
+		return prefixes
+	}
+	for _, b := range c.BoardList() {
+		prefixes[expand(c.CommandPrefix, b.Alias)] = true
+	}
+	return prefixes
+}
+
+// CommandFilters returns the wildcard topic filters to subscribe to all output commands at once, one per board alias; empty without command prefix. The multi-level wildcard takes mapped topics with several levels as well.
+func (c *Configuration) CommandFilters() (filters []string) {
+	for _, prefix := range sortedKeys(c.commandPrefixes()) {
+		filters = append(filters, prefix+"/#")
+	}
+	return
+}
+
+// commandPath returns the levels in between the command prefix and the suffix of a topic, if it has both
+func (c *Configuration) commandPath(topic string, suffix string) (path string, ok bool) {
+	for prefix := range c.commandPrefixes() {
+		if strings.HasPrefix(topic, prefix+"/") && strings.HasSuffix(topic, suffix) && len(topic) > len(prefix)+1+len(suffix) {
+			return topic[len(prefix)+1 : len(topic)-len(suffix)], true
+		}
+	}
+	return "", false
+}
+
+// CommandName finds the output name for a command topic. With a command prefix, the levels in between the prefix and the suffix are either the name itself or a mapped topic. Otherwise, the topic is reverse mapped with Name.
+func (c *Configuration) CommandName(topic string) string {
+	if path, ok := c.commandPath(topic, CommandSuffix); ok {
+		return c.Name(path)
+	}
+	return c.Name(topic)
+}
+
+// Validate checks the configuration can be applied, returning the first problem found
+func (c *Configuration) Validate() error {
+	if problems := c.Problems(); len(problems) > 0 {
+		return problems[0]
+	}
+	return nil
+}
+
+// Dump formats the configuration as yaml, in the same format as the config file. Passwords are masked.
+func (c *Configuration) Dump() ([]byte, error) {
+	masked := *c
+	masked.AuthConfiguration = masked.AuthConfiguration.masked()
+	masked.Brokers = make([]BrokerConfiguration, len(c.Brokers))
+	for k, b := range c.Brokers {
+		masked.Brokers[k] = BrokerConfiguration{URI: b.URI, AuthConfiguration: b.AuthConfiguration.masked()}
+	}
+	return yaml.Marshal(&masked)
+}
+
+// configFromFile reads a configuration from a yaml file, on top of the defaults
 func configFromFile(configFile string) (c Configuration, err error) {
+	c = DefaultConfiguration()
 	f, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		log.Printf("Error reading config file: %s\n", err)
+		configLog.Error("Error reading config file", "file", configFile, "err", err)
 		return
 	}
 
-	err = yaml.Unmarshal(f, &c)
+	err = yaml.UnmarshalStrict(f, &c)
 	if err != nil {
-		log.Printf("Error unmarshalling the config: %s\n", err)
+		configLog.Error("Error unmarshalling the config", "file", configFile, "err", err)
 		return
 	}
 	return
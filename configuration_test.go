@@ -3,6 +3,7 @@ package unipitt
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	yaml "gopkg.in/yaml.v2"
@@ -78,6 +79,59 @@ func TestConfigurationName(t *testing.T) {
 	}
 }
 
+func TestConfigurationTopicPrefix(t *testing.T) {
+	c := Configuration{
+		TopicPrefix:   "unipitt/{board}",
+		BoardID:       "neuron1",
+		CommandPrefix: "unipitt/{board}/cmd",
+		Topics:        map[string]string{"do_1_01": "kitchen light"},
+	}
+	cases := []struct {
+		Name  string
+		Topic string
+	}{
+		{Name: "di_1_01", Topic: "unipitt/neuron1/di_1_01"},
+		{Name: "do_1_01", Topic: "kitchen light"},
+	}
+	for _, testCase := range cases {
+		if topic := c.Topic(testCase.Name); topic != testCase.Topic {
+			t.Fatalf("Expected topic %s for %s, got %s\n", testCase.Topic, testCase.Name, topic)
+		}
+		if name := c.Name(testCase.Topic); name != testCase.Name {
+			t.Fatalf("Expected name %s for %s, got %s\n", testCase.Name, testCase.Topic, name)
+		}
+	}
+	if filters := c.CommandFilters(); len(filters) != 1 || filters[0] != "unipitt/neuron1/cmd/#" {
+		t.Fatalf("Expected command filter %s, got %v\n", "unipitt/neuron1/cmd/#", filters)
+	}
+	if name := c.CommandName("unipitt/neuron1/cmd/di_1_02/set"); name != "di_1_02" {
+		t.Fatalf("Expected name %s, got %s\n", "di_1_02", name)
+	}
+}
+
+func TestConfigurationCommandName(t *testing.T) {
+	cases := []struct {
+		Prefix   string
+		Topic    string
+		Expected string
+	}{
+		{Prefix: "", Topic: "kitchen light", Expected: "do_1_01"},
+		{Prefix: "", Topic: "do_1_02", Expected: "do_1_02"},
+		{Prefix: "unipitt/board1", Topic: "unipitt/board1/do_1_02/set", Expected: "do_1_02"},
+		{Prefix: "unipitt/board1", Topic: "unipitt/board1/kitchen light/set", Expected: "do_1_01"},
+		{Prefix: "unipitt/board1", Topic: "kitchen light", Expected: "do_1_01"},
+		// Mapped topics with several levels
+		{Prefix: "unipitt/board1", Topic: "unipitt/board1/house/kitchen/light/set", Expected: "do_1_03"},
+		{Prefix: "unipitt/board1", Topic: "unipitt/board1/set", Expected: "unipitt/board1/set"},
+	}
+	for _, testCase := range cases {
+		c := Configuration{CommandPrefix: testCase.Prefix, Topics: map[string]string{"do_1_01": "kitchen light", "do_1_03": "house/kitchen/light"}}
+		if result := c.CommandName(testCase.Topic); result != testCase.Expected {
+			t.Fatalf("Expected name %s for %s, got %s\n", testCase.Expected, testCase.Topic, result)
+		}
+	}
+}
+
 func TestConfigFromFileNonExistant(t *testing.T) {
 	_, err := configFromFile("foo")
 	if err == nil {
@@ -147,3 +201,88 @@ func TestConfigFromFileUnmarshalIssue(t *testing.T) {
 		t.Fatal("Expected an error on unmarshalling, got none")
 	}
 }
+
+func TestConfigurationUnmarshalLogging(t *testing.T) {
+	input := []byte(`
+logging:
+  level: warn
+  format: json
+  levels:
+    poller: error
+    mqtt: debug
+`)
+	var c Configuration
+	err := yaml.Unmarshal(input, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Logging.Level != "warn" || c.Logging.Format != "json" {
+		t.Fatalf("Unexpected logging configuration %v\n", c.Logging)
+	}
+	if c.Logging.Levels["poller"] != "error" || c.Logging.Levels["mqtt"] != "debug" {
+		t.Fatalf("Unexpected subsystem levels %v\n", c.Logging.Levels)
+	}
+}
+
+func TestBoardPlaceholderProblem(t *testing.T) {
+	c := DefaultConfiguration()
+	c.TopicPrefix = "unipitt/{board}"
+	c.Boards = []BoardConfiguration{{Backend: BackendModbus, Address: "neuron.lan:502"}}
+	for _, p := range c.Problems() {
+		if p.Key == "topic_prefix" && strings.HasSuffix(p.Message, "for neuron.lan:502") {
+			return
+		}
+	}
+	t.Fatalf("Expected the board placeholder problem to name board %s, got %v\n", "neuron.lan:502", c.Problems())
+}
+
+func TestConfigurationValidate(t *testing.T) {
+	// withTopics creates a default configuration with the given topics
+	withTopics := func(topics map[string]string) Configuration {
+		c := DefaultConfiguration()
+		c.Topics = topics
+		return c
+	}
+	invalidLogging := DefaultConfiguration()
+	invalidLogging.Logging.Level = "foo"
+	noBroker := DefaultConfiguration()
+	noBroker.Broker = ""
+	noInterval := DefaultConfiguration()
+	noInterval.PollingInterval = 0
+	invalidVersion := DefaultConfiguration()
+	invalidVersion.MQTTVersion = 6
+	expiryWithoutMQTT5 := DefaultConfiguration()
+	expiryWithoutMQTT5.MessageExpiry = 10
+	expiryWithMQTT5 := expiryWithoutMQTT5
+	expiryWithMQTT5.MQTTVersion = MQTTVersion5
+	noBoardID := DefaultConfiguration()
+	noBoardID.TopicPrefix = "unipitt/{board}"
+	withBoardID := noBoardID
+	withBoardID.BoardID = "neuron1"
+	invalidBoardID := withBoardID
+	invalidBoardID.BoardID = "neuron/1"
+
+	cases := []struct {
+		Config   Configuration
+		HasError bool
+	}{
+		{Config: withTopics(map[string]string{"di_1_01": "kitchen switch", "do_2_02": "living light"})},
+		{Config: withTopics(map[string]string{"di_1_01": "light", "do_2_02": "light"}), HasError: true},
+		{Config: withTopics(map[string]string{"di_1_01": ""}), HasError: true},
+		{Config: invalidLogging, HasError: true},
+		{Config: noBroker, HasError: true},
+		{Config: noInterval, HasError: true},
+		{Config: invalidVersion, HasError: true},
+		{Config: expiryWithoutMQTT5, HasError: true},
+		{Config: expiryWithMQTT5},
+		{Config: noBoardID, HasError: true},
+		{Config: withBoardID},
+		{Config: invalidBoardID, HasError: true},
+	}
+	for _, testCase := range cases {
+		err := testCase.Config.Validate()
+		if (err != nil) != testCase.HasError {
+			t.Fatalf("Expected error %t for %v, got %v\n", testCase.HasError, testCase.Config, err)
+		}
+	}
+}
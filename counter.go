@@ -0,0 +1,232 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CounterFilename holds the hardware pulse counter, next to the di_value file
+	CounterFilename = "counter"
+	// DefaultCounterInterval is the default interval in seconds to publish the counter totals and rates at
+	DefaultCounterInterval = 60
+	// DefaultCounterState is the default file to keep the counter totals in across restarts
+	DefaultCounterState = "/var/lib/unipitt/counters.json"
+	// CounterTotalSuffix is appended to the topic of the input to publish the total on
+	CounterTotalSuffix = "/total"
+	// CounterRateSuffix is appended to the topic of the input to publish the rate (units per hour) on
+	CounterRateSuffix = "/rate"
+	// counterWrap is where the 32 bit hardware counters wrap around
+	counterWrap = 1 << 32
+)
+
+// CounterConfiguration sets up metering with the hardware counter of a digital input
+type CounterConfiguration struct {
+	// Factor is the number of pulses per unit, e.g. 1000 for a meter with 1000 imp/kWh
+	Factor float64 `yaml:"factor"`
+	// Topic replaces the topic of the input to publish the total and rate under
+	Topic string `yaml:"topic"`
+}
+
+// CounterState is what is kept of a counter across restarts
+type CounterState struct {
+	// Pulses is the total number of pulses counted
+	Pulses uint64 `json:"pulses"`
+	// Raw is the last value read from the hardware counter
+	Raw uint32 `json:"raw"`
+}
+
+// Counter meters the pulses on the hardware counter of a digital input, keeping a total which survives wraps and resets of the counter
+type Counter struct {
+	Name   string
+	Factor float64
+	Path   string
+	CounterState
+	// started is set once the hardware counter was read, or the state restored
+	started bool
+	// total and time of the last update, for the rate
+	total float64
+	last  time.Time
+}
+
+// NewCounter creates a counter for the digital input in the folder, restoring its state if any
+func NewCounter(name string, folder string, factor float64, state *CounterState) *Counter {
+	c := &Counter{Name: name, Factor: factor, Path: folder}
+	if state != nil {
+		c.CounterState = *state
+		c.started = true
+	}
+	c.total = c.Total()
+	return c
+}
+
+// Read reads the hardware counter
+func (c *Counter) Read() (uint32, error) {
+	content, err := ioutil.ReadFile(path.Join(c.Path, CounterFilename))
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 32)
+	return uint32(value), err
+}
+
+// counterDelta returns the pulses counted between two readings of a hardware counter. A lower value is taken as a wrap around when the last one was in the upper half of the range, otherwise as a reset (e.g. after a power cycle) counting up from zero.
+func counterDelta(last uint32, current uint32) uint64 {
+	if current >= last {
+		return uint64(current - last)
+	}
+	if last >= counterWrap/2 {
+		return counterWrap - uint64(last) + uint64(current)
+	}
+	return uint64(current)
+}
+
+// Update reads the hardware counter and adds the pulses since the last reading to the total, returning the total and the rate in units per hour. The rate is only known from the second update on.
+func (c *Counter) Update(now time.Time) (total float64, rate float64, err error) {
+	raw, err := c.Read()
+	if err != nil {
+		return c.Total(), 0, err
+	}
+	if c.started {
+		c.Pulses += counterDelta(c.Raw, raw)
+	}
+	c.Raw, c.started = raw, true
+	total = c.Total()
+	if !c.last.IsZero() && now.After(c.last) {
+		rate = (total - c.total) / now.Sub(c.last).Hours()
+	}
+	c.total, c.last = total, now
+	return
+}
+
+// Total returns the total in units
+func (c *Counter) Total() float64 {
+	return float64(c.Pulses) / c.Factor
+}
+
+// loadCounterState reads the counter states kept by saveCounterState, if any
+func loadCounterState(file string) (states map[string]CounterState, err error) {
+	states = make(map[string]CounterState)
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &states)
+	return
+}
+
+// saveCounterState writes the counter states, replacing the file at once so a crash doesn't lose the totals
+func saveCounterState(file string, counters map[string]*Counter) error {
+	states := make(map[string]CounterState)
+	for name, c := range counters {
+		if c.started {
+			states[name] = c.CounterState
+		}
+	}
+	content, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// setupCounters creates the configured counters on the sys fs inputs, restoring their totals
+func (h *Handler) setupCounters(c *Configuration) (err error) {
+	if len(c.Counters) == 0 {
+		return
+	}
+	states, err := loadCounterState(c.CounterState)
+	if err != nil {
+		return fmt.Errorf("could not read counter state %s: %s", c.CounterState, err)
+	}
+	h.counters = make(map[string]*Counter)
+	for _, name := range sortedKeys(c.Counters) {
+		reader, ok := h.inputs[name].(*DigitalInputReader)
+		if !ok {
+			counterLog.Warn("No hardware counter for digital input", "name", name)
+			continue
+		}
+		var state *CounterState
+		if s, ok := states[name]; ok {
+			state = &s
+		}
+		counter := NewCounter(name, reader.Path, c.Counters[name].Factor, state)
+		// Take the counter up to date right away, the rate follows from the next update on
+		if _, _, err := counter.Update(time.Now()); err != nil {
+			counterLog.Error("Error reading counter", "name", name, "err", err)
+		}
+		h.counters[name] = counter
+	}
+	counterLog.Info("Set up counters", "count", len(h.counters), "state", c.CounterState)
+	return
+}
+
+// counterTopic returns the topic to publish the total and rate of a counter under
+func (c *Configuration) counterTopic(name string) string {
+	if topic := c.Counters[name].Topic; topic != "" {
+		return topic
+	}
+	return c.Topic(name)
+}
+
+// updateCounters updates all counters, publishing their totals and rates, and keeps their state
+func (h *Handler) updateCounters(now time.Time) {
+	c := h.configuration()
+	for _, name := range sortedKeys(c.Counters) {
+		counter, ok := h.counters[name]
+		if !ok {
+			continue
+		}
+		total, rate, err := counter.Update(now)
+		if err != nil {
+			counterLog.Error("Error reading counter", "name", name, "err", err)
+			continue
+		}
+		topic := c.counterTopic(name)
+		counterLog.Debug("Publishing counter", "name", name, "total", total, "rate", rate)
+		h.publishRetained(topic+CounterTotalSuffix, strconv.FormatFloat(total, 'f', -1, 64))
+		h.publishRetained(topic+CounterRateSuffix, strconv.FormatFloat(rate, 'f', 3, 64))
+	}
+	if err := saveCounterState(c.CounterState, h.counters); err != nil {
+		counterLog.Error("Error saving counter state", "file", c.CounterState, "err", err)
+	}
+}
+
+// Meter publishes the totals and rates of the counters at the interval in seconds, until done
+func (h *Handler) Meter(done chan bool, interval int) {
+	if len(h.counters) == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			h.updateCounters(now)
+		case <-done:
+			return
+		}
+	}
+}
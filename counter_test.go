@@ -0,0 +1,125 @@
+package unipitt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCounterDelta(t *testing.T) {
+	cases := []struct {
+		Last     uint32
+		Current  uint32
+		Expected uint64
+	}{
+		{Last: 10, Current: 25, Expected: 15},
+		{Last: 10, Current: 10, Expected: 0},
+		// Wrap around
+		{Last: 4294967290, Current: 4, Expected: 10},
+		// Reset, e.g. after a power cycle
+		{Last: 5000, Current: 3, Expected: 3},
+	}
+	for _, testCase := range cases {
+		if delta := counterDelta(testCase.Last, testCase.Current); delta != testCase.Expected {
+			t.Fatalf("Expected %d pulses from %d to %d, got %d\n", testCase.Expected, testCase.Last, testCase.Current, delta)
+		}
+	}
+}
+
+// setCounter writes the hardware counter of the input in the folder
+func setCounter(t *testing.T, folder string, value string) {
+	if err := ioutil.WriteFile(filepath.Join(folder, CounterFilename), []byte(value+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCounterUpdate(t *testing.T) {
+	root := makeBoard(t, "di_1_01")
+	defer os.RemoveAll(root)
+	folder := filepath.Join(root, "di_1_01")
+
+	// 1000 imp/kWh, restored at 2 kWh with the counter at 100
+	c := NewCounter("di_1_01", folder, 1000, &CounterState{Pulses: 2000, Raw: 100})
+	start := time.Now()
+	cases := []struct {
+		Raw   string
+		After time.Duration
+		Total float64
+		Rate  float64
+	}{
+		// Pulses counted while not running are included, the rate is not known yet
+		{Raw: "600", Total: 2.5},
+		{Raw: "1100", After: time.Hour, Total: 3, Rate: 0.5},
+		{Raw: "10", After: 90 * time.Minute, Total: 3.01, Rate: 0.02},
+	}
+	for _, testCase := range cases {
+		setCounter(t, folder, testCase.Raw)
+		total, rate, err := c.Update(start.Add(testCase.After))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%.3f %.3f", total, rate) != fmt.Sprintf("%.3f %.3f", testCase.Total, testCase.Rate) {
+			t.Fatalf("Expected total %g and rate %g at %s, got %g and %g\n", testCase.Total, testCase.Rate, testCase.Raw, total, rate)
+		}
+	}
+
+	setCounter(t, folder, "many")
+	if _, _, err := c.Update(start.Add(2 * time.Hour)); err == nil {
+		t.Fatal("Expected an error reading an invalid counter, got none")
+	}
+}
+
+func TestMeter(t *testing.T) {
+	root := makeBoard(t, "di_1_01", "di_1_02")
+	defer os.RemoveAll(root)
+	for _, name := range []string{"di_1_01", "di_1_02"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name, DiFilename), []byte("0"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		setCounter(t, filepath.Join(root, name), "40")
+	}
+	state, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(state)
+
+	c := DefaultConfiguration()
+	c.CounterState = filepath.Join(state, "counters.json")
+	c.Counters = map[string]CounterConfiguration{
+		"di_1_01": {Factor: 1000, Topic: "house/energy"},
+		"di_1_02": {Factor: 10},
+	}
+	inputs, outputs, backends, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newFakeClient()
+	h := &Handler{inputs: inputs, writerMap: outputs, backends: backends, config: c, brokers: []*broker{{name: "fake", client: client}}}
+	defer h.Close()
+	if err := h.setupCounters(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	// The state is kept after each update, and restored from it on restart
+	setCounter(t, filepath.Join(root, "di_1_02"), "45")
+	h.updateCounters(time.Now().Add(time.Hour))
+	expected := map[string]string{"house/energy/total": "0", "house/energy/rate": "0.000", "di_1_02/total": "0.5", "di_1_02/rate": "0.500"}
+	if len(client.published) != len(expected) {
+		t.Fatalf("Expected %d values published, got %v\n", len(expected), client.published)
+	}
+	for _, m := range client.published {
+		if expected[m.topic] != string(m.payload) {
+			t.Fatalf("Expected %s on %s, got %s\n", expected[m.topic], m.topic, m.payload)
+		}
+	}
+	if err := h.setupCounters(&c); err != nil {
+		t.Fatal(err)
+	}
+	if total := h.counters["di_1_02"].Total(); total != 0.5 {
+		t.Fatalf("Expected the restored total to be %g, got %g\n", 0.5, total)
+	}
+}
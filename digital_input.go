@@ -1,9 +1,9 @@
 package unipitt
 
 import (
-	"log"
 	"os"
 	"path"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,41 +16,40 @@ const (
 	DiFolderRegex = "di_[0-9]_[0-9]{2}"
 )
 
-// DigitalInput interface for doing the polling
-type DigitalInput interface {
-	Update(chan *DigitalInput) error
-	Poll(chan *DigitalInput, int)
-	Close()
-}
-
-// DigitalInputReader implements the digital input interface
+// DigitalInputReader implements the digital input interface for the sys fs, polling the di_value file
 type DigitalInputReader struct {
 	Name  string
 	Value bool
 	Path  string
 	Err   error
 	f     *os.File
+	// lastPoll holds the unix nano timestamp of the last successful poll, accessed atomically
+	lastPoll int64
 }
 
-// Update reads the value and sets the new value
-func (d *DigitalInputReader) Update(events chan *DigitalInputReader) (err error) {
-	// Read the first byte
-	d.f.Seek(0, 0)
+// Read reads the current value from the file
+func (d *DigitalInputReader) Read() (value bool, err error) {
+	// Read the first byte, without moving the offset so it can be read concurrently
 	b := make([]byte, 1)
-	_, err = d.f.Read(b)
+	_, err = d.f.ReadAt(b, 0)
 	// Check it's true
-	value := string(b) == DiTrueValue
+	return string(b) == DiTrueValue, err
+}
+
+// Update reads the value and sets the new value
+func (d *DigitalInputReader) Update(events chan<- Event) (err error) {
+	value, err := d.Read()
 	// Push out an event in case of a leading edge
 	if !d.Value && value {
-		events <- d
+		events <- Event{Name: d.Name, Value: value}
 	}
 	// Update value
 	d.Value = value
 	return
 }
 
-// Poll continuously updates the instance
-func (d *DigitalInputReader) Poll(events chan *DigitalInputReader, interval int) {
+// Watch continuously updates the instance, polling at the interval until done
+func (d *DigitalInputReader) Watch(events chan<- Event, interval int, done <-chan bool) {
 	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
 	defer ticker.Stop()
 
@@ -61,19 +60,31 @@ func (d *DigitalInputReader) Poll(events chan *DigitalInputReader, interval int)
 			err := d.Update(events)
 			if err != nil {
 				d.Err = err
-				events <- d
-				log.Printf("Error polling digital input with name %s\n", d.Name)
+				events <- Event{Name: d.Name, Err: err}
+				pollerLog.Error("Error polling digital input", "name", d.Name, "err", err)
 				return
 			}
+			atomic.StoreInt64(&d.lastPoll, time.Now().UnixNano())
 			if count%100 == 0 {
 				count = 0
-				log.Printf("Polling digital input %s ...\n", d.Name)
+				pollerLog.Debug("Polling digital input", "name", d.Name)
 			}
 			count++
+		case <-done:
+			return
 		}
 	}
 }
 
+// LastPoll returns the time of the last successful poll, zero if it never polled
+func (d *DigitalInputReader) LastPoll() time.Time {
+	nanos := atomic.LoadInt64(&d.lastPoll)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
 // Close closes the current open file handle
 func (d *DigitalInputReader) Close() error {
 	return d.f.Close()
@@ -91,17 +102,17 @@ func FindDigitalInputReaders(root string) (readers []DigitalInputReader, err err
 	// Find the paths first
 	paths, err := findPathsByRegex(root, DiFolderRegex)
 	if err != nil {
-		log.Println(err)
+		pollerLog.Error("Error finding digital input paths", "root", root, "err", err)
 		return
 	}
-	log.Printf("Found %d matching digital input paths\n", len(paths))
+	pollerLog.Info("Found matching digital input paths", "count", len(paths))
 	readers = make([]DigitalInputReader, len(paths))
 	for k, folder := range paths {
 		// Read name as the trailing folder path
 		_, name := path.Split(folder)
 		digitalInputReader, err := NewDigitalInputReader(folder, name)
 		if err != nil {
-			log.Print(err)
+			pollerLog.Error("Error creating digital input reader", "name", name, "err", err)
 		}
 		readers[k] = *digitalInputReader
 	}
@@ -117,7 +117,7 @@ func TestUpdate(t *testing.T) {
 			HasEvent: false,
 		},
 	}
-	events := make(chan *DigitalInputReader)
+	events := make(chan Event)
 	defer close(events)
 	for _, testCase := range cases {
 		f.Seek(0, 0)
@@ -154,7 +154,7 @@ func TestPoll(t *testing.T) {
 	}
 
 	// Events
-	events := make(chan *DigitalInputReader)
+	events := make(chan Event)
 	defer close(events)
 
 	// Setup for triggering an event
@@ -166,7 +166,9 @@ func TestPoll(t *testing.T) {
 	}
 
 	// Poll
-	go digitalInput.Poll(events, 500)
+	done := make(chan bool)
+	defer close(done)
+	go digitalInput.Watch(events, 500, done)
 
 	// Block on events
 	d := <-events
@@ -193,12 +195,14 @@ func TestPollError(t *testing.T) {
 	}
 
 	// Events
-	events := make(chan *DigitalInputReader)
+	events := make(chan Event)
 	defer close(events)
 
 	f.Close()
 	// Poll
-	go digitalInput.Poll(events, 500)
+	done := make(chan bool)
+	defer close(done)
+	go digitalInput.Watch(events, 500, done)
 
 	d := <-events
 
@@ -1,9 +1,10 @@
 package unipitt
 
 import (
-	"log"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 )
 
 const (
@@ -17,9 +18,12 @@ const (
 	DoFolderRegex = "do_[0-9]_[0-9]{2}"
 )
 
-// DigitalOutput represents the digital outputs of the unipi board
+// DigitalOutput represents a digital output channel, as provided by a backend
 type DigitalOutput interface {
+	// Update writes the value to the output
 	Update(bool) error
+	// Read reads back the current value of the output
+	Read() (bool, error)
 }
 
 // DigitalOutputWriter implements the digital output specifically for writing outputs to files
@@ -28,8 +32,11 @@ type DigitalOutputWriter struct {
 	Path string
 }
 
-// Update writes the updated value to the digital output
+// Update writes the updated value to the digital output, stopping PWM if running
 func (d *DigitalOutputWriter) Update(value bool) (err error) {
+	if err = d.clearDuty(); err != nil {
+		return err
+	}
 	f, err := os.Create(path.Join(d.Path, DoFilename))
 	defer f.Close()
 	if err != nil {
@@ -42,11 +49,20 @@ func (d *DigitalOutputWriter) Update(value bool) (err error) {
 		_, err = f.WriteString(DoFalseValue)
 	}
 	if err == nil {
-		log.Printf("Update value of digital output %s to %t\n", d.Name, value)
+		outputsLog.Info("Updated value of digital output", "name", d.Name, "value", value)
 	}
 	return err
 }
 
+// Read reads back the current value of the digital output
+func (d *DigitalOutputWriter) Read() (value bool, err error) {
+	b, err := ioutil.ReadFile(path.Join(d.Path, DoFilename))
+	if err != nil {
+		return
+	}
+	return strings.TrimSpace(string(b)) == strings.TrimSpace(DoTrueValue), nil
+}
+
 // NewDigitalOutputWriter creates a new digital output writer instance from a a given matching folder
 func NewDigitalOutputWriter(folder string) (d *DigitalOutputWriter) {
 	// Read name as the trailing folder path
@@ -58,10 +74,10 @@ func NewDigitalOutputWriter(folder string) (d *DigitalOutputWriter) {
 func FindDigitalOutputWriters(root string) (writerMap map[string]DigitalOutputWriter, err error) {
 	paths, err := findPathsByRegex(root, DoFolderRegex)
 	if err != nil {
-		log.Println(err)
+		outputsLog.Error("Error finding digital output paths", "root", root, "err", err)
 		return
 	}
-	log.Printf("Found %d matching digital output paths\n", len(paths))
+	outputsLog.Info("Found matching digital output paths", "count", len(paths))
 	writerMap = make(map[string]DigitalOutputWriter)
 	var d *DigitalOutputWriter
 	for _, path := range paths {
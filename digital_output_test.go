@@ -106,3 +106,23 @@ func TestFindDigitalOutputWritersNoFolder(t *testing.T) {
 		t.Fatal("Expected no mapping to be found")
 	}
 }
+
+func TestReadDigitalOutputWriter(t *testing.T) {
+	folder, err := ioutil.TempDir("", "do_2_01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d := NewDigitalOutputWriter(folder)
+	if _, err := d.Read(); err == nil {
+		t.Fatal("Expected an error reading a missing value file, got none")
+	}
+	for _, value := range []bool{true, false} {
+		if err := d.Update(value); err != nil {
+			t.Fatal(err)
+		}
+		if current, err := d.Read(); err != nil || current != value {
+			t.Fatalf("Expected to read back %v, got %v (%v)\n", value, current, err)
+		}
+	}
+}
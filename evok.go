@@ -0,0 +1,363 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// BackendEvok talks to the REST and WebSocket API of the evok daemon of UniPi
+	BackendEvok = "evok"
+	// EvokTimeout limits the evok REST requests
+	EvokTimeout = 5 * time.Second
+	// EvokEdgeBuffer is the number of rising edges kept per input while its watcher is busy
+	EvokEdgeBuffer = 16
+)
+
+// evokKinds maps the evok device types to the channel name prefixes
+var evokKinds = map[string]string{"input": "di", "output": "do", "relay": "ro"}
+
+// evokDevice is the state of a device, as sent by evok over REST and WebSocket
+type evokDevice struct {
+	Dev     string      `json:"dev"`
+	Circuit string      `json:"circuit"`
+	Value   interface{} `json:"value"`
+}
+
+// on checks whether the device is switched on, evok sending the values as numbers
+func (d evokDevice) on() bool {
+	switch v := d.Value.(type) {
+	case float64:
+		return v != 0
+	case bool:
+		return v
+	case string:
+		return v == "1"
+	}
+	return false
+}
+
+// parseEvokDevices parses a single device state or a list of them
+func parseEvokDevices(data []byte) (devices []evokDevice, err error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "{") {
+		var device evokDevice
+		err = json.Unmarshal(data, &device)
+		return []evokDevice{device}, err
+	}
+	err = json.Unmarshal(data, &devices)
+	return
+}
+
+// EvokBackend implements the backend for the evok API: the channels are discovered over REST, the inputs follow the changes sent over the WebSocket and the outputs are switched over REST, so the value read back is current
+type EvokBackend struct {
+	URL    *url.URL
+	Prefix string
+	client *http.Client
+	// mu guards the connection state and the inputs
+	mu             sync.Mutex
+	inputs         map[string]*evokInput
+	conn           *websocket.Conn
+	disconnectedAt time.Time
+	listening      sync.Once
+	closed         chan bool
+}
+
+// NewEvokBackend sets up the evok backend for a board, the address being the base URL of evok
+func NewEvokBackend(b BoardConfiguration) (Backend, error) {
+	u, err := url.Parse(b.Address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("evok address %q should be an http or https URL", b.Address)
+	}
+	return &EvokBackend{
+		URL:    u,
+		Prefix: b.Prefix,
+		client: &http.Client{Timeout: EvokTimeout},
+		inputs: make(map[string]*evokInput),
+		closed: make(chan bool),
+	}, nil
+}
+
+// endpoint builds the URL of an endpoint relative to the base URL
+func (e *EvokBackend) endpoint(path string) string {
+	u := *e.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return u.String()
+}
+
+// get requests a REST endpoint, decoding the JSON response
+func (e *EvokBackend) get(path string) ([]evokDevice, error) {
+	resp, err := e.client.Get(e.endpoint(path))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("evok returned %s for %s", resp.Status, path)
+	}
+	var data json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("invalid evok response for %s: %s", path, err)
+	}
+	return parseEvokDevices(data)
+}
+
+// Discover lists the inputs, outputs and relays known to evok
+func (e *EvokBackend) Discover() (inputs map[string]DigitalInput, outputs map[string]DigitalOutput, err error) {
+	inputs = make(map[string]DigitalInput)
+	outputs = make(map[string]DigitalOutput)
+	devices, err := e.get("/rest/all")
+	if err != nil {
+		return inputs, outputs, fmt.Errorf("listing the evok devices: %s", err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, d := range devices {
+		kind, ok := evokKinds[d.Dev]
+		if !ok {
+			continue
+		}
+		name := e.Prefix + kind + "_" + d.Circuit
+		if d.Dev == "input" {
+			input := &evokInput{backend: e, name: name, edges: make(chan bool, EvokEdgeBuffer)}
+			e.inputs[d.Circuit] = input
+			inputs[name] = input
+		} else {
+			outputs[name] = &evokOutput{backend: e, name: name, dev: d.Dev, circuit: d.Circuit}
+		}
+	}
+	pollerLog.Info("Created evok digital inputs", "count", len(inputs), "url", e.URL.String())
+	return
+}
+
+// Channels lists the names of the inputs, outputs and relays known to evok, without following their changes
+func (e *EvokBackend) Channels() (names []string, err error) {
+	devices, err := e.get("/rest/all")
+	if err != nil {
+		return nil, fmt.Errorf("listing the evok devices: %s", err)
+	}
+	for _, d := range devices {
+		if kind, ok := evokKinds[d.Dev]; ok {
+			names = append(names, e.Prefix+kind+"_"+d.Circuit)
+		}
+	}
+	return
+}
+
+// update applies the device states to the inputs
+func (e *EvokBackend) update(devices []evokDevice) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, d := range devices {
+		if input, ok := e.inputs[d.Circuit]; ok && d.Dev == "input" {
+			input.set(d.on())
+		}
+	}
+}
+
+// listen follows the changes sent over the WebSocket until closed, reconnecting with a backoff. The states are refreshed over REST on every connect, to catch up on the changes missed.
+func (e *EvokBackend) listen() {
+	u := *e.URL
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	origin := e.URL.String()
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0
+	for {
+		err := e.follow(u.String(), origin, b)
+		e.mu.Lock()
+		e.conn = nil
+		e.disconnectedAt = time.Now()
+		e.mu.Unlock()
+		select {
+		case <-e.closed:
+			return
+		default:
+		}
+		pollerLog.Warn("Lost connection to evok", "url", u.String(), "err", err)
+		select {
+		case <-time.After(b.NextBackOff()):
+		case <-e.closed:
+			return
+		}
+	}
+}
+
+// follow connects to the WebSocket and applies the changes received, until the connection fails
+func (e *EvokBackend) follow(wsURL string, origin string, b backoff.BackOff) error {
+	conn, err := websocket.Dial(wsURL, "", origin)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	e.mu.Lock()
+	select {
+	case <-e.closed:
+		e.mu.Unlock()
+		return nil
+	default:
+	}
+	e.conn = conn
+	e.mu.Unlock()
+
+	devices, err := e.get("/rest/all")
+	if err != nil {
+		return err
+	}
+	e.update(devices)
+	b.Reset()
+	pollerLog.Info("Following evok changes", "url", wsURL)
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			return err
+		}
+		devices, err := parseEvokDevices(data)
+		if err != nil {
+			pollerLog.Warn("Invalid evok message", "err", err)
+			continue
+		}
+		e.update(devices)
+	}
+}
+
+// lastSeen returns now while connected to the WebSocket, otherwise when it got disconnected; zero if it never connected
+func (e *EvokBackend) lastSeen() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil {
+		return time.Now()
+	}
+	return e.disconnectedAt
+}
+
+// Close stops following the changes
+func (e *EvokBackend) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-e.closed:
+		return nil
+	default:
+	}
+	close(e.closed)
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+	return nil
+}
+
+// evokInput is a digital input of evok, following the changes sent over the WebSocket
+type evokInput struct {
+	backend *EvokBackend
+	name    string
+	// value is guarded by the mutex of the backend
+	value bool
+	edges chan bool
+}
+
+// set updates the value, queueing a rising edge for the watcher
+func (i *evokInput) set(value bool) {
+	rising := !i.value && value
+	i.value = value
+	if !rising {
+		return
+	}
+	select {
+	case i.edges <- true:
+	default:
+		pollerLog.Warn("Dropped rising edge of digital input", "name", i.name)
+	}
+}
+
+// Read returns the last value received from evok
+func (i *evokInput) Read() (bool, error) {
+	i.backend.mu.Lock()
+	defer i.backend.mu.Unlock()
+	return i.value, nil
+}
+
+// Watch sends an event for every rising edge received from evok until done. The interval is not used, as evok pushes the changes.
+func (i *evokInput) Watch(events chan<- Event, interval int, done <-chan bool) {
+	i.backend.listening.Do(func() {
+		go i.backend.listen()
+	})
+	for {
+		select {
+		case <-i.edges:
+			select {
+			case events <- Event{Name: i.name, Value: true}:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// LastPoll returns the time evok was last known to push the changes, for the health checks
+func (i *evokInput) LastPoll() time.Time {
+	return i.backend.lastSeen()
+}
+
+// Close is a no-op, the WebSocket is shared by the board
+func (i *evokInput) Close() error {
+	return nil
+}
+
+// evokOutput is a digital output or relay of evok, switched over REST
+type evokOutput struct {
+	backend *EvokBackend
+	name    string
+	dev     string
+	circuit string
+}
+
+// path returns the REST path of the output
+func (o *evokOutput) path() string {
+	return "/rest/" + o.dev + "/" + o.circuit
+}
+
+// Update switches the output
+func (o *evokOutput) Update(value bool) error {
+	form := url.Values{"value": {"0"}}
+	if value {
+		form.Set("value", "1")
+	}
+	resp, err := o.backend.client.PostForm(o.backend.endpoint(o.path()), form)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("evok returned %s for %s", resp.Status, o.path())
+	}
+	outputsLog.Info("Updated value of digital output", "name", o.name, "value", value)
+	return nil
+}
+
+// Read reads back the current value of the output from evok
+func (o *evokOutput) Read() (bool, error) {
+	devices, err := o.backend.get(o.path())
+	if err != nil {
+		return false, err
+	}
+	if len(devices) != 1 {
+		return false, fmt.Errorf("evok returned %d devices for %s", len(devices), o.path())
+	}
+	return devices[0].on(), nil
+}
@@ -0,0 +1,136 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// evokStub is a minimal evok API, with a relay to switch and an input to push changes of over the WebSocket
+type evokStub struct {
+	sync.Mutex
+	server  *httptest.Server
+	devices []evokDevice
+	changes chan string
+}
+
+func newEvokStub() *evokStub {
+	stub := &evokStub{
+		devices: []evokDevice{
+			{Dev: "input", Circuit: "1_01", Value: float64(0)},
+			{Dev: "relay", Circuit: "2_01", Value: float64(0)},
+			{Dev: "ai", Circuit: "1_01", Value: 2.5},
+		},
+		changes: make(chan string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/all", func(w http.ResponseWriter, r *http.Request) {
+		stub.Lock()
+		defer stub.Unlock()
+		json.NewEncoder(w).Encode(stub.devices)
+	})
+	mux.HandleFunc("/rest/relay/2_01", func(w http.ResponseWriter, r *http.Request) {
+		stub.Lock()
+		defer stub.Unlock()
+		if r.Method == http.MethodPost {
+			stub.devices[1].Value = float64(0)
+			if r.FormValue("value") == "1" {
+				stub.devices[1].Value = float64(1)
+			}
+		}
+		json.NewEncoder(w).Encode(stub.devices[1])
+	})
+	mux.Handle("/ws", websocket.Handler(func(conn *websocket.Conn) {
+		for change := range stub.changes {
+			if err := websocket.Message.Send(conn, change); err != nil {
+				return
+			}
+		}
+	}))
+	stub.server = httptest.NewServer(mux)
+	return stub
+}
+
+func TestParseEvokDevices(t *testing.T) {
+	cases := []struct {
+		Data     string
+		Expected int
+		On       bool
+	}{
+		{Data: `{"dev": "input", "circuit": "1_01", "value": 1}`, Expected: 1, On: true},
+		{Data: `[{"dev": "input", "circuit": "1_01", "value": 0}, {"dev": "relay", "circuit": "2_01", "value": 1}]`, Expected: 2, On: false},
+		{Data: `{"dev": "input", "circuit": "1_01", "value": "1"}`, Expected: 1, On: true},
+	}
+	for _, testCase := range cases {
+		devices, err := parseEvokDevices([]byte(testCase.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != testCase.Expected || devices[0].on() != testCase.On {
+			t.Fatalf("Expected %d devices, the first one on %t, got %v\n", testCase.Expected, testCase.On, devices)
+		}
+	}
+}
+
+func TestEvokBackend(t *testing.T) {
+	stub := newEvokStub()
+	defer stub.server.Close()
+	defer close(stub.changes)
+
+	backend, err := NewBackend(BoardConfiguration{Backend: BackendEvok, Address: stub.server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, outputs, err := backend.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBackends(inputs, []Backend{backend})
+	if _, ok := inputs["di_1_01"]; !ok || len(inputs) != 1 {
+		t.Fatalf("Expected input di_1_01, got %v\n", inputs)
+	}
+	relay, ok := outputs["ro_2_01"]
+	if !ok || len(outputs) != 1 {
+		t.Fatalf("Expected relay ro_2_01, got %v\n", outputs)
+	}
+
+	// Outputs are switched and read back over REST
+	if err := relay.Update(true); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := relay.Read(); err != nil || !value {
+		t.Fatalf("Expected to read back %t, got %t (%v)\n", true, value, err)
+	}
+
+	// Changes of the inputs come in over the WebSocket
+	events := make(chan Event)
+	done := make(chan bool)
+	defer close(done)
+	go inputs["di_1_01"].Watch(events, 50, done)
+	stub.changes <- `[{"dev": "input", "circuit": "1_01", "value": 1}]`
+	select {
+	case e := <-events:
+		if e.Name != "di_1_01" || !e.Value {
+			t.Fatalf("Expected a rising edge on %s, got %v\n", "di_1_01", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a rising edge, got none")
+	}
+	if value, _ := inputs["di_1_01"].Read(); !value {
+		t.Fatalf("Expected input value %t, got %t\n", true, value)
+	}
+	if last := inputs["di_1_01"].(poller).LastPoll(); time.Since(last) > time.Second {
+		t.Fatalf("Expected the input to be live while connected, last seen %s\n", last)
+	}
+}
+
+func TestEvokBackendAddress(t *testing.T) {
+	if _, err := NewBackend(BoardConfiguration{Backend: BackendEvok, Address: "neuron.lan:8080"}); err == nil {
+		t.Fatal("Expected an error for an evok address without http scheme, got none")
+	}
+}
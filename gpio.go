@@ -0,0 +1,220 @@
+package unipitt
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// BackendGPIO takes the digital inputs and outputs from the lines of a Linux GPIO character device, e.g. on a Raspberry Pi
+	BackendGPIO = "gpio"
+	// GPIOInput is the direction of a line read as digital input
+	GPIOInput = "input"
+	// GPIOOutput is the direction of a line driven as digital output
+	GPIOOutput = "output"
+	// GPIOConsumer is the consumer label of the requested lines, as shown by gpioinfo
+	GPIOConsumer = "unipitt"
+)
+
+// GPIOLine maps a line of a GPIO chip to a channel name
+type GPIOLine struct {
+	Name string `yaml:"name"`
+	// Line is the offset of the line on the chip
+	Line uint32 `yaml:"line"`
+	// Direction is input or output, defaults to input
+	Direction string `yaml:"direction"`
+	// ActiveLow inverts the value of the line, e.g. for a switch pulling the line to ground
+	ActiveLow bool `yaml:"active_low"`
+}
+
+// output checks whether the line is driven as digital output
+func (l GPIOLine) output() bool {
+	return l.Direction == GPIOOutput
+}
+
+// gpioChip requests lines of a GPIO chip
+type gpioChip interface {
+	// lines returns the number of lines of the chip
+	lines() uint32
+	// requestEvents requests an input line, with the kernel reporting its rising edges
+	requestEvents(offset uint32, activeLow bool) (gpioLine, error)
+	// requestOutput requests an output line, switched off
+	requestOutput(offset uint32, activeLow bool) (gpioLine, error)
+	Close() error
+}
+
+// gpioLine is a requested line of a GPIO chip
+type gpioLine interface {
+	value() (bool, error)
+	setValue(value bool) error
+	// waitEdge blocks until the next rising edge, failing once the line got closed
+	waitEdge() error
+	Close() error
+}
+
+// openGPIOChip opens a GPIO character device, replaced in the tests
+var openGPIOChip = openChardev
+
+// GPIOBackend implements the backend for a GPIO character device, with the inputs waiting for the kernel to report their edges rather than polling
+type GPIOBackend struct {
+	Chip   string
+	Prefix string
+	Lines  []GPIOLine
+	chip   gpioChip
+	// outputs holds the output lines, to release them on close
+	outputs []gpioLine
+}
+
+// NewGPIOBackend sets up the GPIO backend for a board
+func NewGPIOBackend(b BoardConfiguration) (Backend, error) {
+	return &GPIOBackend{Chip: b.Chip, Prefix: b.Prefix, Lines: b.Lines}, nil
+}
+
+// Discover requests the configured lines of the chip
+func (g *GPIOBackend) Discover() (inputs map[string]DigitalInput, outputs map[string]DigitalOutput, err error) {
+	inputs = make(map[string]DigitalInput)
+	outputs = make(map[string]DigitalOutput)
+	if g.chip, err = openGPIOChip(g.Chip); err != nil {
+		return
+	}
+	for _, l := range g.Lines {
+		if l.Line >= g.chip.lines() {
+			return inputs, outputs, fmt.Errorf("line %d of %s does not exist, it has %d lines", l.Line, g.Chip, g.chip.lines())
+		}
+		name := g.Prefix + l.Name
+		if l.output() {
+			line, err := g.chip.requestOutput(l.Line, l.ActiveLow)
+			if err != nil {
+				return inputs, outputs, fmt.Errorf("requesting line %d of %s: %s", l.Line, g.Chip, err)
+			}
+			g.outputs = append(g.outputs, line)
+			outputs[name] = &gpioOutput{name: name, line: line}
+			continue
+		}
+		line, err := g.chip.requestEvents(l.Line, l.ActiveLow)
+		if err != nil {
+			return inputs, outputs, fmt.Errorf("requesting line %d of %s: %s", l.Line, g.Chip, err)
+		}
+		inputs[name] = &gpioInput{name: name, line: line}
+	}
+	pollerLog.Info("Requested GPIO lines", "inputs", len(inputs), "outputs", len(outputs), "chip", g.Chip)
+	return
+}
+
+// Channels lists the names of the configured lines, without opening the chip
+func (g *GPIOBackend) Channels() (names []string, err error) {
+	for _, l := range g.Lines {
+		names = append(names, g.Prefix+l.Name)
+	}
+	return
+}
+
+// Close releases the output lines and the chip
+func (g *GPIOBackend) Close() error {
+	for _, line := range g.outputs {
+		line.Close()
+	}
+	if g.chip == nil {
+		return nil
+	}
+	return g.chip.Close()
+}
+
+// gpioLineProblems checks the line mapping of a GPIO board
+func gpioLineProblems(b BoardConfiguration) (problems []Problem) {
+	if len(b.Lines) == 0 {
+		problems = append(problems, Problem{Key: "lines", Message: fmt.Sprintf("board %s: no lines", b.label())})
+	}
+	names := make(map[string]bool)
+	offsets := make(map[uint32]bool)
+	for _, l := range b.Lines {
+		switch {
+		case l.Name == "" || strings.ContainsAny(l.Name, "/+#"):
+			problems = append(problems, Problem{Key: "lines", Message: fmt.Sprintf("board %s: line %d should have a name without /, + or #", b.label(), l.Line)})
+		case names[l.Name]:
+			problems = append(problems, Problem{Key: "lines", Message: fmt.Sprintf("board %s: name %s used for more than one line", b.label(), l.Name)})
+		case offsets[l.Line]:
+			problems = append(problems, Problem{Key: "lines", Message: fmt.Sprintf("board %s: line %d mapped more than once", b.label(), l.Line)})
+		case l.Direction != "" && l.Direction != GPIOInput && l.Direction != GPIOOutput:
+			problems = append(problems, Problem{Key: "lines", Message: fmt.Sprintf("board %s: direction %q of %s should be %s or %s", b.label(), l.Direction, l.Name, GPIOInput, GPIOOutput)})
+		}
+		names[l.Name] = true
+		offsets[l.Line] = true
+	}
+	return
+}
+
+// gpioInput is an input line of a GPIO chip
+type gpioInput struct {
+	name string
+	line gpioLine
+}
+
+// Read reads the current value of the line
+func (i *gpioInput) Read() (bool, error) {
+	return i.line.value()
+}
+
+// Watch sends an event for every rising edge reported by the kernel until done. The interval is not used, no polling is involved.
+func (i *gpioInput) Watch(events chan<- Event, interval int, done <-chan bool) {
+	edges := make(chan error)
+	go func() {
+		for {
+			err := i.line.waitEdge()
+			select {
+			case edges <- err:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case err := <-edges:
+			e := Event{Name: i.name, Value: true}
+			if err != nil {
+				pollerLog.Error("Error watching digital input", "name", i.name, "err", err)
+				e = Event{Name: i.name, Err: err}
+			}
+			select {
+			case events <- e:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Close releases the line, which stops waiting for edges
+func (i *gpioInput) Close() error {
+	return i.line.Close()
+}
+
+// gpioOutput is an output line of a GPIO chip
+type gpioOutput struct {
+	name string
+	line gpioLine
+}
+
+// Update drives the line
+func (o *gpioOutput) Update(value bool) error {
+	err := o.line.setValue(value)
+	if err == nil {
+		outputsLog.Info("Updated value of digital output", "name", o.name, "value", value)
+	}
+	return err
+}
+
+// Read reads back the current value of the line
+func (o *gpioOutput) Read() (bool, error) {
+	return o.line.value()
+}
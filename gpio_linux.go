@@ -0,0 +1,172 @@
+package unipitt
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// GPIO character device ioctls of the Linux uAPI (v1), see include/uapi/linux/gpio.h
+const (
+	gpioGetChipInfoIoctl         = 0x8044b401
+	gpioGetLineHandleIoctl       = 0xc16cb403
+	gpioGetLineEventIoctl        = 0xc030b404
+	gpioHandleGetLineValuesIoctl = 0xc040b408
+	gpioHandleSetLineValuesIoctl = 0xc040b409
+	gpioHandleRequestInput       = 1 << 0
+	gpioHandleRequestOutput      = 1 << 1
+	gpioHandleRequestActiveLow   = 1 << 2
+	gpioEventRequestRisingEdge   = 1 << 0
+	gpioEventDataSize            = 16
+)
+
+// gpiochipInfo is struct gpiochip_info
+type gpiochipInfo struct {
+	name  [32]byte
+	label [32]byte
+	lines uint32
+}
+
+// gpiohandleRequest is struct gpiohandle_request
+type gpiohandleRequest struct {
+	lineOffsets   [64]uint32
+	flags         uint32
+	defaultValues [64]uint8
+	consumerLabel [32]byte
+	lines         uint32
+	fd            int32
+}
+
+// gpioeventRequest is struct gpioevent_request
+type gpioeventRequest struct {
+	lineOffset    uint32
+	handleFlags   uint32
+	eventFlags    uint32
+	consumerLabel [32]byte
+	fd            int32
+}
+
+// gpiohandleData is struct gpiohandle_data
+type gpiohandleData struct {
+	values [64]uint8
+}
+
+// ioctl calls the ioctl on the file, without putting it in blocking mode as Fd does
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// chardevChip is a GPIO chip opened through its character device
+type chardevChip struct {
+	f    *os.File
+	info gpiochipInfo
+}
+
+// openChardev opens the GPIO character device, e.g. /dev/gpiochip0
+func openChardev(path string) (gpioChip, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	c := &chardevChip{f: f}
+	if err := ioctl(f, gpioGetChipInfoIoctl, unsafe.Pointer(&c.info)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *chardevChip) lines() uint32 {
+	return c.info.lines
+}
+
+// lineFile wraps the file descriptor of a requested line, non-blocking so closing it interrupts a pending read
+func lineFile(fd int32, name string) (*os.File, error) {
+	if err := syscall.SetNonblock(int(fd), true); err != nil {
+		syscall.Close(int(fd))
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func (c *chardevChip) requestEvents(offset uint32, activeLow bool) (gpioLine, error) {
+	request := gpioeventRequest{lineOffset: offset, handleFlags: gpioHandleRequestInput, eventFlags: gpioEventRequestRisingEdge}
+	if activeLow {
+		request.handleFlags |= gpioHandleRequestActiveLow
+	}
+	copy(request.consumerLabel[:], GPIOConsumer)
+	if err := ioctl(c.f, gpioGetLineEventIoctl, unsafe.Pointer(&request)); err != nil {
+		return nil, err
+	}
+	f, err := lineFile(request.fd, c.f.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &chardevLine{f: f}, nil
+}
+
+func (c *chardevChip) requestOutput(offset uint32, activeLow bool) (gpioLine, error) {
+	request := gpiohandleRequest{flags: gpioHandleRequestOutput, lines: 1}
+	request.lineOffsets[0] = offset
+	if activeLow {
+		request.flags |= gpioHandleRequestActiveLow
+	}
+	copy(request.consumerLabel[:], GPIOConsumer)
+	if err := ioctl(c.f, gpioGetLineHandleIoctl, unsafe.Pointer(&request)); err != nil {
+		return nil, err
+	}
+	f, err := lineFile(request.fd, c.f.Name())
+	if err != nil {
+		return nil, err
+	}
+	return &chardevLine{f: f}, nil
+}
+
+func (c *chardevChip) Close() error {
+	return c.f.Close()
+}
+
+// chardevLine is a line requested from a GPIO character device, either for events or as output
+type chardevLine struct {
+	f *os.File
+}
+
+func (l *chardevLine) value() (bool, error) {
+	var data gpiohandleData
+	err := ioctl(l.f, gpioHandleGetLineValuesIoctl, unsafe.Pointer(&data))
+	return data.values[0] != 0, err
+}
+
+func (l *chardevLine) setValue(value bool) error {
+	var data gpiohandleData
+	if value {
+		data.values[0] = 1
+	}
+	return ioctl(l.f, gpioHandleSetLineValuesIoctl, unsafe.Pointer(&data))
+}
+
+// waitEdge reads the next event, only rising edges being requested
+func (l *chardevLine) waitEdge() error {
+	event := make([]byte, gpioEventDataSize)
+	_, err := io.ReadFull(l.f, event)
+	return err
+}
+
+func (l *chardevLine) Close() error {
+	return l.f.Close()
+}
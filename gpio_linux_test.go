@@ -0,0 +1,30 @@
+package unipitt
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestGPIOStructSizes(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Size     uintptr
+		Expected uintptr
+	}{
+		{Name: "gpiochip_info", Size: unsafe.Sizeof(gpiochipInfo{}), Expected: 68},
+		{Name: "gpiohandle_request", Size: unsafe.Sizeof(gpiohandleRequest{}), Expected: 364},
+		{Name: "gpioevent_request", Size: unsafe.Sizeof(gpioeventRequest{}), Expected: 48},
+		{Name: "gpiohandle_data", Size: unsafe.Sizeof(gpiohandleData{}), Expected: 64},
+	}
+	for _, testCase := range cases {
+		if testCase.Size != testCase.Expected {
+			t.Fatalf("Expected struct %s to be %d bytes, got %d\n", testCase.Name, testCase.Expected, testCase.Size)
+		}
+	}
+}
+
+func TestOpenChardevMissing(t *testing.T) {
+	if _, err := openChardev("/dev/gpiochip-unipitt"); err == nil {
+		t.Fatal("Expected an error opening a missing GPIO chip, got none")
+	}
+}
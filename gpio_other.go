@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package unipitt
+
+import "errors"
+
+// openChardev fails, GPIO character devices being specific to Linux
+func openChardev(path string) (gpioChip, error) {
+	return nil, errors.New("GPIO character devices are only supported on Linux")
+}
@@ -0,0 +1,172 @@
+package unipitt
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeChip is a GPIO chip with lines which can be triggered by the test
+type fakeChip struct {
+	sync.Mutex
+	count     uint32
+	requested map[uint32]*fakeLine
+}
+
+func (c *fakeChip) lines() uint32 {
+	return c.count
+}
+
+func (c *fakeChip) request(offset uint32) *fakeLine {
+	c.Lock()
+	defer c.Unlock()
+	line := &fakeLine{edges: make(chan bool), closed: make(chan bool)}
+	c.requested[offset] = line
+	return line
+}
+
+func (c *fakeChip) requestEvents(offset uint32, activeLow bool) (gpioLine, error) {
+	return c.request(offset), nil
+}
+
+func (c *fakeChip) requestOutput(offset uint32, activeLow bool) (gpioLine, error) {
+	return c.request(offset), nil
+}
+
+func (c *fakeChip) Close() error {
+	return nil
+}
+
+// fakeLine is a requested line, reporting the edges sent on it
+type fakeLine struct {
+	sync.Mutex
+	current bool
+	edges   chan bool
+	closed  chan bool
+	once    sync.Once
+}
+
+func (l *fakeLine) value() (bool, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.current, nil
+}
+
+func (l *fakeLine) setValue(value bool) error {
+	l.Lock()
+	defer l.Unlock()
+	l.current = value
+	return nil
+}
+
+func (l *fakeLine) waitEdge() error {
+	select {
+	case <-l.edges:
+		return nil
+	case <-l.closed:
+		return errors.New("line closed")
+	}
+}
+
+func (l *fakeLine) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func TestGPIOBackend(t *testing.T) {
+	chip := &fakeChip{count: 28, requested: make(map[uint32]*fakeLine)}
+	openGPIOChip = func(path string) (gpioChip, error) {
+		return chip, nil
+	}
+	defer func() { openGPIOChip = openChardev }()
+
+	backend, err := NewBackend(BoardConfiguration{
+		Backend: BackendGPIO,
+		Chip:    "/dev/gpiochip0",
+		Prefix:  "pi_",
+		Lines: []GPIOLine{
+			{Name: "doorbell", Line: 17, ActiveLow: true},
+			{Name: "relay", Line: 27, Direction: GPIOOutput},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, outputs, err := backend.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 1 || len(outputs) != 1 {
+		t.Fatalf("Expected 1 input and 1 output, got %v and %v\n", inputs, outputs)
+	}
+
+	relay := outputs["pi_relay"]
+	if err := relay.Update(true); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := relay.Read(); err != nil || !value {
+		t.Fatalf("Expected to read back %t, got %t (%v)\n", true, value, err)
+	}
+
+	// The edges reported by the kernel end up as events, until the line is closed
+	events := make(chan Event)
+	done := make(chan bool)
+	defer close(done)
+	go inputs["pi_doorbell"].Watch(events, 50, done)
+	chip.requested[17].edges <- true
+	select {
+	case e := <-events:
+		if e.Name != "pi_doorbell" || !e.Value || e.Err != nil {
+			t.Fatalf("Expected a rising edge on %s, got %v\n", "pi_doorbell", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a rising edge, got none")
+	}
+	closeBackends(inputs, []Backend{backend})
+	select {
+	case e := <-events:
+		if e.Err == nil {
+			t.Fatalf("Expected an error once the line got closed, got %v\n", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected an error once the line got closed, got none")
+	}
+}
+
+func TestGPIOBackendMissingLine(t *testing.T) {
+	openGPIOChip = func(path string) (gpioChip, error) {
+		return &fakeChip{count: 8, requested: make(map[uint32]*fakeLine)}, nil
+	}
+	defer func() { openGPIOChip = openChardev }()
+
+	backend, _ := NewBackend(BoardConfiguration{Backend: BackendGPIO, Chip: "/dev/gpiochip0", Lines: []GPIOLine{{Name: "doorbell", Line: 17}}})
+	if _, _, err := backend.Discover(); err == nil || !strings.Contains(err.Error(), "line 17") {
+		t.Fatalf("Expected an error for a line beyond the chip, got %v\n", err)
+	}
+}
+
+func TestGPIOLineProblems(t *testing.T) {
+	c := Configuration{Boards: []BoardConfiguration{{
+		Backend: BackendGPIO,
+		Chip:    "/dev/gpiochip0",
+		Lines: []GPIOLine{
+			{Name: "doorbell", Line: 17},
+			{Name: "doorbell", Line: 18},
+			{Name: "relay", Line: 17},
+			{Name: "light/1", Line: 22},
+			{Name: "valve", Line: 23, Direction: "pwm"},
+		},
+	}}}
+	problems := c.boardProblems()
+	expected := []string{"more than one line", "mapped more than once", "without /", "direction"}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v\n", len(expected), problems)
+	}
+	for k, fragment := range expected {
+		if !strings.Contains(problems[k].Message, fragment) {
+			t.Fatalf("Expected problem %d to mention %q, got %s\n", k, fragment, problems[k].Message)
+		}
+	}
+}
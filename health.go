@@ -0,0 +1,206 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HealthStaleFactor is the number of polling intervals a poller can miss before it is considered hung
+	HealthStaleFactor = 20
+	// HealthMinStale is the lower bound on the time a poller can miss, to avoid flapping on very short intervals
+	HealthMinStale = 2 * time.Second
+	// HealthBrokerTimeout is how long the broker can stay disconnected before the handler is no longer considered live
+	HealthBrokerTimeout = 5 * time.Minute
+	// LivenessPath is the HTTP path serving the liveness check
+	LivenessPath = "/healthz"
+	// ReadinessPath is the HTTP path serving the readiness check
+	ReadinessPath = "/readyz"
+	// CheckOK is the result reported for a passing check
+	CheckOK = "ok"
+)
+
+// Status represents the outcome of a set of health checks
+type Status struct {
+	Healthy bool              `json:"healthy"`
+	Checks  map[string]string `json:"checks"`
+}
+
+// newStatus creates an empty, healthy status
+func newStatus() Status {
+	return Status{Healthy: true, Checks: make(map[string]string)}
+}
+
+// add records the outcome of a single check, marking the status unhealthy on error
+func (s *Status) add(name string, err error) {
+	if err != nil {
+		s.Healthy = false
+		s.Checks[name] = err.Error()
+		return
+	}
+	s.Checks[name] = CheckOK
+}
+
+// note records the outcome of a check for information only, without affecting the health
+func (s *Status) note(name string, err error) {
+	if err != nil {
+		s.Checks[name] = err.Error()
+		return
+	}
+	s.Checks[name] = CheckOK
+}
+
+// poller is implemented by the digital inputs which poll, to check their liveness
+type poller interface {
+	LastPoll() time.Time
+}
+
+// checkPollers verifies all polling inputs ticked recently enough
+func (h *Handler) checkPollers() error {
+	interval := time.Duration(atomic.LoadInt64(&h.interval)) * time.Millisecond
+	if interval == 0 {
+		return fmt.Errorf("polling not started")
+	}
+	stale := HealthStaleFactor * interval
+	if stale < HealthMinStale {
+		stale = HealthMinStale
+	}
+	for _, name := range sortedKeys(h.inputs) {
+		p, ok := h.inputs[name].(poller)
+		if !ok {
+			continue
+		}
+		last := p.LastPoll()
+		if last.IsZero() {
+			return fmt.Errorf("poller %s did not tick yet", name)
+		}
+		if since := time.Since(last); since > stale {
+			return fmt.Errorf("poller %s last ticked %s ago", name, since)
+		}
+	}
+	return nil
+}
+
+// checkBrokers verifies the MQTT clients are connected: all of them when mirroring, at least one otherwise
+func (h *Handler) checkBrokers() error {
+	connected := 0
+	for _, b := range h.brokers {
+		if b.connected() {
+			connected++
+		}
+	}
+	switch {
+	case connected == 0:
+		return fmt.Errorf("not connected to MQTT broker")
+	case connected < len(h.brokers) && h.configuration().BrokerMode == BrokerModeMirror:
+		return fmt.Errorf("connected to %d of %d MQTT brokers", connected, len(h.brokers))
+	}
+	return nil
+}
+
+// check verifies the MQTT client for a single broker is connected
+func (b *broker) check() error {
+	nanos := atomic.LoadInt64(&b.disconnectedSince)
+	if b.connected() {
+		return nil
+	}
+	if nanos == 0 {
+		return fmt.Errorf("not connected")
+	}
+	return fmt.Errorf("disconnected for %s", time.Since(time.Unix(0, nanos)).Round(time.Second))
+}
+
+// checkBrokerTimeout verifies the MQTT clients did not all stay disconnected for too long
+func (h *Handler) checkBrokerTimeout() error {
+	var shortest time.Duration
+	for k, b := range h.brokers {
+		nanos := atomic.LoadInt64(&b.disconnectedSince)
+		if nanos == 0 {
+			return nil
+		}
+		if since := time.Since(time.Unix(0, nanos)); k == 0 || since < shortest {
+			shortest = since
+		}
+	}
+	if shortest > HealthBrokerTimeout {
+		return fmt.Errorf("disconnected from MQTT broker for %s", shortest)
+	}
+	return nil
+}
+
+// checkSysFs verifies the sys fs roots can still be read
+func (h *Handler) checkSysFs() error {
+	for _, root := range h.sysFsRoots {
+		if err := checkRoot(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRoot verifies a single sys fs root can still be read
+func checkRoot(root string) error {
+	f, err := os.Open(root)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Readdirnames(1); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Liveness reports whether the handler is still making progress; a failure means it should be restarted
+func (h *Handler) Liveness() Status {
+	s := newStatus()
+	s.add("pollers", h.checkPollers())
+	s.add("broker", h.checkBrokerTimeout())
+	return s
+}
+
+// Readiness reports whether the handler is fully operational: pollers ticking, brokers connected and sys fs readable. The state of each broker is included as well.
+func (h *Handler) Readiness() Status {
+	s := newStatus()
+	s.add("pollers", h.checkPollers())
+	s.add("broker", h.checkBrokers())
+	for _, b := range h.brokers {
+		s.note("broker "+b.name, b.check())
+	}
+	s.add("sysfs", h.checkSysFs())
+	s.note("sensors", h.checkSensors())
+	return s
+}
+
+// statusHandler serves a status as JSON, with a 503 code when unhealthy
+func statusHandler(check func() Status) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := check()
+		w.Header().Set("Content-Type", "application/json")
+		if !s.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(s); err != nil {
+			healthLog.Error("Error encoding health status", "err", err)
+		}
+	}
+}
+
+// HealthMux creates the HTTP handler serving the liveness and readiness checks
+func (h *Handler) HealthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(LivenessPath, statusHandler(h.Liveness))
+	mux.HandleFunc(ReadinessPath, statusHandler(h.Readiness))
+	return mux
+}
+
+// ServeHealth serves the liveness and readiness checks over HTTP on the given address (blocking)
+func (h *Handler) ServeHealth(address string) error {
+	healthLog.Info("Serving health checks", "address", address)
+	return http.ListenAndServe(address, h.HealthMux())
+}
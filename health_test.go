@@ -0,0 +1,97 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckPollers(t *testing.T) {
+	reader := &DigitalInputReader{Name: "di_1_01"}
+	h := &Handler{inputs: map[string]DigitalInput{"di_1_01": reader}}
+	if err := h.checkPollers(); err == nil {
+		t.Fatal("Expected an error when polling did not start, got none")
+	}
+
+	h.interval = 50
+	if err := h.checkPollers(); err == nil {
+		t.Fatal("Expected an error when the poller did not tick yet, got none")
+	}
+
+	reader.lastPoll = time.Now().UnixNano()
+	if err := h.checkPollers(); err != nil {
+		t.Fatalf("Expected no error for a poller which just ticked, got %s\n", err)
+	}
+
+	reader.lastPoll = time.Now().Add(-time.Hour).UnixNano()
+	if err := h.checkPollers(); err == nil {
+		t.Fatal("Expected an error for a stale poller, got none")
+	}
+}
+
+func TestCheckBrokerTimeout(t *testing.T) {
+	primary, backup := &broker{name: "primary"}, &broker{name: "backup"}
+	h := &Handler{brokers: []*broker{primary, backup}}
+	if err := h.checkBrokerTimeout(); err != nil {
+		t.Fatalf("Expected no error when connected, got %s\n", err)
+	}
+	primary.disconnectedSince = time.Now().Add(-2 * HealthBrokerTimeout).UnixNano()
+	backup.disconnectedSince = time.Now().UnixNano()
+	if err := h.checkBrokerTimeout(); err != nil {
+		t.Fatalf("Expected no error when a broker is disconnected only shortly, got %s\n", err)
+	}
+	backup.disconnectedSince = primary.disconnectedSince
+	if err := h.checkBrokerTimeout(); err == nil {
+		t.Fatal("Expected an error when disconnected for too long, got none")
+	}
+}
+
+func TestCheckSysFs(t *testing.T) {
+	root, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	h := &Handler{sysFsRoots: []string{root}}
+	if err := h.checkSysFs(); err != nil {
+		t.Fatalf("Expected an empty sys fs root to be readable, got %s\n", err)
+	}
+	h.sysFsRoots = append(h.sysFsRoots, "foo")
+	if err := h.checkSysFs(); err == nil {
+		t.Fatal("Expected an error for a non-existing sys fs root, got none")
+	}
+}
+
+func TestHealthMux(t *testing.T) {
+	h := &Handler{
+		inputs:     map[string]DigitalInput{"di_1_01": &DigitalInputReader{Name: "di_1_01", lastPoll: time.Now().UnixNano()}},
+		interval:   50,
+		sysFsRoots: []string{"foo"},
+	}
+	cases := []struct {
+		Path     string
+		Expected int
+	}{
+		{Path: LivenessPath, Expected: http.StatusOK},
+		{Path: ReadinessPath, Expected: http.StatusServiceUnavailable},
+	}
+	for _, testCase := range cases {
+		rec := httptest.NewRecorder()
+		h.HealthMux().ServeHTTP(rec, httptest.NewRequest("GET", testCase.Path, nil))
+		if rec.Code != testCase.Expected {
+			t.Fatalf("Expected status code %d for %s, got %d\n", testCase.Expected, testCase.Path, rec.Code)
+		}
+		var s Status
+		if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Checks["pollers"] != CheckOK {
+			t.Fatalf("Expected pollers check to pass for %s, got %s\n", testCase.Path, s.Checks["pollers"])
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package unipitt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DebounceFilename holds the hardware debounce time of a digital input in millis, next to the di_value file
+	DebounceFilename = "debounce"
+	// CounterModeFilename enables (1) or disables (0) the hardware counter of a digital input, next to the di_value file
+	CounterModeFilename = "counter_mode"
+	// SettingDebounce is the name of the debounce setting in the config topics
+	SettingDebounce = "debounce"
+	// SettingCounter is the name of the counter mode setting in the config topics
+	SettingCounter = "counter"
+	// MaxDebounce is the longest debounce time in millis the board takes, held in a 16 bit register
+	MaxDebounce = 65535
+)
+
+// InputSettings are the hardware settings of a digital input; the ones left out are not touched
+type InputSettings struct {
+	// Debounce is the time in millis the input has to be stable for a change to be taken
+	Debounce *int `yaml:"debounce,omitempty"`
+	// Counter enables the hardware pulse counter of the input
+	Counter *bool `yaml:"counter,omitempty"`
+}
+
+// inputSetting describes how a setting is kept in the sys fs
+type inputSetting struct {
+	file string
+	// value formats the configured value as written to the file, if configured
+	value func(s InputSettings) (string, bool)
+	// parse checks a value given over MQTT, formatting it as written to the file
+	parse func(payload string) (string, error)
+}
+
+// inputSettings lists the supported settings, by name
+var inputSettings = map[string]inputSetting{
+	SettingDebounce: {
+		file: DebounceFilename,
+		value: func(s InputSettings) (string, bool) {
+			if s.Debounce == nil {
+				return "", false
+			}
+			return strconv.Itoa(*s.Debounce), true
+		},
+		parse: func(payload string) (string, error) {
+			debounce, err := strconv.Atoi(payload)
+			if err != nil || debounce < 0 || debounce > MaxDebounce {
+				return "", fmt.Errorf("invalid debounce %q, should be 0 to %d millis", payload, MaxDebounce)
+			}
+			return strconv.Itoa(debounce), nil
+		},
+	},
+	SettingCounter: {
+		file: CounterModeFilename,
+		value: func(s InputSettings) (string, bool) {
+			if s.Counter == nil {
+				return "", false
+			}
+			return formatBit(*s.Counter), true
+		},
+		parse: func(payload string) (string, error) {
+			switch payload {
+			case MsgTrueValue:
+				return formatBit(true), nil
+			case MsgFalseValue:
+				return formatBit(false), nil
+			}
+			return "", fmt.Errorf("invalid counter mode %q, should be %s or %s", payload, MsgTrueValue, MsgFalseValue)
+		},
+	},
+}
+
+// formatBit formats a flag as written to the sys fs
+func formatBit(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+// inputSettingProblems checks the configured settings of the inputs, and the config prefix being apart from the command prefix
+func (c *Configuration) inputSettingProblems() (problems []Problem) {
+	for _, name := range sortedKeys(c.Inputs) {
+		if debounce := c.Inputs[name].Debounce; debounce != nil && (*debounce < 0 || *debounce > MaxDebounce) {
+			problems = append(problems, Problem{Key: name, Section: "inputs", Message: fmt.Sprintf("input %s: debounce %d should be 0 to %d millis", name, *debounce, MaxDebounce)})
+		}
+	}
+	for _, config := range sortedKeys(c.configPrefixes()) {
+		for _, command := range sortedKeys(c.commandPrefixes()) {
+			if config == command || strings.HasPrefix(config, command+"/") || strings.HasPrefix(command, config+"/") {
+				problems = append(problems, Problem{Key: "config_prefix", Message: fmt.Sprintf("config prefix %s overlaps with command prefix %s, so commands could be taken for settings", config, command)})
+			}
+		}
+	}
+	return
+}
+
+// configPrefixes returns the config prefixes, with the board aliases filled in
+func (c *Configuration) configPrefixes() map[string]bool {
+	prefixes := make(map[string]bool)
+	if c.ConfigPrefix == "" {
+		return prefixes
+	}
+	for _, b := range c.BoardList() {
+		prefixes[expand(c.ConfigPrefix, b.Alias)] = true
+	}
+	return prefixes
+}
+
+// ConfigFilters returns the wildcard topic filters to receive the input settings on, one per board alias; empty without config prefix
+func (c *Configuration) ConfigFilters() (filters []string) {
+	for _, prefix := range sortedKeys(c.configPrefixes()) {
+		filters = append(filters, prefix+"/+/+"+CommandSuffix)
+	}
+	return
+}
+
+// settingTopic finds the input name and setting for a config topic, like <config prefix>/di_1_01/debounce/set
+func (c *Configuration) settingTopic(topic string) (name string, setting string, ok bool) {
+	for prefix := range c.configPrefixes() {
+		if topicMatches(prefix+"/+/+"+CommandSuffix, topic) {
+			levels := strings.Split(strings.TrimSuffix(strings.TrimPrefix(topic, prefix+"/"), CommandSuffix), "/")
+			return levels[0], levels[1], true
+		}
+	}
+	return
+}
+
+// settingStateTopic returns the topic to publish the current value of a setting on
+func (c *Configuration) settingStateTopic(name string, setting string) string {
+	return expand(c.ConfigPrefix, c.board(name).Alias) + "/" + name + "/" + setting
+}
+
+// readSetting reads a setting of the digital input in the folder
+func readSetting(folder string, file string) (string, error) {
+	content, err := ioutil.ReadFile(path.Join(folder, file))
+	return strings.TrimSpace(string(content)), err
+}
+
+// applySetting brings a setting of a sys fs input to the value, verifying the value read back. It returns the value found before, which differs when it drifted.
+func (h *Handler) applySetting(name string, setting string, value string) (previous string, err error) {
+	reader, ok := h.inputs[name].(*DigitalInputReader)
+	if !ok {
+		return "", fmt.Errorf("no sys fs digital input %s", name)
+	}
+	s, ok := inputSettings[setting]
+	if !ok {
+		return "", fmt.Errorf("unknown setting %s", setting)
+	}
+	return applyFile(reader.Path, s.file, value)
+}
+
+// applyFile writes the value to a settings file in the folder unless it has it already, verifying the value read back. It returns the value found before.
+func applyFile(folder string, file string, value string) (previous string, err error) {
+	if previous, err = readSetting(folder, file); err != nil || previous == value {
+		return
+	}
+	if err = ioutil.WriteFile(path.Join(folder, file), []byte(value), 0644); err != nil {
+		return
+	}
+	current, err := readSetting(folder, file)
+	if err == nil && current != value {
+		err = fmt.Errorf("read back %s after writing %s", current, value)
+	}
+	return
+}
+
+// setupInputSettings applies the configured settings of the inputs, reporting the ones which drifted from the configuration
+func (h *Handler) setupInputSettings(c *Configuration) {
+	for _, name := range sortedKeys(c.Inputs) {
+		for _, setting := range sortedKeys(inputSettings) {
+			value, ok := inputSettings[setting].value(c.Inputs[name])
+			if !ok {
+				continue
+			}
+			previous, err := h.applySetting(name, setting, value)
+			if err != nil {
+				configLog.Error("Error applying input setting", "name", name, "setting", setting, "value", value, "err", err)
+				continue
+			}
+			if previous != value {
+				configLog.Warn("Input setting drifted from the configuration, applied it", "name", name, "setting", setting, "found", previous, "value", value)
+			}
+		}
+	}
+}
+
+// onSetting changes a setting of an input as received on a config topic, publishing the value it got
+func (h *Handler) onSetting(name string, setting string, payload []byte) {
+	s, ok := inputSettings[setting]
+	if !ok {
+		configLog.Warn("Unknown input setting", "name", name, "setting", setting)
+		return
+	}
+	value, err := s.parse(strings.TrimSpace(string(payload)))
+	if err != nil {
+		configLog.Warn("Invalid input setting", "name", name, "setting", setting, "err", err)
+		return
+	}
+	if _, err := h.applySetting(name, setting, value); err != nil {
+		configLog.Error("Error changing input setting", "name", name, "setting", setting, "value", value, "err", err)
+		return
+	}
+	configLog.Info("Changed input setting", "name", name, "setting", setting, "value", value)
+	h.publishRetained(h.configuration().settingStateTopic(name, setting), strings.TrimSpace(string(payload)))
+}
@@ -0,0 +1,147 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// makeSettingsBoard creates a sys fs root with a digital input having the given settings files
+func makeSettingsBoard(t *testing.T, debounce string, counterMode string) (*Handler, string) {
+	root := makeBoard(t, "di_1_01")
+	folder := filepath.Join(root, "di_1_01")
+	for file, content := range map[string]string{DiFilename: "0", DebounceFilename: debounce + "\n", CounterModeFilename: counterMode + "\n"} {
+		if err := ioutil.WriteFile(filepath.Join(folder, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputs, outputs, backends, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Handler{inputs: inputs, writerMap: outputs, backends: backends, config: DefaultConfiguration()}, folder
+}
+
+func TestSetupInputSettings(t *testing.T) {
+	h, folder := makeSettingsBoard(t, "10", "0")
+	defer os.RemoveAll(filepath.Dir(folder))
+	defer h.Close()
+
+	debounce, counter := 50, true
+	c := DefaultConfiguration()
+	c.Inputs = map[string]InputSettings{"di_1_01": {Debounce: &debounce, Counter: &counter}, "di_9_01": {Counter: &counter}}
+	h.setupInputSettings(&c)
+	cases := []struct {
+		File     string
+		Expected string
+	}{
+		{File: DebounceFilename, Expected: "50"},
+		{File: CounterModeFilename, Expected: "1"},
+	}
+	for _, testCase := range cases {
+		if value, err := readSetting(folder, testCase.File); err != nil || value != testCase.Expected {
+			t.Fatalf("Expected %s to be %s, got %s (%v)\n", testCase.File, testCase.Expected, value, err)
+		}
+	}
+
+	// Settings which did not drift are left alone
+	if previous, err := h.applySetting("di_1_01", SettingDebounce, "50"); err != nil || previous != "50" {
+		t.Fatalf("Expected %s to be kept at %s, got %s (%v)\n", SettingDebounce, "50", previous, err)
+	}
+	if _, err := h.applySetting("di_9_01", SettingDebounce, "50"); err == nil {
+		t.Fatal("Expected an error for a missing input, got none")
+	}
+}
+
+func TestSettingTopic(t *testing.T) {
+	c := Configuration{
+		ConfigPrefix: "unipitt/{board}/config",
+		BoardID:      "neuron",
+		Boards:       []BoardConfiguration{{Root: "/sys/devices/platform/unipi_plc"}, {Root: "/tmp/fake", Alias: "fake", Prefix: "fake_"}},
+	}
+	cases := []struct {
+		Topic   string
+		Name    string
+		Setting string
+		OK      bool
+	}{
+		{Topic: "unipitt/neuron/config/di_1_01/debounce/set", Name: "di_1_01", Setting: SettingDebounce, OK: true},
+		{Topic: "unipitt/fake/config/fake_di_1_01/counter/set", Name: "fake_di_1_01", Setting: SettingCounter, OK: true},
+		{Topic: "unipitt/neuron/config/di_1_01/debounce"},
+		{Topic: "unipitt/neuron/di_1_01/set"},
+	}
+	for _, testCase := range cases {
+		name, setting, ok := c.settingTopic(testCase.Topic)
+		if name != testCase.Name || setting != testCase.Setting || ok != testCase.OK {
+			t.Fatalf("Expected %s, %s (%t) for %s, got %s, %s (%t)\n", testCase.Name, testCase.Setting, testCase.OK, testCase.Topic, name, setting, ok)
+		}
+	}
+	if filters := c.ConfigFilters(); len(filters) != 2 || filters[0] != "unipitt/fake/config/+/+/set" {
+		t.Fatalf("Expected a config filter per board, got %v\n", filters)
+	}
+}
+
+func TestOnSetting(t *testing.T) {
+	h, folder := makeSettingsBoard(t, "10", "0")
+	defer os.RemoveAll(filepath.Dir(folder))
+	defer h.Close()
+	h.config.ConfigPrefix = "unipitt/config"
+	client := newFakeClient()
+	h.brokers = []*broker{{name: "fake", client: client}}
+	h.subscribe(client, h.subscriptions(&h.config))
+
+	cases := []struct {
+		Topic    string
+		Payload  string
+		File     string
+		Expected string
+	}{
+		{Topic: "unipitt/config/di_1_01/debounce/set", Payload: "25", File: DebounceFilename, Expected: "25"},
+		{Topic: "unipitt/config/di_1_01/debounce/set", Payload: "-3", File: DebounceFilename, Expected: "25"},
+		{Topic: "unipitt/config/di_1_01/counter/set", Payload: "ON", File: CounterModeFilename, Expected: "1"},
+		{Topic: "unipitt/config/di_1_01/counter/set", Payload: "maybe", File: CounterModeFilename, Expected: "1"},
+	}
+	for _, testCase := range cases {
+		if !client.deliver(testCase.Topic, testCase.Payload) {
+			t.Fatalf("Expected a subscription for %s\n", testCase.Topic)
+		}
+		if value, err := readSetting(folder, testCase.File); err != nil || value != testCase.Expected {
+			t.Fatalf("Expected %s to be %s after %q, got %s (%v)\n", testCase.File, testCase.Expected, testCase.Payload, value, err)
+		}
+	}
+	if len(client.published) != 2 || client.published[0].topic != "unipitt/config/di_1_01/debounce" || string(client.published[1].payload) != MsgTrueValue {
+		t.Fatalf("Expected the changed settings to be published, got %v\n", client.published)
+	}
+}
+
+func TestInputSettingProblems(t *testing.T) {
+	debounce := 70000
+	c := DefaultConfiguration()
+	c.Inputs = map[string]InputSettings{"di_1_01": {Debounce: &debounce}}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "debounce 70000") {
+		t.Fatalf("Expected an error for the debounce, got %v\n", err)
+	}
+
+	cases := []struct {
+		CommandPrefix string
+		ConfigPrefix  string
+		Overlaps      bool
+	}{
+		{CommandPrefix: "unipitt/neuron", ConfigPrefix: "unipitt/neuron", Overlaps: true},
+		{CommandPrefix: "unipitt", ConfigPrefix: "unipitt/config", Overlaps: true},
+		{CommandPrefix: "unipitt/neuron/set", ConfigPrefix: "unipitt/neuron", Overlaps: true},
+		{CommandPrefix: "unipitt/neuron", ConfigPrefix: "unipitt/neuron-config"},
+		{CommandPrefix: "unipitt/cmd", ConfigPrefix: "unipitt/config"},
+		{ConfigPrefix: "unipitt"},
+	}
+	for _, testCase := range cases {
+		c := DefaultConfiguration()
+		c.CommandPrefix, c.ConfigPrefix = testCase.CommandPrefix, testCase.ConfigPrefix
+		err := c.Validate()
+		if overlaps := err != nil && strings.Contains(err.Error(), "overlaps"); overlaps != testCase.Overlaps {
+			t.Fatalf("Expected overlap %t for %s and %s, got %v\n", testCase.Overlaps, testCase.CommandPrefix, testCase.ConfigPrefix, err)
+		}
+	}
+}
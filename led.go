@@ -0,0 +1,113 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// LedFilename holds the brightness of a user LED, 0 being off
+	LedFilename = "brightness"
+	// LedFolderRegex is the regular expression for the folders of the user LEDs
+	LedFolderRegex = "led_[0-9]_[0-9]{2}"
+	// StatusBlinkInterval is the time the status LEDs stay on or off while blinking, as well as the duration of a flash
+	StatusBlinkInterval = 250 * time.Millisecond
+)
+
+// LedWriter implements the digital output for a user LED in the sys fs
+type LedWriter struct {
+	Name string
+	Path string
+}
+
+// Update switches the LED on or off
+func (l *LedWriter) Update(value bool) error {
+	err := ioutil.WriteFile(path.Join(l.Path, LedFilename), []byte(formatBit(value)+"\n"), 0644)
+	if err == nil {
+		outputsLog.Debug("Updated value of user LED", "name", l.Name, "value", value)
+	}
+	return err
+}
+
+// Read reads back whether the LED is on
+func (l *LedWriter) Read() (bool, error) {
+	b, err := ioutil.ReadFile(path.Join(l.Path, LedFilename))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(b)) != "0", nil
+}
+
+// FindLedWriters finds the user LEDs under the root (sys) folder
+func FindLedWriters(root string) (leds map[string]LedWriter, err error) {
+	paths, err := findPathsByRegex(root, LedFolderRegex)
+	if err != nil {
+		outputsLog.Error("Error finding user LED paths", "root", root, "err", err)
+		return
+	}
+	outputsLog.Info("Found matching user LED paths", "count", len(paths))
+	leds = make(map[string]LedWriter)
+	for _, folder := range paths {
+		_, name := path.Split(folder)
+		leds[name] = LedWriter{Name: name, Path: folder}
+	}
+	return
+}
+
+// setupStatusLeds takes the status LEDs out of the outputs controlled over MQTT
+func (h *Handler) setupStatusLeds(c *Configuration) {
+	h.statusLeds = make(map[string]DigitalOutput)
+	for _, name := range c.StatusLeds {
+		led, ok := h.writerMap[name]
+		if !ok {
+			healthLog.Warn("No user LED to show the status on", "name", name)
+			continue
+		}
+		h.statusLeds[name] = led
+		delete(h.writerMap, name)
+	}
+}
+
+// status determines the value of the status LEDs for the tick: blinking while no broker is connected, off for a flash after publishing a trigger, otherwise on when healthy
+func (h *Handler) status(tick int) bool {
+	if h.checkBrokers() != nil {
+		return tick%2 == 0
+	}
+	if atomic.CompareAndSwapInt32(&h.flash, 1, 0) {
+		return false
+	}
+	return h.Readiness().Healthy
+}
+
+// Indicate shows the status on the status LEDs until done, switching them off then
+func (h *Handler) Indicate(done chan bool) {
+	if len(h.statusLeds) == 0 {
+		return
+	}
+	ticker := time.NewTicker(StatusBlinkInterval)
+	defer ticker.Stop()
+	set := func(value bool) {
+		for _, name := range sortedKeys(h.statusLeds) {
+			if err := h.statusLeds[name].Update(value); err != nil {
+				healthLog.Error("Error updating status LED", "name", name, "err", err)
+			}
+		}
+	}
+	value := false
+	set(value)
+	for tick := 0; ; tick++ {
+		select {
+		case <-ticker.C:
+			if next := h.status(tick); next != value {
+				value = next
+				set(value)
+			}
+		case <-done:
+			set(false)
+			return
+		}
+	}
+}
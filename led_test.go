@@ -0,0 +1,92 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLedWriter(t *testing.T) {
+	root := makeBoard(t, "led_1_01", "led_1_02", "do_1_01")
+	defer os.RemoveAll(root)
+	for _, name := range []string{"led_1_01", "led_1_02"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name, LedFilename), []byte("0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backend, _ := NewBackend(BoardConfiguration{Root: root, Prefix: "fake_"})
+	_, outputs, err := backend.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 3 {
+		t.Fatalf("Expected the user LEDs among the outputs, got %v\n", outputs)
+	}
+	cases := []struct {
+		Value    bool
+		Expected string
+	}{
+		{Value: true, Expected: "1\n"},
+		{Value: false, Expected: "0\n"},
+	}
+	for _, testCase := range cases {
+		if ack := execute("fake_led_1_02", outputs["fake_led_1_02"], testCase.Value); !ack.Success {
+			t.Fatalf("Expected the user LED to switch, got %v\n", ack)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(root, "led_1_02", LedFilename))
+		if err != nil || string(content) != testCase.Expected {
+			t.Fatalf("Expected %q, got %q (%v)\n", testCase.Expected, content, err)
+		}
+	}
+}
+
+func TestStatusLeds(t *testing.T) {
+	root := makeBoard(t, "led_1_01", "led_1_02")
+	defer os.RemoveAll(root)
+	led := filepath.Join(root, "led_1_01", LedFilename)
+	if err := ioutil.WriteFile(led, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, outputs, _, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfiguration()
+	c.StatusLeds = []string{"led_1_01"}
+	client := newFakeClient()
+	client.connected = false
+	h := &Handler{writerMap: outputs, config: c, brokers: []*broker{{name: "fake", client: client}}, interval: DefaultPollingInterval}
+	h.setupStatusLeds(&c)
+	if _, ok := h.writerMap["led_1_01"]; ok || len(h.statusLeds) != 1 {
+		t.Fatalf("Expected the status LED to no longer be controlled over MQTT, got %v\n", h.writerMap)
+	}
+
+	// Blinking while disconnected
+	if !h.status(0) || h.status(1) {
+		t.Fatal("Expected the status LEDs to blink while disconnected")
+	}
+	// Flashing off once after publishing, on while healthy
+	client.connected = true
+	atomic.StoreInt32(&h.flash, 1)
+	if h.status(0) || !h.status(1) || !h.status(2) {
+		t.Fatal("Expected the status LEDs to flash once, then stay on")
+	}
+
+	done := make(chan bool)
+	go h.Indicate(done)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		content, _ := ioutil.ReadFile(led)
+		if string(content) == "1\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the status LED to be on, got %q\n", content)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+}
@@ -0,0 +1,334 @@
+package unipitt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level represents the severity of a log line
+type Level int
+
+const (
+	// LevelDebug is used for verbose output, only relevant when troubleshooting
+	LevelDebug Level = iota
+	// LevelInfo is used for regular operational messages
+	LevelInfo
+	// LevelWarn is used for unexpected situations the daemon recovers from
+	LevelWarn
+	// LevelError is used for failures
+	LevelError
+)
+
+const (
+	// LogFormatLogfmt writes log lines as logfmt key=value pairs
+	LogFormatLogfmt = "logfmt"
+	// LogFormatJSON writes log lines as JSON objects
+	LogFormatJSON = "json"
+	// logTimeFormat is the timestamp format used in the log lines
+	logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+const (
+	// SubsystemPoller logs the polling of the inputs
+	SubsystemPoller = "poller"
+	// SubsystemMQTT logs the MQTT client interactions
+	SubsystemMQTT = "mqtt"
+	// SubsystemOutputs logs the updates of the outputs
+	SubsystemOutputs = "outputs"
+	// SubsystemConfig logs the reading of the configuration
+	SubsystemConfig = "config"
+	// SubsystemHealth logs the health checks and systemd notifications
+	SubsystemHealth = "health"
+	// SubsystemModbus logs the Modbus TCP server
+	SubsystemModbus = "modbus"
+	// SubsystemCounter logs the metering with the hardware counters
+	SubsystemCounter = "counter"
+	// SubsystemSensor logs the reading of the 1-Wire temperature sensors
+	SubsystemSensor = "sensor"
+	// SubsystemTrace logs the recording and replaying of traces
+	SubsystemTrace = "trace"
+)
+
+// subsystems lists the subsystems which can be given their own level
+var subsystems = map[string]bool{
+	SubsystemPoller:  true,
+	SubsystemMQTT:    true,
+	SubsystemOutputs: true,
+	SubsystemConfig:  true,
+	SubsystemHealth:  true,
+	SubsystemModbus:  true,
+	SubsystemCounter: true,
+	SubsystemSensor:  true,
+	SubsystemTrace:   true,
+}
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// String returns the name of the level
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return strconv.Itoa(int(l))
+}
+
+// ParseLevel parses a level from its name
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// LoggingConfiguration represents the log format, default level and per-subsystem levels
+type LoggingConfiguration struct {
+	Level  string            `yaml:"level"`
+	Format string            `yaml:"format"`
+	Levels map[string]string `yaml:"levels"`
+}
+
+// ParseLevels parses per-subsystem levels given as a comma-separated list of subsystem=level pairs
+func ParseLevels(value string) (levels map[string]string, err error) {
+	levels = make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid subsystem level %q, expected subsystem=level", pair)
+		}
+		levels[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return
+}
+
+// logSettings holds the process-wide logging setup shared by all loggers
+type logSettings struct {
+	sync.Mutex
+	out    io.Writer
+	format string
+	level  Level
+	levels map[string]Level
+}
+
+var settings = &logSettings{
+	out:    os.Stderr,
+	format: LogFormatLogfmt,
+	level:  LevelInfo,
+	levels: make(map[string]Level),
+}
+
+// SetLogOutput sets the destination all loggers write to
+func SetLogOutput(w io.Writer) {
+	settings.Lock()
+	defer settings.Unlock()
+	settings.out = w
+}
+
+// Validate checks the format, the levels and the subsystems of the logging configuration
+func (c LoggingConfiguration) Validate() error {
+	switch c.Format {
+	case "", LogFormatLogfmt, LogFormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q", c.Format)
+	}
+	if c.Level != "" {
+		if _, err := ParseLevel(c.Level); err != nil {
+			return err
+		}
+	}
+	for _, subsystem := range sortedKeys(c.Levels) {
+		if !subsystems[subsystem] {
+			return fmt.Errorf("unknown log subsystem %q, should be one of %s", subsystem, strings.Join(sortedKeys(subsystems), ", "))
+		}
+		if _, err := ParseLevel(c.Levels[subsystem]); err != nil {
+			return fmt.Errorf("subsystem %s: %s", subsystem, err)
+		}
+	}
+	return nil
+}
+
+// ConfigureLogging applies the given logging configuration. An empty format or level leaves the current setting untouched, while the per-subsystem levels replace the current ones. Nothing is applied for an invalid configuration.
+func ConfigureLogging(c LoggingConfiguration) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	settings.Lock()
+	defer settings.Unlock()
+	if c.Format != "" {
+		settings.format = c.Format
+	}
+	if c.Level != "" {
+		settings.level, _ = ParseLevel(c.Level)
+	}
+	settings.levels = make(map[string]Level)
+	for subsystem, name := range c.Levels {
+		settings.levels[subsystem], _ = ParseLevel(name)
+	}
+	return nil
+}
+
+// Logger writes structured, levelled log lines for a given subsystem
+type Logger struct {
+	Subsystem string
+}
+
+// NewLogger creates a logger for the given subsystem
+func NewLogger(subsystem string) *Logger {
+	return &Logger{Subsystem: subsystem}
+}
+
+var (
+	pollerLog  = NewLogger(SubsystemPoller)
+	mqttLog    = NewLogger(SubsystemMQTT)
+	outputsLog = NewLogger(SubsystemOutputs)
+	configLog  = NewLogger(SubsystemConfig)
+	healthLog  = NewLogger(SubsystemHealth)
+	modbusLog  = NewLogger(SubsystemModbus)
+	traceLog   = NewLogger(SubsystemTrace)
+	counterLog = NewLogger(SubsystemCounter)
+	sensorLog  = NewLogger(SubsystemSensor)
+)
+
+// Enabled checks whether a log line at the given level would be written for this subsystem
+func (l *Logger) Enabled(level Level) bool {
+	settings.Lock()
+	defer settings.Unlock()
+	return level >= l.threshold()
+}
+
+// threshold returns the minimum level for this subsystem; expects the settings to be locked
+func (l *Logger) threshold() Level {
+	if level, ok := settings.levels[l.Subsystem]; ok {
+		return level
+	}
+	return settings.level
+}
+
+// Debug logs a message with optional key-value pairs at debug level
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+// Info logs a message with optional key-value pairs at info level
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+// Warn logs a message with optional key-value pairs at warn level
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+// Error logs a message with optional key-value pairs at error level
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+// log formats and writes a single log line
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	settings.Lock()
+	defer settings.Unlock()
+	if level < l.threshold() {
+		return
+	}
+
+	fields := []interface{}{
+		"time", time.Now().Format(logTimeFormat),
+		"level", level.String(),
+		"subsystem", l.Subsystem,
+		"msg", msg,
+	}
+	fields = append(fields, keyvals...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, nil)
+	}
+
+	var buf bytes.Buffer
+	if settings.format == LogFormatJSON {
+		writeJSON(&buf, fields)
+	} else {
+		writeLogfmt(&buf, fields)
+	}
+	buf.WriteByte('\n')
+	settings.out.Write(buf.Bytes())
+}
+
+// fieldValue converts a logged value to something that can be encoded
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case map[string]string:
+		// Keep maps readable and deterministic
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for k, key := range keys {
+			parts[k] = key + ":" + v[key]
+		}
+		return strings.Join(parts, ",")
+	}
+	return value
+}
+
+// writeLogfmt encodes the key-value pairs as logfmt
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	for k := 0; k < len(fields); k += 2 {
+		if k > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(fields[k]))
+		buf.WriteByte('=')
+		value := fmt.Sprint(fieldValue(fields[k+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+// writeJSON encodes the key-value pairs as a JSON object, keeping the order of the keys
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for k := 0; k < len(fields); k += 2 {
+		if k > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[k]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(fieldValue(fields[k+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[k+1]))
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
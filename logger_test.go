@@ -0,0 +1,146 @@
+package unipitt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// resetLogging restores the default logging setup after a test
+func resetLogging() {
+	SetLogOutput(os.Stderr)
+	settings.format = LogFormatLogfmt
+	settings.level = LevelInfo
+	settings.levels = make(map[string]Level)
+}
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Expected Level
+		HasError bool
+	}{
+		{Name: "debug", Expected: LevelDebug},
+		{Name: "INFO", Expected: LevelInfo},
+		{Name: "warning", Expected: LevelWarn},
+		{Name: "error", Expected: LevelError},
+		{Name: "foo", Expected: LevelInfo, HasError: true},
+	}
+	for _, testCase := range cases {
+		level, err := ParseLevel(testCase.Name)
+		if (err != nil) != testCase.HasError {
+			t.Fatalf("Expected error %t for %s, got %v\n", testCase.HasError, testCase.Name, err)
+		}
+		if level != testCase.Expected {
+			t.Fatalf("Expected level %s for %s, got %s\n", testCase.Expected, testCase.Name, level)
+		}
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels("poller=warn, mqtt=debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if levels["poller"] != "warn" || levels["mqtt"] != "debug" {
+		t.Fatalf("Unexpected levels %v\n", levels)
+	}
+	if _, err := ParseLevels("poller"); err == nil {
+		t.Fatal("Expected an error for a level without subsystem, got none")
+	}
+}
+
+func TestConfigureLoggingInvalid(t *testing.T) {
+	defer resetLogging()
+	cases := []LoggingConfiguration{
+		{Format: "xml"},
+		{Level: "foo"},
+		{Levels: map[string]string{"poller": "foo"}},
+		{Levels: map[string]string{"mqt": "debug"}},
+	}
+	for _, testCase := range cases {
+		if err := ConfigureLogging(testCase); err == nil {
+			t.Fatalf("Expected an error for configuration %v, got none\n", testCase)
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	defer resetLogging()
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	err := ConfigureLogging(LoggingConfiguration{Level: "warn", Levels: map[string]string{SubsystemMQTT: "debug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pollerLog.Info("hidden")
+	pollerLog.Warn("shown")
+	mqttLog.Debug("verbose")
+
+	output := buf.String()
+	if strings.Contains(output, "hidden") {
+		t.Fatal("Expected info message to be filtered for the poller")
+	}
+	if !strings.Contains(output, "level=warn subsystem=poller msg=shown") {
+		t.Fatalf("Expected warn message for the poller, got %s\n", output)
+	}
+	if !strings.Contains(output, "level=debug subsystem=mqtt msg=verbose") {
+		t.Fatalf("Expected debug message for mqtt, got %s\n", output)
+	}
+	if !mqttLog.Enabled(LevelDebug) || pollerLog.Enabled(LevelDebug) {
+		t.Fatal("Expected debug to be enabled for mqtt only")
+	}
+
+	// Levels no longer given are dropped, as on a reload
+	if err := ConfigureLogging(LoggingConfiguration{Levels: map[string]string{SubsystemPoller: "debug"}}); err != nil {
+		t.Fatal(err)
+	}
+	if mqttLog.Enabled(LevelDebug) || !pollerLog.Enabled(LevelDebug) {
+		t.Fatal("Expected debug to be enabled for the poller only")
+	}
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	defer resetLogging()
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+
+	configLog.Error("Error reading config file", "file", "/etc/unipitt.yaml", "err", errors.New("no such file"), "empty", "")
+
+	expected := `level=error subsystem=config msg="Error reading config file" file=/etc/unipitt.yaml err="no such file" empty=""`
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("Expected log line to contain %s, got %s\n", expected, buf.String())
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	defer resetLogging()
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	if err := ConfigureLogging(LoggingConfiguration{Format: LogFormatJSON}); err != nil {
+		t.Fatal(err)
+	}
+
+	outputsLog.Info("Updated value of digital output", "name", "do_2_01", "value", true)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"level":     "info",
+		"subsystem": "outputs",
+		"msg":       "Updated value of digital output",
+		"name":      "do_2_01",
+		"value":     true,
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Fatalf("Expected %s to be %v, got %v\n", k, v, line[k])
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package unipitt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// BackendModbus talks to the Modbus TCP server of a UniPi Neuron, e.g. unipi-tcp-server
+	BackendModbus = "modbus"
+	// DefaultModbusPort is used when the address of a Modbus board has no port
+	DefaultModbusPort = "502"
+	// DefaultModbusTimeout limits connecting and waiting for a Modbus response
+	DefaultModbusTimeout = 2 * time.Second
+	// ModbusGroupSize is the offset between the registers and coils of consecutive groups in the Neuron register map
+	ModbusGroupSize = 100
+	// ModbusMaxChannels is the number of channels fitting in the bitmap register of a group
+	ModbusMaxChannels = 16
+)
+
+// Modbus function codes and framing
+const (
+	modbusReadHoldingRegisters = 0x03
+	modbusWriteSingleCoil      = 0x05
+	modbusException            = 0x80
+	modbusCoilOn               = 0xff00
+	modbusProtocolIdentifier   = 0
+	modbusHeaderLength         = 7
+	modbusMaxFrameLength       = 260
+)
+
+// DefaultModbusGroups is the layout of a Neuron S103: 4 digital inputs and 4 digital outputs in group 1
+var DefaultModbusGroups = []ModbusGroup{{DI: 4, DO: 4}}
+
+// ModbusGroup is the number of channels of a group in the Neuron register map. Group n has the digital input bitmap in holding register 100*(n-1), the output bitmap in the next one, and its digital outputs followed by its relays as coils from 100*(n-1).
+type ModbusGroup struct {
+	DI int `yaml:"di"`
+	DO int `yaml:"do"`
+	RO int `yaml:"ro"`
+}
+
+// ModbusError is an exception response of a Modbus server
+type ModbusError struct {
+	Function byte
+	Code     byte
+}
+
+// Error formats the exception
+func (e *ModbusError) Error() string {
+	return fmt.Sprintf("modbus exception %d for function %d", e.Code, e.Function)
+}
+
+// readModbusFrame reads a Modbus TCP frame: the MBAP header followed by the PDU
+func readModbusFrame(r io.Reader) (transaction uint16, unit byte, pdu []byte, err error) {
+	header := make([]byte, modbusHeaderLength)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	transaction = binary.BigEndian.Uint16(header[0:])
+	if protocol := binary.BigEndian.Uint16(header[2:]); protocol != modbusProtocolIdentifier {
+		err = fmt.Errorf("unknown modbus protocol identifier %d", protocol)
+		return
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length < 2 || length > modbusMaxFrameLength-6 {
+		err = fmt.Errorf("invalid modbus frame length %d", length)
+		return
+	}
+	unit = header[6]
+	pdu = make([]byte, length-1)
+	_, err = io.ReadFull(r, pdu)
+	return
+}
+
+// writeModbusFrame writes the PDU as a Modbus TCP frame
+func writeModbusFrame(w io.Writer, transaction uint16, unit byte, pdu []byte) error {
+	frame := make([]byte, modbusHeaderLength+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], transaction)
+	binary.BigEndian.PutUint16(frame[2:], modbusProtocolIdentifier)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = unit
+	copy(frame[modbusHeaderLength:], pdu)
+	_, err := w.Write(frame)
+	return err
+}
+
+// modbusAddress adds the default port to an address without one
+func modbusAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, DefaultModbusPort)
+	}
+	return address
+}
+
+// ModbusClient is a Modbus TCP client, (re)connecting on the first request after an error
+type ModbusClient struct {
+	Address string
+	UnitID  byte
+	Timeout time.Duration
+	// mu guards the connection, requests are sent one at a time
+	mu          sync.Mutex
+	conn        net.Conn
+	transaction uint16
+}
+
+// NewModbusClient creates a client for the Modbus TCP server at the address
+func NewModbusClient(address string, unitID byte) *ModbusClient {
+	return &ModbusClient{Address: modbusAddress(address), UnitID: unitID, Timeout: DefaultModbusTimeout}
+}
+
+// request sends the request PDU and returns the data of the response, an exception response as ModbusError
+func (c *ModbusClient) request(pdu []byte) (data []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if c.conn, err = net.DialTimeout("tcp", c.Address, c.Timeout); err != nil {
+			c.conn = nil
+			return
+		}
+	}
+	c.transaction++
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	var response []byte
+	err = writeModbusFrame(c.conn, c.transaction, c.UnitID, pdu)
+	if err == nil {
+		var transaction uint16
+		transaction, _, response, err = readModbusFrame(c.conn)
+		if err == nil && transaction != c.transaction {
+			err = fmt.Errorf("modbus response for transaction %d, expected %d", transaction, c.transaction)
+		}
+	}
+	if err != nil {
+		// Start over with a new connection, rather than reading a late response on the next request
+		c.conn.Close()
+		c.conn = nil
+		return
+	}
+
+	switch {
+	case response[0] == pdu[0]|modbusException && len(response) > 1:
+		return nil, &ModbusError{Function: pdu[0], Code: response[1]}
+	case response[0] != pdu[0]:
+		return nil, fmt.Errorf("modbus response for function %d, expected %d", response[0], pdu[0])
+	}
+	return response[1:], nil
+}
+
+// ReadHoldingRegisters reads count holding registers starting at the address
+func (c *ModbusClient) ReadHoldingRegisters(address uint16, count uint16) (values []uint16, err error) {
+	pdu := []byte{modbusReadHoldingRegisters, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	binary.BigEndian.PutUint16(pdu[3:], count)
+	data, err := c.request(pdu)
+	if err != nil {
+		return
+	}
+	if len(data) != 1+2*int(count) || int(data[0]) != 2*int(count) {
+		return nil, fmt.Errorf("modbus response of %d bytes for %d registers", len(data), count)
+	}
+	values = make([]uint16, count)
+	for k := range values {
+		values[k] = binary.BigEndian.Uint16(data[1+2*k:])
+	}
+	return
+}
+
+// WriteSingleCoil switches the coil at the address on or off
+func (c *ModbusClient) WriteSingleCoil(address uint16, value bool) error {
+	pdu := []byte{modbusWriteSingleCoil, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	if value {
+		binary.BigEndian.PutUint16(pdu[3:], modbusCoilOn)
+	}
+	data, err := c.request(pdu)
+	if err != nil {
+		return err
+	}
+	if len(data) != 4 || binary.BigEndian.Uint16(data[2:]) != binary.BigEndian.Uint16(pdu[3:]) {
+		return fmt.Errorf("modbus response does not echo the coil write")
+	}
+	return nil
+}
+
+// Close closes the connection, if any
+func (c *ModbusClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// modbusRead is a cached read of the bitmap registers of a group
+type modbusRead struct {
+	values []uint16
+	at     time.Time
+}
+
+// ModbusBackend implements the backend for a Neuron Modbus TCP server. The inputs of a group share the register reads, so the server is queried once per polling interval per group.
+type ModbusBackend struct {
+	Client *ModbusClient
+	Prefix string
+	Groups []ModbusGroup
+	// mu guards the cache
+	mu    sync.Mutex
+	cache map[int]modbusRead
+}
+
+// NewModbusBackend sets up the Modbus backend for a board
+func NewModbusBackend(b BoardConfiguration) (Backend, error) {
+	groups := b.Groups
+	if len(groups) == 0 {
+		groups = DefaultModbusGroups
+	}
+	return &ModbusBackend{
+		Client: NewModbusClient(b.Address, b.UnitID),
+		Prefix: b.Prefix,
+		Groups: groups,
+		cache:  make(map[int]modbusRead),
+	}, nil
+}
+
+// registers reads the digital input and output bitmaps of a group, unless read less than maxAge ago
+func (m *ModbusBackend) registers(group int, maxAge time.Duration) ([]uint16, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if read, ok := m.cache[group]; ok && time.Since(read.at) < maxAge {
+		return read.values, nil
+	}
+	values, err := m.Client.ReadHoldingRegisters(uint16(group*ModbusGroupSize), 2)
+	if err != nil {
+		delete(m.cache, group)
+		return nil, err
+	}
+	m.cache[group] = modbusRead{values: values, at: time.Now()}
+	return values, nil
+}
+
+// groupInputName names input k (0-based) of group g (0-based) in the register map
+func groupInputName(prefix string, g int, k int) string {
+	return fmt.Sprintf("%sdi_%d_%02d", prefix, g+1, k+1)
+}
+
+// groupOutputName names output k (0-based) of group g (0-based) in the register map: its digital outputs followed by its relays
+func groupOutputName(prefix string, g int, group ModbusGroup, k int) string {
+	if k >= group.DO {
+		return fmt.Sprintf("%sro_%d_%02d", prefix, g+1, k-group.DO+1)
+	}
+	return fmt.Sprintf("%sdo_%d_%02d", prefix, g+1, k+1)
+}
+
+// groupChannels lists the names of the inputs and outputs of the groups in the register map
+func groupChannels(prefix string, groups []ModbusGroup) (names []string) {
+	for g, group := range groups {
+		for k := 0; k < group.DI; k++ {
+			names = append(names, groupInputName(prefix, g, k))
+		}
+		for k := 0; k < group.DO+group.RO; k++ {
+			names = append(names, groupOutputName(prefix, g, group, k))
+		}
+	}
+	return
+}
+
+// Discover checks the register map of every group can be read, and sets up its digital inputs and outputs
+func (m *ModbusBackend) Discover() (inputs map[string]DigitalInput, outputs map[string]DigitalOutput, err error) {
+	inputs = make(map[string]DigitalInput)
+	outputs = make(map[string]DigitalOutput)
+	for g, group := range m.Groups {
+		if _, err = m.registers(g, 0); err != nil {
+			return inputs, outputs, fmt.Errorf("reading group %d from %s: %s", g+1, m.Client.Address, err)
+		}
+		for k := 0; k < group.DI; k++ {
+			name := groupInputName(m.Prefix, g, k)
+			inputs[name] = &modbusInput{backend: m, name: name, group: g, bit: uint(k)}
+		}
+		for k := 0; k < group.DO+group.RO; k++ {
+			name := groupOutputName(m.Prefix, g, group, k)
+			outputs[name] = &modbusOutput{backend: m, name: name, group: g, bit: uint(k)}
+		}
+	}
+	pollerLog.Info("Created Modbus digital inputs", "count", len(inputs), "address", m.Client.Address)
+	return
+}
+
+// Channels lists the names of the groups in the register map, without connecting to the server
+func (m *ModbusBackend) Channels() ([]string, error) {
+	return groupChannels(m.Prefix, m.Groups), nil
+}
+
+// Close closes the connection to the Modbus server
+func (m *ModbusBackend) Close() error {
+	return m.Client.Close()
+}
+
+// modbusInput is a digital input of a Modbus board, a bit in the input bitmap register of its group
+type modbusInput struct {
+	backend *ModbusBackend
+	name    string
+	group   int
+	bit     uint
+	value   bool
+	// lastPoll holds the unix nano timestamp of the last successful poll, accessed atomically
+	lastPoll int64
+}
+
+// read reads the input, from a register read at most maxAge ago
+func (i *modbusInput) read(maxAge time.Duration) (bool, error) {
+	values, err := i.backend.registers(i.group, maxAge)
+	if err != nil {
+		return false, err
+	}
+	return values[0]&(1<<i.bit) != 0, nil
+}
+
+// Read reads the current value of the input
+func (i *modbusInput) Read() (bool, error) {
+	return i.read(0)
+}
+
+// Watch polls the input at the interval until done. Errors are logged and retried on the next tick, the input goes stale for the health checks meanwhile.
+func (i *modbusInput) Watch(events chan<- Event, interval int, done <-chan bool) {
+	period := time.Duration(interval) * time.Millisecond
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		select {
+		case <-ticker.C:
+			value, err := i.read(period / 2)
+			if err != nil {
+				if !failing {
+					pollerLog.Error("Error polling digital input", "name", i.name, "err", err)
+				}
+				failing = true
+				continue
+			}
+			if failing {
+				pollerLog.Info("Polling digital input again", "name", i.name)
+				failing = false
+			}
+			atomic.StoreInt64(&i.lastPoll, time.Now().UnixNano())
+			// Push out an event in case of a leading edge
+			if !i.value && value {
+				select {
+				case events <- Event{Name: i.name, Value: value}:
+				case <-done:
+					return
+				}
+			}
+			i.value = value
+		case <-done:
+			return
+		}
+	}
+}
+
+// LastPoll returns the time of the last successful poll, zero if it never polled
+func (i *modbusInput) LastPoll() time.Time {
+	nanos := atomic.LoadInt64(&i.lastPoll)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Close is a no-op, the connection is shared by the board
+func (i *modbusInput) Close() error {
+	return nil
+}
+
+// modbusOutput is a digital output or relay of a Modbus board: a coil, read back from the output bitmap register of its group
+type modbusOutput struct {
+	backend *ModbusBackend
+	name    string
+	group   int
+	bit     uint
+}
+
+// Update switches the coil of the output
+func (o *modbusOutput) Update(value bool) error {
+	err := o.backend.Client.WriteSingleCoil(uint16(o.group*ModbusGroupSize)+uint16(o.bit), value)
+	if err == nil {
+		outputsLog.Info("Updated value of digital output", "name", o.name, "value", value)
+	}
+	return err
+}
+
+// Read reads back the current value of the output
+func (o *modbusOutput) Read() (bool, error) {
+	values, err := o.backend.registers(o.group, 0)
+	if err != nil {
+		return false, err
+	}
+	return values[1]&(1<<o.bit) != 0, nil
+}
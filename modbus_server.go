@@ -0,0 +1,264 @@
+package unipitt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+)
+
+// Modbus function and exception codes served
+const (
+	modbusReadCoils           = 0x01
+	modbusReadDiscreteInputs  = 0x02
+	modbusWriteMultipleCoils  = 0x0f
+	modbusIllegalFunction     = 0x01
+	modbusIllegalDataAddress  = 0x02
+	modbusIllegalDataValue    = 0x03
+	modbusServerDeviceFailure = 0x04
+	modbusMaxBitsPerRead      = 2000
+	modbusMaxCoilsPerWrite    = 1968
+	modbusMaxAddress          = 65535
+)
+
+const (
+	// ModbusBoardBlock is the range of Modbus addresses per board, in the order of the boards list
+	ModbusBoardBlock = 10000
+	// ModbusRelayOffset is added to the Modbus addresses of the relays, to keep them apart from the digital outputs of the same group
+	ModbusRelayOffset = 1000
+)
+
+// modbusChannelRegex matches the channels numbered by group and number, after the prefix of their board
+var modbusChannelRegex = regexp.MustCompile(`^(.*)(di|do|ro)_([0-9])_([0-9]{2})$`)
+
+// ChannelAddress returns the Modbus address of a channel: as mapped in modbus_addresses, otherwise the board index times ModbusBoardBlock, plus ModbusRelayOffset for a relay, plus the group times 100 and the number (e.g. 203 for do_2_03 on the first board). User LEDs and channels not named by group and number only get an address when mapped.
+func (c *Configuration) ChannelAddress(name string) (address int, ok bool) {
+	if address, ok = c.ModbusAddresses[name]; ok {
+		return
+	}
+	match := modbusChannelRegex.FindStringSubmatch(name)
+	if match == nil {
+		return 0, false
+	}
+	group, _ := strconv.Atoi(match[3])
+	number, _ := strconv.Atoi(match[4])
+	for k, b := range c.BoardList() {
+		if b.Prefix != match[1] {
+			continue
+		}
+		address = k*ModbusBoardBlock + group*100 + number
+		if match[2] == "ro" {
+			address += ModbusRelayOffset
+		}
+		return address, address <= modbusMaxAddress
+	}
+	return 0, false
+}
+
+// modbusProblems checks the mapped Modbus addresses
+func (c *Configuration) modbusProblems() (problems []Problem) {
+	for _, name := range sortedKeys(c.ModbusAddresses) {
+		if address := c.ModbusAddresses[name]; address < 0 || address > modbusMaxAddress {
+			problems = append(problems, Problem{Key: name, Section: "modbus_addresses", Message: fmt.Sprintf("Modbus address %d of %s should be 0 to %d", address, name, modbusMaxAddress)})
+		}
+	}
+	return
+}
+
+// modbusTable numbers the channels by their Modbus address, leaving out the ones without one or with an address taken already
+func modbusTable(kind string, names []string, address func(name string) (int, bool)) map[int]string {
+	table := make(map[int]string)
+	for _, name := range names {
+		k, ok := address(name)
+		if !ok {
+			modbusLog.Debug("Not serving channel without Modbus address", "name", name)
+			continue
+		}
+		if other, taken := table[k]; taken {
+			modbusLog.Error("Not serving channel on a Modbus address taken already", "name", name, "address", k, "other", other)
+			continue
+		}
+		table[k] = name
+		modbusLog.Debug("Serving channel over Modbus", "name", name, "kind", kind, "address", k)
+	}
+	return table
+}
+
+// ModbusServer serves the digital inputs as discrete inputs and the digital outputs as coils over Modbus TCP, at the addresses given for their names. Any unit ID is accepted.
+type ModbusServer struct {
+	inputs  map[string]DigitalInput
+	outputs map[string]DigitalOutput
+	// discreteInputs and coils map the addresses to the names of the channels
+	discreteInputs map[int]string
+	coils          map[int]string
+	// write updates a digital output for a coil write
+	write func(name string, value bool) Ack
+}
+
+// NewModbusServer creates a Modbus TCP server for the digital inputs and outputs, at the addresses given for their names
+func NewModbusServer(inputs map[string]DigitalInput, outputs map[string]DigitalOutput, address func(name string) (int, bool)) *ModbusServer {
+	return &ModbusServer{
+		inputs:         inputs,
+		outputs:        outputs,
+		discreteInputs: modbusTable("discrete input", sortedKeys(inputs), address),
+		coils:          modbusTable("coil", sortedKeys(outputs), address),
+		write: func(name string, value bool) Ack {
+			return execute(name, outputs[name], value)
+		},
+	}
+}
+
+// Serve accepts connections on the listener, serving each one in its own goroutine
+func (s *ModbusServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// serve handles the requests on a connection until it is closed
+func (s *ModbusServer) serve(conn net.Conn) {
+	defer conn.Close()
+	modbusLog.Debug("Modbus client connected", "remote", conn.RemoteAddr())
+	for {
+		transaction, unit, pdu, err := readModbusFrame(conn)
+		if err != nil {
+			if err != io.EOF {
+				modbusLog.Warn("Error reading Modbus request", "remote", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+		if err := writeModbusFrame(conn, transaction, unit, s.handle(pdu)); err != nil {
+			modbusLog.Warn("Error writing Modbus response", "remote", conn.RemoteAddr(), "err", err)
+			return
+		}
+	}
+}
+
+// exception builds an exception response
+func exception(function byte, code byte) []byte {
+	return []byte{function | modbusException, code}
+}
+
+// handle handles a request PDU, returning the response PDU
+func (s *ModbusServer) handle(pdu []byte) []byte {
+	switch pdu[0] {
+	case modbusReadCoils:
+		return s.readBits(pdu, s.coils, func(name string) (bool, error) { return s.outputs[name].Read() })
+	case modbusReadDiscreteInputs:
+		return s.readBits(pdu, s.discreteInputs, func(name string) (bool, error) { return s.inputs[name].Read() })
+	case modbusWriteSingleCoil:
+		return s.writeSingleCoil(pdu)
+	case modbusWriteMultipleCoils:
+		return s.writeMultipleCoils(pdu)
+	}
+	return exception(pdu[0], modbusIllegalFunction)
+}
+
+// mapped checks all addresses of the range are in the table
+func mapped(table map[int]string, address int, count int) bool {
+	for k := address; k < address+count; k++ {
+		if _, ok := table[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// readBits reads a range of coils or discrete inputs, packed in bytes with the lowest address in the least significant bit
+func (s *ModbusServer) readBits(pdu []byte, names map[int]string, read func(name string) (bool, error)) []byte {
+	if len(pdu) != 5 {
+		return exception(pdu[0], modbusIllegalDataValue)
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:]))
+	count := int(binary.BigEndian.Uint16(pdu[3:]))
+	if count < 1 || count > modbusMaxBitsPerRead {
+		return exception(pdu[0], modbusIllegalDataValue)
+	}
+	if !mapped(names, address, count) {
+		return exception(pdu[0], modbusIllegalDataAddress)
+	}
+	response := make([]byte, 2+(count+7)/8)
+	response[0], response[1] = pdu[0], byte((count+7)/8)
+	for k := 0; k < count; k++ {
+		value, err := read(names[address+k])
+		if err != nil {
+			modbusLog.Error("Error reading channel for Modbus", "name", names[address+k], "err", err)
+			return exception(pdu[0], modbusServerDeviceFailure)
+		}
+		if value {
+			response[2+k/8] |= 1 << uint(k%8)
+		}
+	}
+	return response
+}
+
+// writeCoil updates the digital output of a coil, verifying the value read back
+func (s *ModbusServer) writeCoil(address int, value bool) bool {
+	return s.write(s.coils[address], value).Success
+}
+
+// writeSingleCoil switches a single coil, echoing the request
+func (s *ModbusServer) writeSingleCoil(pdu []byte) []byte {
+	if len(pdu) != 5 {
+		return exception(pdu[0], modbusIllegalDataValue)
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:]))
+	value := binary.BigEndian.Uint16(pdu[3:])
+	if value != modbusCoilOn && value != 0 {
+		return exception(pdu[0], modbusIllegalDataValue)
+	}
+	if !mapped(s.coils, address, 1) {
+		return exception(pdu[0], modbusIllegalDataAddress)
+	}
+	if !s.writeCoil(address, value == modbusCoilOn) {
+		return exception(pdu[0], modbusServerDeviceFailure)
+	}
+	return pdu
+}
+
+// writeMultipleCoils switches a range of coils, packed like the response of readBits
+func (s *ModbusServer) writeMultipleCoils(pdu []byte) []byte {
+	if len(pdu) < 6 {
+		return exception(pdu[0], modbusIllegalDataValue)
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:]))
+	count := int(binary.BigEndian.Uint16(pdu[3:]))
+	if count < 1 || count > modbusMaxCoilsPerWrite || int(pdu[5]) != (count+7)/8 || len(pdu) != 6+int(pdu[5]) {
+		return exception(pdu[0], modbusIllegalDataValue)
+	}
+	if !mapped(s.coils, address, count) {
+		return exception(pdu[0], modbusIllegalDataAddress)
+	}
+	for k := 0; k < count; k++ {
+		if !s.writeCoil(address+k, pdu[6+k/8]&(1<<uint(k%8)) != 0) {
+			return exception(pdu[0], modbusServerDeviceFailure)
+		}
+	}
+	return pdu[:5]
+}
+
+// ServeModbus serves the digital inputs and outputs of the handler over Modbus TCP on the address
+func (h *Handler) ServeModbus(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	modbusLog.Info("Serving Modbus TCP", "address", address, "discrete_inputs", len(h.inputs), "coils", len(h.writerMap))
+	return h.modbusServer().Serve(listener)
+}
+
+// modbusServer creates the Modbus TCP server for the handler, updating the digital outputs the same way as the MQTT commands do
+func (h *Handler) modbusServer() *ModbusServer {
+	c := h.configuration()
+	s := NewModbusServer(h.inputs, h.writerMap, c.ChannelAddress)
+	s.write = func(name string, value bool) Ack {
+		return h.output(name, "", []byte(formatValue(value)), value)
+	}
+	return s
+}
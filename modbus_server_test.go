@@ -0,0 +1,138 @@
+package unipitt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModbusServer(t *testing.T) {
+	root := makeBoard(t, "di_1_01", "di_1_02", "di_1_03", "do_1_01", "do_1_02")
+	defer os.RemoveAll(root)
+	files := map[string]string{"di_1_01": DiFilename, "di_1_02": DiFilename, "di_1_03": DiFilename, "do_1_01": DoFilename, "do_1_02": DoFilename}
+	values := map[string]string{"di_1_01": "1\n", "di_1_02": "0\n", "di_1_03": "1\n", "do_1_01": DoFalseValue, "do_1_02": DoFalseValue}
+	for name, value := range values {
+		if err := ioutil.WriteFile(filepath.Join(root, name, files[name]), []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputs, outputs, backends, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBackends(inputs, backends)
+	trace := writeConfig(t, "")
+	defer os.Remove(trace)
+	recorder, err := NewRecorder(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfiguration()
+	c.SysFsRoot = root
+	h := &Handler{inputs: inputs, writerMap: outputs, recorder: recorder, config: c}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go h.modbusServer().Serve(listener)
+	client := NewModbusClient(listener.Addr().String(), 1)
+	defer client.Close()
+
+	cases := []struct {
+		Request  []byte
+		Response []byte
+		Error    byte
+	}{
+		// Discrete inputs 101-103 are di_1_01 to di_1_03
+		{Request: []byte{modbusReadDiscreteInputs, 0, 101, 0, 3}, Response: []byte{1, 0x05}},
+		{Request: []byte{modbusReadDiscreteInputs, 0, 103, 0, 2}, Error: modbusIllegalDataAddress},
+		{Request: []byte{modbusReadDiscreteInputs, 0, 0, 0, 1}, Error: modbusIllegalDataAddress},
+		// Coil 102 is do_1_02
+		{Request: []byte{modbusWriteSingleCoil, 0, 102, 0xff, 0}, Response: []byte{0, 102, 0xff, 0}},
+		{Request: []byte{modbusReadCoils, 0, 101, 0, 2}, Response: []byte{1, 0x02}},
+		{Request: []byte{modbusWriteMultipleCoils, 0, 101, 0, 2, 1, 0x01}, Response: []byte{0, 101, 0, 2}},
+		{Request: []byte{modbusReadCoils, 0, 101, 0, 2}, Response: []byte{1, 0x01}},
+		{Request: []byte{modbusWriteSingleCoil, 0, 102, 0x12, 0}, Error: modbusIllegalDataValue},
+		{Request: []byte{modbusWriteSingleCoil, 0, 103, 0xff, 0}, Error: modbusIllegalDataAddress},
+		{Request: []byte{modbusReadHoldingRegisters, 0, 0, 0, 1}, Error: modbusIllegalFunction},
+	}
+	for _, testCase := range cases {
+		response, err := client.request(testCase.Request)
+		if testCase.Error != 0 {
+			if e, ok := err.(*ModbusError); !ok || e.Code != testCase.Error {
+				t.Fatalf("Expected exception %d for %v, got %v\n", testCase.Error, testCase.Request, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(response, testCase.Response) {
+			t.Fatalf("Expected response %v for %v, got %v\n", testCase.Response, testCase.Request, response)
+		}
+	}
+
+	// The coil writes went through the digital output writers, recorded like the MQTT commands
+	if value, err := outputs["do_1_01"].Read(); err != nil || !value {
+		t.Fatalf("Expected do_1_01 to be %t, got %t (%v)\n", true, value, err)
+	}
+	recorder.Close()
+	entries, err := ReadTrace(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TraceEntry{
+		{Kind: TraceOutput, Name: "do_1_02", Payload: MsgTrueValue},
+		{Kind: TraceOutput, Name: "do_1_01", Payload: MsgTrueValue},
+		{Kind: TraceOutput, Name: "do_1_02", Payload: MsgFalseValue},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d coil writes recorded, got %v\n", len(expected), entries)
+	}
+	for k, entry := range expected {
+		if entries[k].Kind != entry.Kind || entries[k].Name != entry.Name || entries[k].Topic != "" || entries[k].Payload != entry.Payload {
+			t.Fatalf("Expected entry %v, got %v\n", entry, entries[k])
+		}
+	}
+}
+
+func TestChannelAddress(t *testing.T) {
+	c := Configuration{
+		Boards: []BoardConfiguration{
+			{Backend: BackendModbus, Address: "neuron1"},
+			{Backend: BackendModbus, Address: "neuron2", Prefix: "n2_"},
+			{Backend: BackendGPIO, Chip: "/dev/gpiochip0", Prefix: "pi_"},
+		},
+		ModbusAddresses: map[string]int{"pi_pump": 500, "led_1_01": 600, "n2_do_1_01": 42},
+	}
+	cases := []struct {
+		Name     string
+		Expected int
+		OK       bool
+	}{
+		// The addresses are pinned: the boards, LEDs and other channels around don't shift them
+		{Name: "di_1_04", Expected: 104, OK: true},
+		{Name: "do_2_03", Expected: 203, OK: true},
+		{Name: "ro_2_03", Expected: 1203, OK: true},
+		{Name: "ro_3_14", Expected: 1314, OK: true},
+		{Name: "n2_do_2_03", Expected: 10203, OK: true},
+		{Name: "n2_ro_2_01", Expected: 11201, OK: true},
+		{Name: "n2_do_1_01", Expected: 42, OK: true},
+		{Name: "pi_pump", Expected: 500, OK: true},
+		{Name: "led_1_01", Expected: 600, OK: true},
+		{Name: "led_1_02"},
+		{Name: "n3_do_1_01"},
+		{Name: "pi_valve"},
+	}
+	for _, testCase := range cases {
+		address, ok := c.ChannelAddress(testCase.Name)
+		if ok != testCase.OK || (ok && address != testCase.Expected) {
+			t.Fatalf("Expected address %d (%t) for %s, got %d (%t)\n", testCase.Expected, testCase.OK, testCase.Name, address, ok)
+		}
+	}
+}
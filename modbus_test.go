@@ -0,0 +1,235 @@
+package unipitt
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standInServer is a minimal Neuron Modbus TCP server, holding the bitmap registers of a single group. Coil writes update the output bitmap.
+type standInServer struct {
+	sync.Mutex
+	listener  net.Listener
+	registers [2]uint16
+}
+
+func newStandInServer(t *testing.T) *standInServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &standInServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *standInServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		transaction, unit, pdu, err := readModbusFrame(conn)
+		if err != nil {
+			return
+		}
+		s.Lock()
+		address := binary.BigEndian.Uint16(pdu[1:])
+		response := []byte{pdu[0] | modbusException, 0x02}
+		switch {
+		case pdu[0] == modbusReadHoldingRegisters && address == 0 && binary.BigEndian.Uint16(pdu[3:]) == 2:
+			response = []byte{pdu[0], 4, 0, 0, 0, 0}
+			binary.BigEndian.PutUint16(response[2:], s.registers[0])
+			binary.BigEndian.PutUint16(response[4:], s.registers[1])
+		case pdu[0] == modbusWriteSingleCoil && address < ModbusMaxChannels:
+			if binary.BigEndian.Uint16(pdu[3:]) == modbusCoilOn {
+				s.registers[1] |= 1 << address
+			} else {
+				s.registers[1] &^= 1 << address
+			}
+			response = pdu
+		case pdu[0] != modbusReadHoldingRegisters && pdu[0] != modbusWriteSingleCoil:
+			response[1] = 0x01
+		}
+		s.Unlock()
+		if err := writeModbusFrame(conn, transaction, unit, response); err != nil {
+			return
+		}
+	}
+}
+
+func (s *standInServer) set(register int, value uint16) {
+	s.Lock()
+	defer s.Unlock()
+	s.registers[register] = value
+}
+
+func (s *standInServer) Close() {
+	s.listener.Close()
+}
+
+func TestModbusAddress(t *testing.T) {
+	cases := []struct {
+		Address  string
+		Expected string
+	}{
+		{Address: "neuron.lan", Expected: "neuron.lan:502"},
+		{Address: "neuron.lan:5020", Expected: "neuron.lan:5020"},
+		{Address: "192.168.1.10", Expected: "192.168.1.10:502"},
+	}
+	for _, testCase := range cases {
+		if address := modbusAddress(testCase.Address); address != testCase.Expected {
+			t.Fatalf("Expected address %s for %s, got %s\n", testCase.Expected, testCase.Address, address)
+		}
+	}
+}
+
+func TestModbusClient(t *testing.T) {
+	server := newStandInServer(t)
+	defer server.Close()
+	server.set(0, 0x0005)
+
+	client := NewModbusClient(server.listener.Addr().String(), 0)
+	defer client.Close()
+	values, err := client.ReadHoldingRegisters(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != 0x0005 {
+		t.Fatalf("Expected the input bitmap %d, got %v\n", 0x0005, values)
+	}
+
+	if err := client.WriteSingleCoil(3, true); err != nil {
+		t.Fatal(err)
+	}
+	if values, err := client.ReadHoldingRegisters(0, 2); err != nil || values[1] != 0x0008 {
+		t.Fatalf("Expected the output bitmap %d, got %v (%v)\n", 0x0008, values, err)
+	}
+
+	_, err = client.ReadHoldingRegisters(100, 2)
+	if e, ok := err.(*ModbusError); !ok || e.Code != 0x02 || e.Function != modbusReadHoldingRegisters {
+		t.Fatalf("Expected an illegal data address exception, got %v\n", err)
+	}
+}
+
+func TestModbusClientReconnect(t *testing.T) {
+	server := newStandInServer(t)
+	address := server.listener.Addr().String()
+	client := NewModbusClient(address, 0)
+	client.Timeout = 200 * time.Millisecond
+	defer client.Close()
+	if _, err := client.ReadHoldingRegisters(0, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the connection, the next request fails and the one after reconnects
+	server.Close()
+	client.mu.Lock()
+	client.conn.Close()
+	client.mu.Unlock()
+	if _, err := client.ReadHoldingRegisters(0, 2); err == nil {
+		t.Fatal("Expected an error with the server gone, got none")
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("Could not listen on %s again: %s\n", address, err)
+	}
+	server.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	defer server.Close()
+	if _, err := client.ReadHoldingRegisters(0, 2); err != nil {
+		t.Fatalf("Expected to reconnect, got %s\n", err)
+	}
+}
+
+func TestModbusBackend(t *testing.T) {
+	server := newStandInServer(t)
+	defer server.Close()
+
+	backend, err := NewBackend(BoardConfiguration{
+		Backend: BackendModbus,
+		Address: server.listener.Addr().String(),
+		Prefix:  "neuron_",
+		Groups:  []ModbusGroup{{DI: 4, DO: 2, RO: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, outputs, err := backend.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBackends(inputs, []Backend{backend})
+	if len(inputs) != 4 || len(outputs) != 4 {
+		t.Fatalf("Expected 4 inputs and 4 outputs, got %v and %v\n", inputs, outputs)
+	}
+	for _, name := range []string{"neuron_do_1_01", "neuron_do_1_02", "neuron_ro_1_01", "neuron_ro_1_02"} {
+		if _, ok := outputs[name]; !ok {
+			t.Fatalf("Expected output %s, got %v\n", name, outputs)
+		}
+	}
+
+	// Relays follow the digital outputs in the coils and the output bitmap
+	relay := outputs["neuron_ro_1_02"]
+	if err := relay.Update(true); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := relay.Read(); err != nil || !value {
+		t.Fatalf("Expected to read back %t, got %t (%v)\n", true, value, err)
+	}
+	server.Lock()
+	bitmap := server.registers[1]
+	server.Unlock()
+	if bitmap != 0x0008 {
+		t.Fatalf("Expected the output bitmap %d, got %d\n", 0x0008, bitmap)
+	}
+
+	// A rising edge on an input ends up as an event, the inputs sharing the register reads
+	events := make(chan Event)
+	done := make(chan bool)
+	defer close(done)
+	for _, input := range inputs {
+		go input.Watch(events, 50, done)
+	}
+	server.set(0, 0x0004)
+	select {
+	case e := <-events:
+		if e.Name != "neuron_di_1_03" || !e.Value {
+			t.Fatalf("Expected a rising edge on %s, got %v\n", "neuron_di_1_03", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a rising edge, got none")
+	}
+	if last := inputs["neuron_di_1_03"].(poller).LastPoll(); last.IsZero() {
+		t.Fatal("Expected the input to have polled, it did not")
+	}
+}
+
+func TestModbusBackendUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	_, _, _, _, err = FindBoards([]BoardConfiguration{{Backend: BackendModbus, Address: address}})
+	if err == nil {
+		t.Fatal("Expected an error for an unreachable Modbus server, got none")
+	}
+}
@@ -3,8 +3,10 @@ package unipitt
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"strings"
 )
 
 // NewTLSConfig generates a TLS config instance for use with the MQTT setup
@@ -18,13 +20,195 @@ func NewTLSConfig(caFile string) (*tls.Config, error) {
 	// Read the local file from the supplied path
 	certs, err := ioutil.ReadFile(caFile)
 	if err != nil {
-		log.Printf("Failed to append %q to RootCAs: %v", caFile, err)
+		mqttLog.Error("Failed to append CA file to root CAs", "file", caFile, "err", err)
 	}
 	// Append our cert to the system pool
 	if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
-		log.Println("No certs appended, using system certs only")
+		mqttLog.Warn("No certs appended, using system certs only", "file", caFile)
 	}
 
 	// Trust the augmented cert pool in our client
 	return &tls.Config{RootCAs: rootCAs}, err
 }
+
+// MaskedSecret is shown instead of passwords when displaying the configuration
+const MaskedSecret = "********"
+
+// AuthConfiguration represents the TLS and credential settings for the connection to an MQTT broker
+type AuthConfiguration struct {
+	CAFile             string `yaml:"cafile"`
+	CertFile           string `yaml:"certfile"`
+	KeyFile            string `yaml:"keyfile"`
+	KeyPassword        string `yaml:"key_password"`
+	KeyPasswordFile    string `yaml:"key_password_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	Username           string `yaml:"username"`
+	Password           string `yaml:"password"`
+	PasswordFile       string `yaml:"password_file"`
+}
+
+// UsesTLS checks whether any custom TLS setting is given
+func (a *AuthConfiguration) UsesTLS() bool {
+	return a.CAFile != "" || a.CertFile != "" || a.ServerName != "" || a.InsecureSkipVerify
+}
+
+// Problems lists the inconsistencies in the TLS and credential settings
+func (a *AuthConfiguration) Problems() (problems []Problem) {
+	if a.CertFile != "" && a.KeyFile == "" {
+		problems = append(problems, Problem{Key: "certfile", Message: "client certificate given without keyfile"})
+	}
+	if a.KeyFile != "" && a.CertFile == "" {
+		problems = append(problems, Problem{Key: "keyfile", Message: "client key given without certfile"})
+	}
+	if a.Password != "" && a.PasswordFile != "" {
+		problems = append(problems, Problem{Key: "password_file", Message: "both password and password_file given"})
+	}
+	if a.KeyPassword != "" && a.KeyPasswordFile != "" {
+		problems = append(problems, Problem{Key: "key_password_file", Message: "both key_password and key_password_file given"})
+	}
+	if (a.Password != "" || a.PasswordFile != "") && a.Username == "" {
+		problems = append(problems, Problem{Key: "username", Message: "password given without username"})
+	}
+	return
+}
+
+// secret returns the value, or the contents of the file when given, without trailing newline
+func secret(value string, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// masked returns a copy with the passwords hidden, for display
+func (a AuthConfiguration) masked() AuthConfiguration {
+	if a.Password != "" {
+		a.Password = MaskedSecret
+	}
+	if a.KeyPassword != "" {
+		a.KeyPassword = MaskedSecret
+	}
+	return a
+}
+
+// Credentials returns the username and password, reading the password from file if needed
+func (a *AuthConfiguration) Credentials() (username string, password string, err error) {
+	password, err = secret(a.Password, a.PasswordFile)
+	return a.Username, password, err
+}
+
+// TLSConfig generates the TLS config: the CA file on top of the system pool, the (optionally encrypted) client certificate, server name and verification
+func (a *AuthConfiguration) TLSConfig() (tlsConfig *tls.Config, err error) {
+	if a.CAFile != "" {
+		if tlsConfig, err = NewTLSConfig(a.CAFile); err != nil {
+			return
+		}
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.ServerName = a.ServerName
+	if a.InsecureSkipVerify {
+		mqttLog.Warn("Skipping verification of the MQTT broker certificate, only use this for testing")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if a.CertFile != "" {
+		keyPassword, err := secret(a.KeyPassword, a.KeyPasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading key password: %s", err)
+		}
+		cert, err := loadKeyPair(a.CertFile, a.KeyFile, keyPassword)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// loadKeyPair loads a client certificate and key, decrypting the key with the password if it is encrypted: PKCS#8 encrypted, or the deprecated legacy PEM encryption
+func loadKeyPair(certFile string, keyFile string, password string) (cert tls.Certificate, err error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return cert, fmt.Errorf("reading client certificate: %s", err)
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return cert, fmt.Errorf("reading client key: %s", err)
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return cert, fmt.Errorf("no PEM data found in client key %s", keyFile)
+	}
+	encrypted := block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block)
+	if encrypted && password == "" {
+		return cert, fmt.Errorf("client key %s is encrypted, but no key password given", keyFile)
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		der, err := decryptPKCS8(block.Bytes, []byte(password))
+		if err != nil {
+			return cert, fmt.Errorf("decrypting client key %s: %s", keyFile, err)
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	} else if encrypted {
+		// Legacy PEM encryption is insecure by design, see x509.DecryptPEMBlock
+		mqttLog.Warn("Client key uses deprecated legacy PEM encryption, convert it to PKCS#8 with openssl pkcs8 -topk8", "file", keyFile)
+		der, err := x509.DecryptPEMBlock(block, []byte(password))
+		if err != nil {
+			return cert, fmt.Errorf("decrypting client key %s: %s", keyFile, err)
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return cert, fmt.Errorf("loading client certificate %s and key %s: %s", certFile, keyFile, err)
+	}
+	return
+}
+
+// connectHints maps fragments of connection errors to a hint on which setting to check
+var connectHints = []struct {
+	Fragment string
+	Hint     string
+}{
+	{Fragment: "certificate signed by unknown authority", Hint: "the broker certificate is not trusted, check cafile"},
+	{Fragment: "certificate is valid for", Hint: "the broker certificate does not match the host name, check the broker URI or server_name"},
+	{Fragment: "certificate has expired", Hint: "the broker certificate expired or the system clock is wrong"},
+	{Fragment: "bad certificate", Hint: "the broker rejected the client certificate, check certfile and keyfile"},
+	{Fragment: "certificate required", Hint: "the broker requires a client certificate, set certfile and keyfile"},
+	{Fragment: "unknown certificate authority", Hint: "the broker does not trust the client certificate"},
+	{Fragment: "first record does not look like a TLS handshake", Hint: "the broker does not speak TLS on this port, check the broker URI scheme"},
+	{Fragment: "bad user name or password", Hint: "the broker rejected the credentials, check username and password"},
+	{Fragment: "not authorized", Hint: "the broker refused the connection, check username, password and ACLs"},
+}
+
+// connectHint returns a hint on how to solve a connection error, empty if none known
+func connectHint(err error) string {
+	for _, h := range connectHints {
+		if strings.Contains(strings.ToLower(err.Error()), strings.ToLower(h.Fragment)) {
+			return h.Hint
+		}
+	}
+	return ""
+}
+
+// topicMatches checks whether the topic matches the subscription filter, with + matching a single level and # all remaining levels
+func topicMatches(filter string, topic string) bool {
+	filters, levels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for k, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if k >= len(levels) || (f != "+" && f != levels[k]) {
+			return false
+		}
+	}
+	return len(filters) == len(levels)
+}
@@ -0,0 +1,1076 @@
+package unipitt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// MQTTVersion5 is the protocol version selecting the built-in MQTT 5 client
+	MQTTVersion5 = 5
+	// DefaultKeepAlive is the default keep alive interval for the MQTT 5 client
+	DefaultKeepAlive = 30 * time.Second
+	// DefaultConnectTimeout is the default time to wait for the broker to accept a connection
+	DefaultConnectTimeout = 30 * time.Second
+	// MQTT5QueueLength is the number of received messages queued for the handlers, beyond which messages are dropped
+	MQTT5QueueLength = 1000
+)
+
+// MQTT control packet types
+const (
+	packetConnect     byte = 1
+	packetConnack     byte = 2
+	packetPublish     byte = 3
+	packetPuback      byte = 4
+	packetSubscribe   byte = 8
+	packetSuback      byte = 9
+	packetUnsubscribe byte = 10
+	packetUnsuback    byte = 11
+	packetPingreq     byte = 12
+	packetPingresp    byte = 13
+	packetDisconnect  byte = 14
+)
+
+// MQTT 5 property identifiers used by the client
+const (
+	propMessageExpiry    byte = 0x02
+	propContentType      byte = 0x03
+	propResponseTopic    byte = 0x08
+	propCorrelationData  byte = 0x09
+	propAssignedClientID byte = 0x12
+	propServerKeepAlive  byte = 0x13
+	propReasonString     byte = 0x1F
+	propUserProperty     byte = 0x26
+)
+
+// propertyKind represents the encoding of a property value
+type propertyKind int
+
+const (
+	kindByte propertyKind = iota
+	kindUint16
+	kindUint32
+	kindVarint
+	kindString
+	kindBinary
+	kindPair
+)
+
+// propertyKinds maps all MQTT 5 property identifiers to their encoding, so unused properties can be skipped
+var propertyKinds = map[byte]propertyKind{
+	0x01: kindByte, 0x02: kindUint32, 0x03: kindString, 0x08: kindString, 0x09: kindBinary,
+	0x0B: kindVarint, 0x11: kindUint32, 0x12: kindString, 0x13: kindUint16, 0x15: kindString,
+	0x16: kindBinary, 0x17: kindByte, 0x18: kindUint32, 0x19: kindByte, 0x1A: kindString,
+	0x1C: kindString, 0x1F: kindString, 0x21: kindUint16, 0x22: kindUint16, 0x23: kindUint16,
+	0x24: kindByte, 0x25: kindByte, 0x26: kindPair, 0x27: kindUint32, 0x28: kindByte,
+	0x29: kindByte, 0x2A: kindByte,
+}
+
+// reasonNames describes the MQTT 5 reason codes
+var reasonNames = map[byte]string{
+	0x00: "success",
+	0x10: "no matching subscribers",
+	0x11: "no subscription existed",
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8A: "banned",
+	0x8B: "server shutting down",
+	0x8C: "bad authentication method",
+	0x8E: "session taken over",
+	0x8F: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x93: "receive maximum exceeded",
+	0x95: "packet too large",
+	0x97: "quota exceeded",
+	0x99: "payload format invalid",
+	0x9A: "retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "use another server",
+	0x9D: "server moved",
+	0x9E: "shared subscriptions not supported",
+	0xA1: "subscription identifiers not supported",
+	0xA2: "wildcard subscriptions not supported",
+}
+
+// ErrNotConnected is returned for operations requiring a connection to the broker
+var ErrNotConnected = errors.New("not connected to MQTT broker")
+
+// ReasonCodeError reports a packet the MQTT 5 broker rejected with a reason code
+type ReasonCodeError struct {
+	Packet string
+	Topic  string
+	Code   byte
+	// Reason is the optional reason string sent along by the broker
+	Reason string
+}
+
+// Error formats the rejected packet with the reason code and its description
+func (e *ReasonCodeError) Error() string {
+	msg := fmt.Sprintf("%s rejected: 0x%02X %s", e.Packet, e.Code, reasonNames[e.Code])
+	if e.Topic != "" {
+		msg = fmt.Sprintf("%s on %s rejected: 0x%02X %s", e.Packet, e.Topic, e.Code, reasonNames[e.Code])
+	}
+	if e.Reason != "" {
+		msg += " (" + e.Reason + ")"
+	}
+	return msg
+}
+
+// UserProperty is an MQTT 5 user property, a key-value pair which can occur multiple times
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// PublishProperties represents the MQTT 5 properties of a published message
+type PublishProperties struct {
+	// MessageExpiry is the lifetime of the message in seconds, zero for no expiry
+	MessageExpiry   uint32
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  []UserProperty
+}
+
+// UserProperty returns the value of the first user property with the given key, empty if not found
+func (p *PublishProperties) UserProperty(key string) string {
+	for _, property := range p.UserProperties {
+		if property.Key == key {
+			return property.Value
+		}
+	}
+	return ""
+}
+
+// PropertiesPublisher is implemented by MQTT clients which can publish MQTT 5 properties
+type PropertiesPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties *PublishProperties) mqtt.Token
+}
+
+// PropertiesMessage is implemented by messages received over MQTT 5
+type PropertiesMessage interface {
+	Properties() *PublishProperties
+}
+
+// packetProperties holds the decoded properties of any packet
+type packetProperties struct {
+	PublishProperties
+	ReasonString     string
+	AssignedClientID string
+	ServerKeepAlive  uint16
+	hasKeepAlive     bool
+}
+
+// packetWriter encodes the variable header and payload of a packet
+type packetWriter struct {
+	bytes.Buffer
+}
+
+func (w *packetWriter) writeUint16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *packetWriter) writeUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func (w *packetWriter) writeVarint(v int) {
+	for {
+		b := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			b |= 0x80
+		}
+		w.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func (w *packetWriter) writeBinary(b []byte) {
+	w.writeUint16(uint16(len(b)))
+	w.Write(b)
+}
+
+func (w *packetWriter) writeString(s string) {
+	w.writeBinary([]byte(s))
+}
+
+// writeProperties encodes the publish properties, nil for no properties
+func (w *packetWriter) writeProperties(p *PublishProperties) {
+	var props packetWriter
+	if p != nil {
+		if p.MessageExpiry > 0 {
+			props.WriteByte(propMessageExpiry)
+			props.writeUint32(p.MessageExpiry)
+		}
+		if p.ContentType != "" {
+			props.WriteByte(propContentType)
+			props.writeString(p.ContentType)
+		}
+		if p.ResponseTopic != "" {
+			props.WriteByte(propResponseTopic)
+			props.writeString(p.ResponseTopic)
+		}
+		if p.CorrelationData != nil {
+			props.WriteByte(propCorrelationData)
+			props.writeBinary(p.CorrelationData)
+		}
+		for _, property := range p.UserProperties {
+			props.WriteByte(propUserProperty)
+			props.writeString(property.Key)
+			props.writeString(property.Value)
+		}
+	}
+	w.writeVarint(props.Len())
+	w.Write(props.Bytes())
+}
+
+// packet frames the contents with the fixed header
+func (w *packetWriter) packet(packetType byte, flags byte) []byte {
+	var p packetWriter
+	p.WriteByte(packetType<<4 | flags)
+	p.writeVarint(w.Len())
+	p.Write(w.Bytes())
+	return p.Bytes()
+}
+
+// packetReader decodes the variable header and payload of a packet, keeping the first error
+type packetReader struct {
+	b   []byte
+	err error
+}
+
+func (r *packetReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *packetReader) readByte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *packetReader) readUint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *packetReader) readUint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *packetReader) readVarint() (v int) {
+	multiplier := 1
+	for k := 0; k < 4; k++ {
+		b := r.readByte()
+		v += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			return
+		}
+		multiplier *= 128
+	}
+	if r.err == nil {
+		r.err = errors.New("malformed variable byte integer")
+	}
+	return
+}
+
+func (r *packetReader) readBinary() []byte {
+	n := int(r.readUint16())
+	if b := r.next(n); b != nil {
+		return append([]byte{}, b...)
+	}
+	return nil
+}
+
+func (r *packetReader) readString() string {
+	return string(r.readBinary())
+}
+
+// readProperties decodes the properties, skipping the ones the client does not use
+func (r *packetReader) readProperties() (p packetProperties) {
+	n := r.readVarint()
+	props := &packetReader{b: r.next(n)}
+	if r.err != nil {
+		return
+	}
+	for len(props.b) > 0 && props.err == nil {
+		id := props.readByte()
+		kind, ok := propertyKinds[id]
+		if !ok {
+			r.err = fmt.Errorf("unknown property 0x%02X", id)
+			return
+		}
+		switch id {
+		case propMessageExpiry:
+			p.MessageExpiry = props.readUint32()
+		case propContentType:
+			p.ContentType = props.readString()
+		case propResponseTopic:
+			p.ResponseTopic = props.readString()
+		case propCorrelationData:
+			p.CorrelationData = props.readBinary()
+		case propAssignedClientID:
+			p.AssignedClientID = props.readString()
+		case propServerKeepAlive:
+			p.ServerKeepAlive, p.hasKeepAlive = props.readUint16(), true
+		case propReasonString:
+			p.ReasonString = props.readString()
+		case propUserProperty:
+			p.UserProperties = append(p.UserProperties, UserProperty{Key: props.readString(), Value: props.readString()})
+		default:
+			props.skip(kind)
+		}
+	}
+	r.err = props.err
+	return
+}
+
+// readPublish decodes a PUBLISH packet with the given fixed header byte
+func (r *packetReader) readPublish(header byte) *mqtt5Message {
+	m := &mqtt5Message{qos: header >> 1 & 0x03, retained: header&0x01 != 0, duplicate: header&0x08 != 0}
+	m.topic = r.readString()
+	if m.qos > 0 {
+		m.id = r.readUint16()
+	}
+	m.properties = r.readProperties().PublishProperties
+	m.payload = r.b
+	return m
+}
+
+// skip reads past a property value of the given kind
+func (r *packetReader) skip(kind propertyKind) {
+	switch kind {
+	case kindByte:
+		r.next(1)
+	case kindUint16:
+		r.next(2)
+	case kindUint32:
+		r.next(4)
+	case kindVarint:
+		r.readVarint()
+	case kindString, kindBinary:
+		r.readBinary()
+	case kindPair:
+		r.readBinary()
+		r.readBinary()
+	}
+}
+
+// readPacket reads a single packet, returning the fixed header byte and the remainder
+func readPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	header, err = r.ReadByte()
+	if err != nil {
+		return
+	}
+	length, multiplier := 0, 1
+	for k := 0; ; k++ {
+		if k == 4 {
+			return header, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return header, nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body = make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+// mqtt5Token tracks the completion of an operation of the MQTT 5 client
+type mqtt5Token struct {
+	done  chan struct{}
+	once  sync.Once
+	err   error
+	topic string
+}
+
+func newMQTT5Token() *mqtt5Token {
+	return &mqtt5Token{done: make(chan struct{})}
+}
+
+// complete marks the operation done, only the first outcome counts
+func (t *mqtt5Token) complete(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+// Wait blocks until the operation completed
+func (t *mqtt5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+// WaitTimeout blocks until the operation completed or the timeout passed, returns whether it completed
+func (t *mqtt5Token) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// Error returns the outcome of the completed operation
+func (t *mqtt5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// mqtt5Message is a message received over MQTT 5
+type mqtt5Message struct {
+	topic      string
+	payload    []byte
+	qos        byte
+	retained   bool
+	duplicate  bool
+	id         uint16
+	properties PublishProperties
+}
+
+// messageQueue queues the received messages for the handlers up to a length, so reading from the connection never waits for them
+type messageQueue struct {
+	mu       sync.Mutex
+	ready    *sync.Cond
+	messages []*mqtt5Message
+	length   int
+	closed   bool
+}
+
+func newMessageQueue(length int) *messageQueue {
+	q := &messageQueue{length: length}
+	q.ready = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues a message, unless closed; false if the queue is full
+func (q *messageQueue) push(m *mqtt5Message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return true
+	}
+	if len(q.messages) >= q.length {
+		return false
+	}
+	q.messages = append(q.messages, m)
+	q.ready.Signal()
+	return true
+}
+
+// pop waits for the next message; false once closed and all queued messages are taken
+func (q *messageQueue) pop() (*mqtt5Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.messages) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if len(q.messages) == 0 {
+		return nil, false
+	}
+	m := q.messages[0]
+	q.messages[0] = nil
+	q.messages = q.messages[1:]
+	return m, true
+}
+
+// close stops taking messages, waking up the dispatcher
+func (q *messageQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.ready.Broadcast()
+}
+
+func (m *mqtt5Message) Duplicate() bool                { return m.duplicate }
+func (m *mqtt5Message) Qos() byte                      { return m.qos }
+func (m *mqtt5Message) Retained() bool                 { return m.retained }
+func (m *mqtt5Message) Topic() string                  { return m.topic }
+func (m *mqtt5Message) MessageID() uint16              { return m.id }
+func (m *mqtt5Message) Payload() []byte                { return m.payload }
+func (m *mqtt5Message) Ack()                           {}
+func (m *mqtt5Message) Properties() *PublishProperties { return &m.properties }
+
+// MQTT5Options represents the connection settings of the MQTT 5 client
+type MQTT5Options struct {
+	Broker           string
+	ClientID         string
+	Username         string
+	Password         string
+	TLSConfig        *tls.Config
+	KeepAlive        time.Duration
+	ConnectTimeout   time.Duration
+	AutoReconnect    bool
+	OnConnect        mqtt.OnConnectHandler
+	OnConnectionLost mqtt.ConnectionLostHandler
+}
+
+// MQTT5Client is a minimal MQTT 5 client, supporting QoS 0 and 1. It implements the paho client interface, so the handler can use either.
+type MQTT5Client struct {
+	opts MQTT5Options
+
+	mu        sync.Mutex
+	conn      net.Conn
+	connected bool
+	stop      chan struct{}
+	messages  *messageQueue
+	nextID    uint16
+	pending   map[uint16]*mqtt5Token
+	routes    map[string]mqtt.MessageHandler
+
+	// writeMu makes sure packets are written as a whole
+	writeMu sync.Mutex
+	// connectMu makes sure only one connection is set up at a time
+	connectMu sync.Mutex
+	// retrying is set while reconnecting in the background after a lost connection, accessed atomically
+	retrying int32
+	// lastReceived holds the unix nano timestamp of the last packet received, accessed atomically
+	lastReceived int64
+}
+
+// NewMQTT5Client creates an MQTT 5 client, which still needs to connect
+func NewMQTT5Client(opts MQTT5Options) *MQTT5Client {
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = DefaultKeepAlive
+	}
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+	return &MQTT5Client{
+		opts:    opts,
+		pending: make(map[uint16]*mqtt5Token),
+		routes:  make(map[string]mqtt.MessageHandler),
+	}
+}
+
+// IsConnected checks whether the client is connected to the broker
+func (c *MQTT5Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// IsConnectionOpen checks whether the client is connected to the broker
+func (c *MQTT5Client) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+// OptionsReader is only there to implement the paho client interface, the MQTT 5 client does not use the paho options
+func (c *MQTT5Client) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// dial opens the network connection for the broker URI
+func (c *MQTT5Client) dial() (net.Conn, error) {
+	u, err := url.Parse(c.opts.Broker)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	dialer := &net.Dialer{Timeout: c.opts.ConnectTimeout}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		return dialer.Dial("tcp", host)
+	case "ssl", "tls", "mqtts", "tcps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		return tls.DialWithDialer(dialer, "tcp", host, c.opts.TLSConfig)
+	}
+	return nil, fmt.Errorf("unsupported broker URI scheme %q", u.Scheme)
+}
+
+// Connect connects to the broker and waits for it to accept the connection
+func (c *MQTT5Client) Connect() mqtt.Token {
+	t := newMQTT5Token()
+	t.complete(c.connect())
+	return t
+}
+
+// connect sets up the connection and starts the reading, dispatching and keep alive routines
+func (c *MQTT5Client) connect() error {
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+	if c.IsConnected() {
+		return nil
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	var w packetWriter
+	w.writeString("MQTT")
+	w.WriteByte(MQTTVersion5)
+	flags := byte(0x02) // clean start
+	if c.opts.Username != "" {
+		flags |= 0x80
+	}
+	if c.opts.Password != "" {
+		flags |= 0x40
+	}
+	w.WriteByte(flags)
+	w.writeUint16(uint16(c.opts.KeepAlive / time.Second))
+	w.writeProperties(nil)
+	w.writeString(c.opts.ClientID)
+	if c.opts.Username != "" {
+		w.writeString(c.opts.Username)
+	}
+	if c.opts.Password != "" {
+		w.writeString(c.opts.Password)
+	}
+	conn.SetDeadline(time.Now().Add(c.opts.ConnectTimeout))
+	if _, err := conn.Write(w.packet(packetConnect, 0)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	header, body, err := readPacket(reader)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if header>>4 != packetConnack {
+		conn.Close()
+		return fmt.Errorf("expected CONNACK, got packet type %d", header>>4)
+	}
+	r := &packetReader{b: body}
+	r.readByte() // session present
+	code := r.readByte()
+	props := r.readProperties()
+	if r.err != nil {
+		conn.Close()
+		return r.err
+	}
+	if code >= 0x80 {
+		conn.Close()
+		return &ReasonCodeError{Packet: "connect", Code: code, Reason: props.ReasonString}
+	}
+	conn.SetDeadline(time.Time{})
+	keepAlive := c.opts.KeepAlive
+	if props.hasKeepAlive {
+		keepAlive = time.Duration(props.ServerKeepAlive) * time.Second
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.connected = true
+	c.stop = make(chan struct{})
+	c.messages = newMessageQueue(MQTT5QueueLength)
+	stop, messages := c.stop, c.messages
+	c.mu.Unlock()
+	atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+
+	go c.read(conn, reader, messages)
+	go c.dispatch(messages)
+	if keepAlive > 0 {
+		go c.keepAlive(conn, keepAlive, stop)
+	}
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect(c)
+	}
+	return nil
+}
+
+// write sends a full packet over the current connection
+func (c *MQTT5Client) write(packet []byte) error {
+	c.mu.Lock()
+	conn := c.conn
+	connected := c.connected
+	c.mu.Unlock()
+	if !connected {
+		return ErrNotConnected
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := conn.Write(packet)
+	return err
+}
+
+// register reserves a packet identifier for an operation awaiting acknowledgement
+func (c *MQTT5Client) register(t *mqtt5Token) (id uint16, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return 0, ErrNotConnected
+	}
+	for k := 0; k < 65535; k++ {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+		if _, ok := c.pending[c.nextID]; !ok {
+			c.pending[c.nextID] = t
+			return c.nextID, nil
+		}
+	}
+	return 0, errors.New("no packet identifiers available")
+}
+
+// acknowledged completes the operation for the given packet identifier
+func (c *MQTT5Client) acknowledged(id uint16) *mqtt5Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.pending[id]
+	delete(c.pending, id)
+	return t
+}
+
+// send registers the token for the packet built with the identifier, and writes it
+func (c *MQTT5Client) send(t *mqtt5Token, build func(id uint16) []byte) mqtt.Token {
+	id, err := c.register(t)
+	if err != nil {
+		t.complete(err)
+		return t
+	}
+	if err := c.write(build(id)); err != nil {
+		c.acknowledged(id)
+		t.complete(err)
+	}
+	return t
+}
+
+// Publish publishes a message without properties
+func (c *MQTT5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return c.PublishWithProperties(topic, qos, retained, payload, nil)
+}
+
+// PublishWithProperties publishes a message with MQTT 5 properties. For QoS 1, the token completes on the acknowledgement of the broker, failing with a ReasonCodeError when rejected.
+func (c *MQTT5Client) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties *PublishProperties) mqtt.Token {
+	t := newMQTT5Token()
+	t.topic = topic
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	case []byte:
+		data = p
+	case bytes.Buffer:
+		data = p.Bytes()
+	default:
+		t.complete(fmt.Errorf("unsupported payload type %T", payload))
+		return t
+	}
+	if qos > 1 {
+		t.complete(fmt.Errorf("QoS %d not supported", qos))
+		return t
+	}
+
+	build := func(id uint16) []byte {
+		var w packetWriter
+		w.writeString(topic)
+		if qos > 0 {
+			w.writeUint16(id)
+		}
+		w.writeProperties(properties)
+		w.Write(data)
+		flags := qos << 1
+		if retained {
+			flags |= 0x01
+		}
+		return w.packet(packetPublish, flags)
+	}
+	if qos == 0 {
+		t.complete(c.write(build(0)))
+		return t
+	}
+	return c.send(t, build)
+}
+
+// Subscribe subscribes the handler to the topic filter; the token fails with a ReasonCodeError when rejected
+func (c *MQTT5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple subscribes the handler to all topic filters at once
+func (c *MQTT5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	t := newMQTT5Token()
+	topics := make([]string, 0, len(filters))
+	for topic := range filters {
+		topics = append(topics, topic)
+		c.AddRoute(topic, callback)
+	}
+	if len(topics) == 1 {
+		t.topic = topics[0]
+	}
+	return c.send(t, func(id uint16) []byte {
+		var w packetWriter
+		w.writeUint16(id)
+		w.writeProperties(nil)
+		for _, topic := range topics {
+			w.writeString(topic)
+			w.WriteByte(filters[topic] & 0x03)
+		}
+		return w.packet(packetSubscribe, 0x02)
+	})
+}
+
+// Unsubscribe ends the subscriptions on the topic filters
+func (c *MQTT5Client) Unsubscribe(topics ...string) mqtt.Token {
+	c.mu.Lock()
+	for _, topic := range topics {
+		delete(c.routes, topic)
+	}
+	c.mu.Unlock()
+	t := newMQTT5Token()
+	if len(topics) == 1 {
+		t.topic = topics[0]
+	}
+	return c.send(t, func(id uint16) []byte {
+		var w packetWriter
+		w.writeUint16(id)
+		w.writeProperties(nil)
+		for _, topic := range topics {
+			w.writeString(topic)
+		}
+		return w.packet(packetUnsubscribe, 0x02)
+	})
+}
+
+// AddRoute sets the handler for messages matching the topic filter, without subscribing
+func (c *MQTT5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.routes[topic] = callback
+}
+
+// Disconnect ends the connection with the broker, without triggering a reconnect
+func (c *MQTT5Client) Disconnect(quiesce uint) {
+	var w packetWriter
+	w.WriteByte(0x00) // normal disconnection
+	w.writeProperties(nil)
+	c.write(w.packet(packetDisconnect, 0))
+	time.Sleep(time.Duration(quiesce) * time.Millisecond)
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	c.closeConnection(conn, ErrNotConnected)
+}
+
+// closeConnection tears down the given connection, failing all pending operations. Returns false if it was already closed.
+func (c *MQTT5Client) closeConnection(conn net.Conn, err error) bool {
+	c.mu.Lock()
+	if c.conn != conn || !c.connected {
+		c.mu.Unlock()
+		return false
+	}
+	c.connected = false
+	close(c.stop)
+	c.messages.close()
+	pending := c.pending
+	c.pending = make(map[uint16]*mqtt5Token)
+	c.mu.Unlock()
+
+	conn.Close()
+	for _, t := range pending {
+		t.complete(err)
+	}
+	return true
+}
+
+// lost handles a broken connection, reconnecting when configured to
+func (c *MQTT5Client) lost(conn net.Conn, err error) {
+	if !c.closeConnection(conn, err) {
+		return
+	}
+	if c.opts.OnConnectionLost != nil {
+		go c.opts.OnConnectionLost(c, err)
+	}
+	if c.opts.AutoReconnect && atomic.CompareAndSwapInt32(&c.retrying, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&c.retrying, 0)
+			backoff.Retry(c.connect, backoff.NewExponentialBackOff())
+		}()
+	}
+}
+
+// Reconnecting checks whether the client is reconnecting by itself after a lost connection
+func (c *MQTT5Client) Reconnecting() bool {
+	return atomic.LoadInt32(&c.retrying) == 1
+}
+
+// read handles the incoming packets until the connection breaks
+func (c *MQTT5Client) read(conn net.Conn, reader *bufio.Reader, messages *messageQueue) {
+	for {
+		header, body, err := readPacket(reader)
+		if err != nil {
+			c.lost(conn, err)
+			return
+		}
+		atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+		r := &packetReader{b: body}
+
+		switch header >> 4 {
+		case packetPublish:
+			m := r.readPublish(header)
+			if r.err != nil {
+				break
+			}
+			// Never blocks, as the handlers may need the acknowledgements read here
+			if !messages.push(m) {
+				mqttLog.Warn("Dropped MQTT message, the handlers are falling behind", "topic", m.topic, "queued", MQTT5QueueLength)
+			}
+			if m.qos > 0 {
+				var w packetWriter
+				w.writeUint16(m.id)
+				c.write(w.packet(packetPuback, 0))
+			}
+		case packetPuback:
+			id := r.readUint16()
+			code := byte(0)
+			var props packetProperties
+			if len(r.b) > 0 {
+				code = r.readByte()
+			}
+			if len(r.b) > 0 {
+				props = r.readProperties()
+			}
+			if t := c.acknowledged(id); t != nil {
+				if code >= 0x80 {
+					t.complete(&ReasonCodeError{Packet: "publish", Topic: t.topic, Code: code, Reason: props.ReasonString})
+				} else {
+					t.complete(nil)
+				}
+			}
+		case packetSuback, packetUnsuback:
+			packet := "subscribe"
+			if header>>4 == packetUnsuback {
+				packet = "unsubscribe"
+			}
+			id := r.readUint16()
+			props := r.readProperties()
+			t := c.acknowledged(id)
+			if t == nil {
+				break
+			}
+			var rejected error
+			for _, code := range r.b {
+				if code >= 0x80 {
+					rejected = &ReasonCodeError{Packet: packet, Topic: t.topic, Code: code, Reason: props.ReasonString}
+					break
+				}
+			}
+			t.complete(rejected)
+		case packetDisconnect:
+			code := byte(0)
+			var props packetProperties
+			if len(r.b) > 0 {
+				code = r.readByte()
+			}
+			if len(r.b) > 0 {
+				props = r.readProperties()
+			}
+			c.lost(conn, &ReasonCodeError{Packet: "connection", Code: code, Reason: props.ReasonString})
+			return
+		case packetPingresp:
+		default:
+			r.err = fmt.Errorf("unexpected packet type %d", header>>4)
+		}
+		if r.err != nil {
+			c.lost(conn, fmt.Errorf("malformed packet from broker: %s", r.err))
+			return
+		}
+	}
+}
+
+// dispatch hands the received messages to the matching handlers, in order
+func (c *MQTT5Client) dispatch(messages *messageQueue) {
+	for {
+		m, ok := messages.pop()
+		if !ok {
+			return
+		}
+		c.mu.Lock()
+		var handlers []mqtt.MessageHandler
+		for filter, handler := range c.routes {
+			if topicMatches(filter, m.topic) {
+				handlers = append(handlers, handler)
+			}
+		}
+		c.mu.Unlock()
+		for _, handler := range handlers {
+			handler(c, m)
+		}
+	}
+}
+
+// keepAlive pings the broker and drops the connection when the broker stops responding
+func (c *MQTT5Client) keepAlive(conn net.Conn, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var w packetWriter
+	ping := w.packet(packetPingreq, 0)
+	for {
+		select {
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&c.lastReceived))
+			if time.Since(last) > interval*3/2 {
+				c.lost(conn, errors.New("MQTT broker stopped responding"))
+				return
+			}
+			c.write(ping)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package unipitt
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// stubBroker is a minimal MQTT 5 broker serving a single client, replying with the configured reason codes
+type stubBroker struct {
+	listener    net.Listener
+	connackCode byte
+	subackCode  byte
+	pubackCode  byte
+	username    string
+	conn        chan net.Conn
+	received    chan *mqtt5Message
+}
+
+func newStubBroker(t *testing.T) *stubBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &stubBroker{listener: listener, conn: make(chan net.Conn, 1), received: make(chan *mqtt5Message, 16)}
+	go b.serve()
+	return b
+}
+
+// uri returns the broker URI to connect the client to
+func (b *stubBroker) uri() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *stubBroker) serve() {
+	conn, err := b.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, body, err := readPacket(reader)
+	if err != nil {
+		return
+	}
+	r := &packetReader{b: body}
+	r.readString()
+	r.readByte()
+	flags := r.readByte()
+	r.readUint16()
+	r.readProperties()
+	r.readString()
+	if flags&0x80 != 0 {
+		b.username = r.readString()
+	}
+	conn.Write([]byte{packetConnack << 4, 3, 0, b.connackCode, 0})
+	if b.connackCode >= 0x80 {
+		return
+	}
+	b.conn <- conn
+
+	for {
+		header, body, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+		r := &packetReader{b: body}
+		var w packetWriter
+		switch header >> 4 {
+		case packetPublish:
+			m := r.readPublish(header)
+			if m.qos > 0 {
+				w.writeUint16(m.id)
+				w.WriteByte(b.pubackCode)
+				w.writeProperties(nil)
+				conn.Write(w.packet(packetPuback, 0))
+			}
+			b.received <- m
+		case packetSubscribe:
+			w.writeUint16(r.readUint16())
+			w.writeProperties(nil)
+			w.WriteByte(b.subackCode)
+			conn.Write(w.packet(packetSuback, 0))
+		case packetUnsubscribe:
+			w.writeUint16(r.readUint16())
+			w.writeProperties(nil)
+			w.WriteByte(0)
+			conn.Write(w.packet(packetUnsuback, 0))
+		case packetPingreq:
+			conn.Write(w.packet(packetPingresp, 0))
+		case packetDisconnect:
+			return
+		}
+	}
+}
+
+// publish sends a QoS 0 message with properties to the client
+func (b *stubBroker) publish(t *testing.T, topic string, payload string, properties *PublishProperties) {
+	var conn net.Conn
+	select {
+	case conn = <-b.conn:
+		b.conn <- conn
+	case <-time.After(time.Second):
+		t.Fatal("Expected the client to connect to the broker")
+	}
+	var w packetWriter
+	w.writeString(topic)
+	w.writeProperties(properties)
+	w.WriteString(payload)
+	conn.Write(w.packet(packetPublish, 0))
+}
+
+// next waits for the next message published by the client
+func (b *stubBroker) next(t *testing.T) *mqtt5Message {
+	select {
+	case m := <-b.received:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("Expected the client to publish a message")
+	}
+	return nil
+}
+
+func (b *stubBroker) Close() {
+	b.listener.Close()
+}
+
+func TestMessageQueueBounded(t *testing.T) {
+	cases := []struct {
+		Length int
+		Pushed int
+		Queued int
+	}{
+		{Length: 3, Pushed: 2, Queued: 2},
+		{Length: 3, Pushed: 3, Queued: 3},
+		{Length: 3, Pushed: 5, Queued: 3},
+	}
+	for _, testCase := range cases {
+		q := newMessageQueue(testCase.Length)
+		dropped := 0
+		for k := 0; k < testCase.Pushed; k++ {
+			if !q.push(&mqtt5Message{id: uint16(k)}) {
+				dropped++
+			}
+		}
+		if dropped != testCase.Pushed-testCase.Queued {
+			t.Fatalf("Expected %d messages dropped for %v, got %d\n", testCase.Pushed-testCase.Queued, testCase, dropped)
+		}
+		q.close()
+		for k := 0; k < testCase.Queued; k++ {
+			if m, ok := q.pop(); !ok || m.id != uint16(k) {
+				t.Fatalf("Expected message %d queued for %v, got %v\n", k, testCase, m)
+			}
+		}
+		if _, ok := q.pop(); ok {
+			t.Fatalf("Expected no more messages for %v\n", testCase)
+		}
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		Filter   string
+		Topic    string
+		Expected bool
+	}{
+		{Filter: "do_1_01", Topic: "do_1_01", Expected: true},
+		{Filter: "do_1_01", Topic: "do_1_02", Expected: false},
+		{Filter: "unipitt/+/set", Topic: "unipitt/do_1_01/set", Expected: true},
+		{Filter: "unipitt/+/set", Topic: "unipitt/do_1_01/get", Expected: false},
+		{Filter: "unipitt/+", Topic: "unipitt/do_1_01/set", Expected: false},
+		{Filter: "unipitt/#", Topic: "unipitt/do_1_01/set", Expected: true},
+		{Filter: "#", Topic: "kitchen light", Expected: true},
+	}
+	for _, testCase := range cases {
+		if result := topicMatches(testCase.Filter, testCase.Topic); result != testCase.Expected {
+			t.Fatalf("Expected %s matching %s to be %v, got %v\n", testCase.Filter, testCase.Topic, testCase.Expected, result)
+		}
+	}
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	properties := &PublishProperties{
+		MessageExpiry:   10,
+		ContentType:     "text/plain",
+		ResponseTopic:   "replies",
+		CorrelationData: []byte{1, 2, 3},
+		UserProperties:  []UserProperty{{Key: "channel", Value: "di_1_01"}, {Key: "channel", Value: "di_1_02"}},
+	}
+	var w packetWriter
+	w.writeProperties(properties)
+	// Properties the client does not use are skipped
+	w.Bytes()[0] += 4
+	w.Write([]byte{0x24, 1, 0x17, 1})
+
+	r := &packetReader{b: w.Bytes()}
+	decoded := r.readProperties()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if decoded.MessageExpiry != 10 || decoded.ContentType != "text/plain" || decoded.ResponseTopic != "replies" || !bytes.Equal(decoded.CorrelationData, []byte{1, 2, 3}) {
+		t.Fatalf("Expected the properties to be decoded, got %+v\n", decoded)
+	}
+	if len(decoded.UserProperties) != 2 || decoded.UserProperty("channel") != "di_1_01" {
+		t.Fatalf("Expected 2 user properties, got %v\n", decoded.UserProperties)
+	}
+}
+
+func TestMQTT5ConnectRejected(t *testing.T) {
+	stub := newStubBroker(t)
+	defer stub.Close()
+	stub.connackCode = 0x86
+
+	client := NewMQTT5Client(MQTT5Options{Broker: stub.uri(), ClientID: "unipitt", Username: "unipi", Password: "wrong"})
+	token := client.Connect()
+	token.Wait()
+	err, ok := token.Error().(*ReasonCodeError)
+	if !ok || err.Code != 0x86 {
+		t.Fatalf("Expected the connection to be rejected with 0x86, got %v\n", token.Error())
+	}
+	if hint := connectHint(err); !strings.Contains(hint, "username") {
+		t.Fatalf("Expected a hint on the credentials, got %q\n", hint)
+	}
+	if client.IsConnected() {
+		t.Fatal("Expected the client not to be connected")
+	}
+}
+
+func TestMQTT5Publish(t *testing.T) {
+	stub := newStubBroker(t)
+	defer stub.Close()
+
+	client := NewMQTT5Client(MQTT5Options{Broker: stub.uri(), ClientID: "unipitt", Username: "unipi"})
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+	if stub.username != "unipi" {
+		t.Fatalf("Expected username %s, got %s\n", "unipi", stub.username)
+	}
+
+	properties := &PublishProperties{MessageExpiry: 5, UserProperties: []UserProperty{{Key: "channel", Value: "di_1_01"}}}
+	if token := client.PublishWithProperties("kitchen", 1, false, "trigger", properties); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	m := stub.next(t)
+	if m.topic != "kitchen" || string(m.payload) != "trigger" || m.properties.MessageExpiry != 5 || m.properties.UserProperty("channel") != "di_1_01" {
+		t.Fatalf("Expected the trigger with its properties, got %+v\n", m)
+	}
+
+	stub.pubackCode = 0x87
+	token := client.PublishWithProperties("kitchen", 1, false, "trigger", nil)
+	token.Wait()
+	if err, ok := token.Error().(*ReasonCodeError); !ok || err.Code != 0x87 || err.Topic != "kitchen" {
+		t.Fatalf("Expected the publish to be rejected with 0x87, got %v\n", token.Error())
+	}
+}
+
+func TestMQTT5SubscribeRejected(t *testing.T) {
+	stub := newStubBroker(t)
+	defer stub.Close()
+	stub.subackCode = 0x87
+
+	client := NewMQTT5Client(MQTT5Options{Broker: stub.uri(), ClientID: "unipitt"})
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+
+	token := client.Subscribe("do_1_01", 0, func(mqtt.Client, mqtt.Message) {})
+	token.Wait()
+	if err, ok := token.Error().(*ReasonCodeError); !ok || err.Code != 0x87 || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatalf("Expected the subscription to be rejected with 0x87, got %v\n", token.Error())
+	}
+}
+
+func TestMQTT5ConnectionLost(t *testing.T) {
+	stub := newStubBroker(t)
+	lost := make(chan error, 1)
+	client := NewMQTT5Client(MQTT5Options{
+		Broker:           stub.uri(),
+		ClientID:         "unipitt",
+		OnConnectionLost: func(c mqtt.Client, err error) { lost <- err },
+	})
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	(<-stub.conn).Close()
+	stub.Close()
+
+	select {
+	case <-lost:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the connection lost handler to be called")
+	}
+	if client.IsConnected() {
+		t.Fatal("Expected the client not to be connected")
+	}
+	if token := client.Publish("kitchen", 0, false, "trigger"); token.Wait() && token.Error() != ErrNotConnected {
+		t.Fatalf("Expected %v, got %v\n", ErrNotConnected, token.Error())
+	}
+}
+
+func TestHandlerMQTT5(t *testing.T) {
+	root, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	folder := path.Join(root, "do_1_01")
+	if err := os.Mkdir(folder, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	stub := newStubBroker(t)
+	defer stub.Close()
+	h := &Handler{
+		writerMap: map[string]DigitalOutput{"do_1_01": &DigitalOutputWriter{Name: "do_1_01", Path: folder}},
+		config:    Configuration{MessageExpiry: 10, BoardSerial: "1234"},
+	}
+	client := NewMQTT5Client(MQTT5Options{Broker: stub.uri(), ClientID: "unipitt"})
+	h.brokers = []*broker{{name: stub.uri(), client: client}}
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+	h.subscribe(client, h.subscriptions(h.configuration()))
+
+	// Triggers carry the channel, edge and board serial
+	if err := h.publishTrigger(client, "kitchen", "trigger", Event{Name: "di_1_01", Value: true}); err != nil {
+		t.Fatal(err)
+	}
+	m := stub.next(t)
+	for key, expected := range map[string]string{"channel": "di_1_01", "edge": "rising", "board_serial": "1234"} {
+		if value := m.properties.UserProperty(key); value != expected {
+			t.Fatalf("Expected user property %s to be %s, got %s\n", key, expected, value)
+		}
+	}
+	if m.qos != 1 || m.properties.MessageExpiry != 10 {
+		t.Fatalf("Expected QoS 1 and message expiry 10, got %d and %d\n", m.qos, m.properties.MessageExpiry)
+	}
+
+	// Commands with a response topic are acknowledged with the correlation data
+	stub.publish(t, "do_1_01", MsgTrueValue, &PublishProperties{ResponseTopic: "replies", CorrelationData: []byte("42")})
+	m = stub.next(t)
+	if m.topic != "replies" || string(m.payload) != `{"name":"do_1_01","success":true,"value":"ON"}` || string(m.properties.CorrelationData) != "42" || m.properties.UserProperty("status") != "ok" {
+		t.Fatalf("Expected an acknowledgement on replies, got %+v\n", m)
+	}
+	value, err := ioutil.ReadFile(path.Join(folder, DoFilename))
+	if err != nil || string(value) != DoTrueValue {
+		t.Fatalf("Expected the digital output to be updated, got %q (%v)\n", value, err)
+	}
+}
+
+func TestMQTT5Burst(t *testing.T) {
+	root, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	folder := path.Join(root, "do_1_01")
+	if err := os.Mkdir(folder, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	stub := newStubBroker(t)
+	defer stub.Close()
+	h := &Handler{writerMap: map[string]DigitalOutput{"do_1_01": &DigitalOutputWriter{Name: "do_1_01", Path: folder}}}
+	client := NewMQTT5Client(MQTT5Options{Broker: stub.uri(), ClientID: "unipitt"})
+	h.brokers = []*broker{{name: stub.uri(), client: client}}
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(0)
+	h.subscribe(client, h.subscriptions(h.configuration()))
+
+	// Acknowledging at QoS 1 needs the reader, which should not wait for the handlers with a burst of commands queued
+	const count = 200
+	for k := 0; k < count; k++ {
+		stub.publish(t, "do_1_01", MsgTrueValue, &PublishProperties{ResponseTopic: "replies"})
+	}
+	for k := 0; k < count; k++ {
+		if m := stub.next(t); m.topic != "replies" {
+			t.Fatalf("Expected acknowledgement %d on replies, got %+v\n", k, m)
+		}
+	}
+}
+
+func TestMQTT5ConcurrentConnect(t *testing.T) {
+	stub := newStubBroker(t)
+	defer stub.Close()
+
+	// The stub broker serves a single connection, so a second one would time out
+	client := NewMQTT5Client(MQTT5Options{Broker: stub.uri(), ClientID: "unipitt", ConnectTimeout: 500 * time.Millisecond})
+	errs := make(chan error, 2)
+	for k := 0; k < 2; k++ {
+		go func() {
+			token := client.Connect()
+			token.Wait()
+			errs <- token.Error()
+		}()
+	}
+	for k := 0; k < 2; k++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Expected both connects to succeed on the one connection, got %v\n", err)
+		}
+	}
+	client.Disconnect(0)
+}
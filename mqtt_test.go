@@ -1,9 +1,22 @@
 package unipitt
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"io/ioutil"
+	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 func TestNewTLSConfig(t *testing.T) {
@@ -28,3 +41,267 @@ func TestNewTLSConfigNoFile(t *testing.T) {
 		t.Fatal("Expected an error reading the file, got none")
 	}
 }
+
+// writeKeyPair generates a self-signed client certificate and key in the given folder, encrypting the key if a password is given
+func writeKeyPair(t *testing.T, dir string, password string) (certFile string, keyFile string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "unipitt"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "client.crt")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if password != "" {
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(password), x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyFile = filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestAuthConfigurationTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeKeyPair(t, dir, "")
+
+	a := AuthConfiguration{CertFile: certFile, KeyFile: keyFile, ServerName: "broker.lan", InsecureSkipVerify: true}
+	if !a.UsesTLS() {
+		t.Fatal("Expected TLS to be used with a client certificate")
+	}
+	c, err := a.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Certificates) != 1 {
+		t.Fatalf("Expected a single client certificate, got %d\n", len(c.Certificates))
+	}
+	if c.ServerName != "broker.lan" || !c.InsecureSkipVerify {
+		t.Fatalf("Expected server name and insecure skip verify to be set, got %s and %t\n", c.ServerName, c.InsecureSkipVerify)
+	}
+}
+
+func TestAuthConfigurationTLSConfigEncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeKeyPair(t, dir, "secret")
+	passwordFile := filepath.Join(dir, "key_password")
+	if err := ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Auth     AuthConfiguration
+		HasError bool
+	}{
+		{Auth: AuthConfiguration{CertFile: certFile, KeyFile: keyFile, KeyPassword: "secret"}},
+		{Auth: AuthConfiguration{CertFile: certFile, KeyFile: keyFile, KeyPasswordFile: passwordFile}},
+		{Auth: AuthConfiguration{CertFile: certFile, KeyFile: keyFile, KeyPassword: "wrong"}, HasError: true},
+		{Auth: AuthConfiguration{CertFile: certFile, KeyFile: keyFile}, HasError: true},
+		{Auth: AuthConfiguration{CertFile: certFile, KeyFile: "foo", KeyPassword: "secret"}, HasError: true},
+	}
+	for _, testCase := range cases {
+		_, err := testCase.Auth.TLSConfig()
+		if (err != nil) != testCase.HasError {
+			t.Fatalf("Expected error %t for %v, got %v\n", testCase.HasError, testCase.Auth, err)
+		}
+	}
+}
+
+func TestAuthConfigurationCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from file\n")
+	f.Close()
+
+	cases := []struct {
+		Auth     AuthConfiguration
+		Expected string
+		HasError bool
+	}{
+		{Auth: AuthConfiguration{Username: "unipitt", Password: "secret"}, Expected: "secret"},
+		{Auth: AuthConfiguration{Username: "unipitt", PasswordFile: f.Name()}, Expected: "from file"},
+		{Auth: AuthConfiguration{Username: "unipitt", PasswordFile: "foo"}, HasError: true},
+	}
+	for _, testCase := range cases {
+		username, password, err := testCase.Auth.Credentials()
+		if (err != nil) != testCase.HasError {
+			t.Fatalf("Expected error %t, got %v\n", testCase.HasError, err)
+		}
+		if username != "unipitt" || password != testCase.Expected {
+			t.Fatalf("Expected credentials unipitt and %s, got %s and %s\n", testCase.Expected, username, password)
+		}
+	}
+}
+
+func TestAuthConfigurationProblems(t *testing.T) {
+	cases := []struct {
+		Auth     AuthConfiguration
+		Problems int
+	}{
+		{Auth: AuthConfiguration{CertFile: "client.crt", KeyFile: "client.key", Username: "unipitt", Password: "secret"}},
+		{Auth: AuthConfiguration{CertFile: "client.crt"}, Problems: 1},
+		{Auth: AuthConfiguration{KeyFile: "client.key"}, Problems: 1},
+		{Auth: AuthConfiguration{Username: "unipitt", Password: "secret", PasswordFile: "password"}, Problems: 1},
+		{Auth: AuthConfiguration{Password: "secret"}, Problems: 1},
+	}
+	for _, testCase := range cases {
+		if problems := testCase.Auth.Problems(); len(problems) != testCase.Problems {
+			t.Fatalf("Expected %d problems for %v, got %v\n", testCase.Problems, testCase.Auth, problems)
+		}
+	}
+}
+
+func TestConfigurationDumpMasksSecrets(t *testing.T) {
+	c := DefaultConfiguration()
+	c.Password = "secret"
+	c.KeyPassword = "secret"
+	out, err := c.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "secret") {
+		t.Fatalf("Expected passwords to be masked, got %s\n", out)
+	}
+	if c.Password != "secret" {
+		t.Fatal("Expected the configuration itself to be left untouched")
+	}
+}
+
+func TestConnectHint(t *testing.T) {
+	cases := []struct {
+		Err      error
+		Expected string
+	}{
+		{Err: errors.New("Network Error : x509: certificate signed by unknown authority"), Expected: "cafile"},
+		{Err: errors.New("Network Error : remote error: tls: bad certificate"), Expected: "certfile"},
+		{Err: errors.New("Connection Error: bad user name or password"), Expected: "username"},
+		{Err: errors.New("Network Error : connection refused"), Expected: ""},
+	}
+	for _, testCase := range cases {
+		hint := connectHint(testCase.Err)
+		if testCase.Expected == "" && hint != "" || !strings.Contains(hint, testCase.Expected) {
+			t.Fatalf("Expected hint for %s to mention %q, got %q\n", testCase.Err, testCase.Expected, hint)
+		}
+	}
+}
+
+// fakeToken is a completed MQTT token
+type fakeToken struct {
+	err error
+}
+
+func (t *fakeToken) Wait() bool                     { return true }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t *fakeToken) Error() error                   { return t.err }
+
+// fakeMessage is an MQTT message delivered to a handler
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 0 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 0 }
+func (m *fakeMessage) Payload() []byte   { return m.payload }
+func (m *fakeMessage) Ack()              {}
+
+// fakeClient records the interactions with an MQTT broker, for testing without one
+type fakeClient struct {
+	sync.Mutex
+	connected     bool
+	subscriptions map[string]mqtt.MessageHandler
+	published     []fakeMessage
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{connected: true, subscriptions: make(map[string]mqtt.MessageHandler)}
+}
+
+func (c *fakeClient) IsConnected() bool      { return c.connected }
+func (c *fakeClient) IsConnectionOpen() bool { return c.connected }
+func (c *fakeClient) Connect() mqtt.Token    { return &fakeToken{} }
+func (c *fakeClient) Disconnect(uint)        {}
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.Lock()
+	defer c.Unlock()
+	var b []byte
+	switch p := payload.(type) {
+	case string:
+		b = []byte(p)
+	case []byte:
+		b = p
+	}
+	c.published = append(c.published, fakeMessage{topic: topic, payload: b})
+	return &fakeToken{}
+}
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.Lock()
+	defer c.Unlock()
+	c.subscriptions[topic] = callback
+	return &fakeToken{}
+}
+func (c *fakeClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	for topic, qos := range filters {
+		c.Subscribe(topic, qos, callback)
+	}
+	return &fakeToken{}
+}
+func (c *fakeClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.Lock()
+	defer c.Unlock()
+	for _, topic := range topics {
+		delete(c.subscriptions, topic)
+	}
+	return &fakeToken{}
+}
+func (c *fakeClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
+func (c *fakeClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// deliver hands a message to the handler subscribed on a filter matching the topic
+func (c *fakeClient) deliver(topic string, payload string) bool {
+	c.Lock()
+	var callback mqtt.MessageHandler
+	for filter, handler := range c.subscriptions {
+		if topicMatches(filter, topic) {
+			callback = handler
+		}
+	}
+	c.Unlock()
+	if callback != nil {
+		callback(c, &fakeMessage{topic: topic, payload: []byte(payload)})
+	}
+	return callback != nil
+}
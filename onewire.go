@@ -0,0 +1,237 @@
+package unipitt
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SysW1Root is the folder the w1 kernel driver lists the 1-Wire devices in
+	SysW1Root = "/sys/bus/w1/devices"
+	// W1SensorPattern matches the folders of the DS18B20 temperature sensors, by family code
+	W1SensorPattern = "28-*"
+	// W1SlaveFilename holds the scratchpad of a sensor with the CRC check and the temperature, like "... crc=57 YES\n... t=23125"
+	W1SlaveFilename = "w1_slave"
+	// W1TemperatureFilename holds just the temperature in millidegrees, on newer kernels
+	W1TemperatureFilename = "temperature"
+	// DefaultSensorInterval is the default interval in seconds to read the sensors at
+	DefaultSensorInterval = 60
+	// SensorMissing is reported for a sensor which disappeared from the bus
+	SensorMissing = "missing"
+	// W1PowerOnValue is the temperature in degrees in the scratchpad of a DS18B20 before its first conversion, e.g. after a brown-out
+	W1PowerOnValue = 85
+	// W1PowerOnJump is the change in degrees from the last published temperature beyond which the power-on value is not trusted
+	W1PowerOnJump = 10
+)
+
+// ErrSensorCRC is returned for a sensor reading which failed the CRC check, e.g. due to a long or noisy bus
+var ErrSensorCRC = errors.New("CRC check failed")
+
+// ErrSensorPowerOn is reported for a sensor reading the power-on value of 85 degrees instead of a temperature
+var ErrSensorPowerOn = errors.New("power-on value, no temperature converted")
+
+// crc8 computes the Dallas/Maxim CRC of the 1-Wire devices
+func crc8(data []byte) (crc byte) {
+	for _, b := range data {
+		for k := 0; k < 8; k++ {
+			mix := (crc ^ b) & 1
+			crc >>= 1
+			if mix != 0 {
+				crc ^= 0x8c
+			}
+			b >>= 1
+		}
+	}
+	return
+}
+
+// parseW1Slave parses the contents of a w1_slave file into the temperature in degrees Celsius, checking the CRC of the scratchpad
+func parseW1Slave(content string) (float64, error) {
+	lines := strings.Split(strings.TrimSpace(content), "\n")
+	if len(lines) != 2 {
+		return 0, fmt.Errorf("unexpected w1_slave contents %q", content)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, ErrSensorCRC
+	}
+	fields := strings.Fields(lines[0])
+	if k := strings.Index(lines[0], ":"); k > 0 {
+		fields = strings.Fields(lines[0][:k])
+	}
+	scratchpad, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil || len(scratchpad) != 9 {
+		return 0, fmt.Errorf("unexpected scratchpad %q", lines[0])
+	}
+	if crc8(scratchpad[:8]) != scratchpad[8] {
+		return 0, ErrSensorCRC
+	}
+	k := strings.Index(lines[1], "t=")
+	if k < 0 {
+		return 0, fmt.Errorf("no temperature in %q", lines[1])
+	}
+	return parseMillidegrees(lines[1][k+2:])
+}
+
+// parseMillidegrees parses a temperature in millidegrees into degrees
+func parseMillidegrees(value string) (float64, error) {
+	millis, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid temperature %q", value)
+	}
+	return float64(millis) / 1000, nil
+}
+
+// Sensor is a DS18B20 temperature sensor on the 1-Wire bus, named by its ID
+type Sensor struct {
+	ID   string
+	Path string
+	// value last published, if published
+	value     float64
+	published bool
+	// problem is the last problem reported, empty if none
+	problem string
+	// powerOn is set when the last reading was dropped as power-on value
+	powerOn bool
+}
+
+// Read reads the temperature in degrees Celsius, from the w1_slave file or otherwise the temperature file
+func (s *Sensor) Read() (float64, error) {
+	content, err := ioutil.ReadFile(path.Join(s.Path, W1SlaveFilename))
+	if err == nil {
+		return parseW1Slave(string(content))
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	if content, err = ioutil.ReadFile(path.Join(s.Path, W1TemperatureFilename)); err != nil {
+		return 0, err
+	}
+	return parseMillidegrees(string(content))
+}
+
+// powerOnValue checks whether the reading is the power-on value rather than a temperature: 85 degrees as first reading or as a jump from the last published temperature, unless read twice in a row
+func (s *Sensor) powerOnValue(value float64) bool {
+	dropped := value == W1PowerOnValue && !s.powerOn && (!s.published || math.Abs(value-s.value) > W1PowerOnJump)
+	s.powerOn = dropped
+	return dropped
+}
+
+// FindSensors finds the IDs of the temperature sensors on the 1-Wire bus, none without root
+func FindSensors(root string) (ids []string, err error) {
+	if root == "" {
+		return
+	}
+	paths, err := filepath.Glob(filepath.Join(root, W1SensorPattern))
+	for _, folder := range paths {
+		ids = append(ids, filepath.Base(folder))
+	}
+	sort.Strings(ids)
+	return
+}
+
+// reportSensor logs a change in the problem of a sensor, keeping it for the health check
+func (h *Handler) reportSensor(s *Sensor, problem string) {
+	h.sensorMu.Lock()
+	defer h.sensorMu.Unlock()
+	if problem == s.problem {
+		return
+	}
+	switch {
+	case problem == SensorMissing:
+		sensorLog.Warn("1-Wire sensor disappeared", "id", s.ID)
+	case problem != "":
+		sensorLog.Warn("Error reading 1-Wire sensor", "id", s.ID, "err", problem)
+	default:
+		sensorLog.Info("1-Wire sensor recovered", "id", s.ID, "problem", s.problem)
+	}
+	s.problem = problem
+}
+
+// updateSensors reads the sensors on the bus, publishing the temperatures which changed by at least the deadband; sensors which disappeared or fail to read are reported once
+func (h *Handler) updateSensors(c *Configuration) {
+	ids, err := FindSensors(c.W1Root)
+	if err != nil {
+		sensorLog.Error("Error finding 1-Wire sensors", "root", c.W1Root, "err", err)
+		return
+	}
+	present := make(map[string]bool)
+	for _, id := range ids {
+		present[id] = true
+		if _, ok := h.sensors[id]; !ok {
+			sensorLog.Info("Found 1-Wire sensor", "id", id, "topic", c.Topic(id))
+			h.sensorMu.Lock()
+			if h.sensors == nil {
+				h.sensors = make(map[string]*Sensor)
+			}
+			h.sensors[id] = &Sensor{ID: id, Path: filepath.Join(c.W1Root, id)}
+			h.sensorMu.Unlock()
+		}
+	}
+	for _, id := range sortedKeys(h.sensors) {
+		s := h.sensors[id]
+		if !present[id] {
+			h.reportSensor(s, SensorMissing)
+			continue
+		}
+		value, err := s.Read()
+		if err != nil {
+			h.reportSensor(s, err.Error())
+			continue
+		}
+		if s.powerOnValue(value) {
+			h.reportSensor(s, ErrSensorPowerOn.Error())
+			continue
+		}
+		h.reportSensor(s, "")
+		if s.published && (value == s.value || math.Abs(value-s.value) < c.SensorDeadband) {
+			continue
+		}
+		sensorLog.Debug("Publishing temperature", "id", id, "value", value)
+		h.publishRetained(c.Topic(id), strconv.FormatFloat(value, 'f', -1, 64))
+		s.value, s.published = value, true
+	}
+}
+
+// Sense reads the 1-Wire sensors at the interval in seconds until done, unless there is no 1-Wire root
+func (h *Handler) Sense(done chan bool, interval int) {
+	if h.configuration().W1Root == "" {
+		return
+	}
+	h.updateSensors(h.configuration())
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.updateSensors(h.configuration())
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkSensors lists the sensors which disappeared or fail to read
+func (h *Handler) checkSensors() error {
+	h.sensorMu.Lock()
+	defer h.sensorMu.Unlock()
+	var problems []string
+	for _, id := range sortedKeys(h.sensors) {
+		if problem := h.sensors[id].problem; problem != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", id, problem))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	validW1Slave = "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	// Power-on value
+	resetW1Slave = "50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n"
+)
+
+func TestParseW1Slave(t *testing.T) {
+	cases := []struct {
+		Content  string
+		Expected float64
+		CRC      bool
+		Error    bool
+	}{
+		{Content: validW1Slave, Expected: 23.125},
+		{Content: resetW1Slave, Expected: 85},
+		{Content: "72 01 4b 46 7f ff 0e 10 57 : crc=57 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n", CRC: true, Error: true},
+		{Content: "73 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n73 01 4b 46 7f ff 0e 10 57 t=23187\n", CRC: true, Error: true},
+		{Content: "ff ff ff ff ff ff ff ff ff : crc=c9 YES\nff ff ff ff ff ff ff ff ff t=-62\n", CRC: true, Error: true},
+		{Content: "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n", Error: true},
+		{Content: "", Error: true},
+	}
+	for _, testCase := range cases {
+		value, err := parseW1Slave(testCase.Content)
+		if (err != nil) != testCase.Error || (err == ErrSensorCRC) != testCase.CRC || value != testCase.Expected {
+			t.Fatalf("Expected %g (error %t, CRC %t) for %q, got %g (%v)\n", testCase.Expected, testCase.Error, testCase.CRC, testCase.Content, value, err)
+		}
+	}
+}
+
+// writeSensor writes a file of a sensor in the fake 1-Wire root
+func writeSensor(t *testing.T, root string, id string, file string, content string) {
+	if err := os.MkdirAll(filepath.Join(root, id), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, id, file), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSensors(t *testing.T) {
+	root, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeSensor(t, root, "28-000005e2fdc3", W1SlaveFilename, validW1Slave)
+	writeSensor(t, root, "28-0316a2794aff", W1TemperatureFilename, "-1250\n")
+	// Not a temperature sensor
+	writeSensor(t, root, "w1_bus_master1", W1SlaveFilename, "")
+
+	c := DefaultConfiguration()
+	c.W1Root = root
+	c.SensorDeadband = 0.5
+	c.Topics = map[string]string{"28-000005e2fdc3": "living/temperature"}
+	client := newFakeClient()
+	h := &Handler{config: c, brokers: []*broker{{name: "fake", client: client}}}
+
+	cases := []struct {
+		Name     string
+		Change   func()
+		Expected map[string]string
+		Problems string
+	}{
+		{
+			Name:     "initial",
+			Change:   func() {},
+			Expected: map[string]string{"living/temperature": "23.125", "28-0316a2794aff": "-1.25"},
+		},
+		{
+			Name:   "within deadband",
+			Change: func() { writeSensor(t, root, "28-0316a2794aff", W1TemperatureFilename, "-1000\n") },
+		},
+		{
+			Name:     "beyond deadband",
+			Change:   func() { writeSensor(t, root, "28-0316a2794aff", W1TemperatureFilename, "-500\n") },
+			Expected: map[string]string{"28-0316a2794aff": "-0.5"},
+		},
+		{
+			Name: "CRC error and disappeared",
+			Change: func() {
+				writeSensor(t, root, "28-000005e2fdc3", W1SlaveFilename, "72 01 4b 46 7f ff 0e 10 57 : crc=57 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n")
+				os.RemoveAll(filepath.Join(root, "28-0316a2794aff"))
+			},
+			Problems: "28-000005e2fdc3: CRC check failed, 28-0316a2794aff: missing",
+		},
+		{
+			Name: "power-on value",
+			Change: func() {
+				writeSensor(t, root, "28-000005e2fdc3", W1SlaveFilename, resetW1Slave)
+				writeSensor(t, root, "28-0316a2794aff", W1TemperatureFilename, "85000\n")
+			},
+			Problems: "28-000005e2fdc3: power-on value, no temperature converted, 28-0316a2794aff: power-on value, no temperature converted",
+		},
+		{
+			Name: "recovered",
+			Change: func() {
+				writeSensor(t, root, "28-000005e2fdc3", W1SlaveFilename, validW1Slave)
+				writeSensor(t, root, "28-0316a2794aff", W1TemperatureFilename, "-1500\n")
+			},
+			Expected: map[string]string{"28-0316a2794aff": "-1.5"},
+		},
+		{
+			Name:     "heated up to 85 degrees",
+			Change:   func() { writeSensor(t, root, "28-0316a2794aff", W1TemperatureFilename, "80000\n") },
+			Expected: map[string]string{"28-0316a2794aff": "80"},
+		},
+		{
+			Name:     "at 85 degrees",
+			Change:   func() { writeSensor(t, root, "28-0316a2794aff", W1TemperatureFilename, "85000\n") },
+			Expected: map[string]string{"28-0316a2794aff": "85"},
+		},
+		{
+			Name:     "jumped to 85 degrees twice in a row",
+			Change:   func() { writeSensor(t, root, "28-000005e2fdc3", W1SlaveFilename, resetW1Slave) },
+			Problems: "28-000005e2fdc3: power-on value, no temperature converted",
+		},
+		{
+			Name:     "still at 85 degrees",
+			Change:   func() {},
+			Expected: map[string]string{"living/temperature": "85"},
+		},
+	}
+	for _, testCase := range cases {
+		client.published = nil
+		testCase.Change()
+		h.updateSensors(&c)
+		if len(client.published) != len(testCase.Expected) {
+			t.Fatalf("Expected %d temperatures published when %s, got %v\n", len(testCase.Expected), testCase.Name, client.published)
+		}
+		for _, m := range client.published {
+			if testCase.Expected[m.topic] != string(m.payload) {
+				t.Fatalf("Expected %s on %s when %s, got %s\n", testCase.Expected[m.topic], m.topic, testCase.Name, m.payload)
+			}
+		}
+		err := h.checkSensors()
+		if (err == nil && testCase.Problems != "") || (err != nil && err.Error() != testCase.Problems) {
+			t.Fatalf("Expected problems %q when %s, got %v\n", testCase.Problems, testCase.Name, err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package unipitt
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EnvPrefix is prepended to the upper-cased option names to find the corresponding environment variables
+	EnvPrefix = "UNIPITT_"
+	// EnvConfigFile is the environment variable holding the config file name
+	EnvConfigFile = EnvPrefix + "CONFIG"
+	// DefaultBroker is the default MQTT broker URI
+	DefaultBroker = "ssl://raspberrypi.lan:8883"
+	// DefaultClientID is the default MQTT client ID
+	DefaultClientID = "unipitt"
+	// DefaultPollingInterval is the default polling interval per digital input in millis
+	DefaultPollingInterval = 50
+	// DefaultPayload is the default MQTT message payload
+	DefaultPayload = "trigger"
+	// DefaultMQTTVersion is the default MQTT protocol version, 3.1.1
+	DefaultMQTTVersion = 4
+)
+
+// Option is a setting which can be given as flag, as environment variable or in the config file. The name is used for the flag and the environment variable (upper-cased, prefixed with EnvPrefix).
+type Option struct {
+	Name  string
+	Usage string
+	// Bool marks options which can be given as flag without value
+	Bool bool
+	// Set parses the value and sets it on the configuration
+	Set func(c *Configuration, value string) error
+	// Get formats the current value from the configuration
+	Get func(c *Configuration) string
+}
+
+// Env returns the environment variable name for the option
+func (o Option) Env() string {
+	return EnvPrefix + strings.ToUpper(o.Name)
+}
+
+// stringOption creates an option for a string field
+func stringOption(name string, usage string, field func(c *Configuration) *string) Option {
+	return Option{
+		Name:  name,
+		Usage: usage,
+		Set: func(c *Configuration, value string) error {
+			*field(c) = value
+			return nil
+		},
+		Get: func(c *Configuration) string {
+			return *field(c)
+		},
+	}
+}
+
+// intOption creates an option for an integer field
+func intOption(name string, usage string, field func(c *Configuration) *int) Option {
+	return Option{
+		Name:  name,
+		Usage: usage,
+		Set: func(c *Configuration, value string) error {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for %s: %s", value, name, err)
+			}
+			*field(c) = i
+			return nil
+		},
+		Get: func(c *Configuration) string {
+			return strconv.Itoa(*field(c))
+		},
+	}
+}
+
+// floatOption creates an option for a floating point field
+func floatOption(name string, usage string, field func(c *Configuration) *float64) Option {
+	return Option{
+		Name:  name,
+		Usage: usage,
+		Set: func(c *Configuration, value string) error {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for %s: %s", value, name, err)
+			}
+			*field(c) = f
+			return nil
+		},
+		Get: func(c *Configuration) string {
+			return strconv.FormatFloat(*field(c), 'g', -1, 64)
+		},
+	}
+}
+
+// boolOption creates an option for a boolean field
+func boolOption(name string, usage string, field func(c *Configuration) *bool) Option {
+	return Option{
+		Name:  name,
+		Usage: usage,
+		Bool:  true,
+		Set: func(c *Configuration, value string) error {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for %s: %s", value, name, err)
+			}
+			*field(c) = b
+			return nil
+		},
+		Get: func(c *Configuration) string {
+			return strconv.FormatBool(*field(c))
+		},
+	}
+}
+
+// Options lists all settings which can be given as flag, environment variable or in the config file
+var Options = []Option{
+	{
+		Name:  "broker",
+		Usage: "MQTT broker URI, replaces the brokers list of the config file",
+		Set: func(c *Configuration, value string) error {
+			c.Broker = value
+			c.Brokers = nil
+			return nil
+		},
+		Get: func(c *Configuration) string {
+			return c.Broker
+		},
+	},
+	stringOption("broker_mode", "With multiple brokers: failover to publish on the first connected one, mirror to publish on all", func(c *Configuration) *string { return &c.BrokerMode }),
+	stringOption("client_id", "MQTT host client ID", func(c *Configuration) *string { return &c.ClientID }),
+	stringOption("cafile", "CA certificate used for MQTT TLS setup", func(c *Configuration) *string { return &c.CAFile }),
+	stringOption("certfile", "Client certificate used for MQTT mutual TLS", func(c *Configuration) *string { return &c.CertFile }),
+	stringOption("keyfile", "Client key used for MQTT mutual TLS, optionally PKCS#8 encrypted (legacy PEM encryption is deprecated)", func(c *Configuration) *string { return &c.KeyFile }),
+	stringOption("key_password", "Password to decrypt the client key", func(c *Configuration) *string { return &c.KeyPassword }),
+	stringOption("key_password_file", "File to read the password to decrypt the client key from", func(c *Configuration) *string { return &c.KeyPasswordFile }),
+	stringOption("server_name", "Server name to verify the MQTT broker certificate against, instead of the broker host", func(c *Configuration) *string { return &c.ServerName }),
+	boolOption("insecure_skip_verify", "Skip verification of the MQTT broker certificate, only for testing", func(c *Configuration) *bool { return &c.InsecureSkipVerify }),
+	stringOption("username", "MQTT username", func(c *Configuration) *string { return &c.Username }),
+	stringOption("password", "MQTT password, prefer password_file or the environment to keep it off the command line", func(c *Configuration) *string { return &c.Password }),
+	stringOption("password_file", "File to read the MQTT password from", func(c *Configuration) *string { return &c.PasswordFile }),
+	intOption("mqtt_version", "MQTT protocol version: 3 (3.1), 4 (3.1.1) or 5", func(c *Configuration) *int { return &c.MQTTVersion }),
+	intOption("message_expiry", "MQTT 5 message expiry interval in seconds for published triggers (disabled when 0)", func(c *Configuration) *int { return &c.MessageExpiry }),
+	stringOption("board_serial", "Board serial number, sent along as MQTT 5 user property (omitted when empty)", func(c *Configuration) *string { return &c.BoardSerial }),
+	stringOption("topic_prefix", "Prefix for the topics of all names without mapped topic, e.g. unipitt/{board}", func(c *Configuration) *string { return &c.TopicPrefix }),
+	stringOption("board_id", "Board ID filled in for {board} in the topic and command prefixes, the default alias of the boards", func(c *Configuration) *string { return &c.BoardID }),
+	stringOption("command_prefix", "Prefix to receive all output commands on with a single wildcard subscription, as <prefix>/<name or mapped topic>/set (one subscription per output when empty)", func(c *Configuration) *string { return &c.CommandPrefix }),
+	stringOption("config_prefix", "Prefix to change the input settings on at runtime, as <prefix>/<name>/<setting>/set (disabled when empty)", func(c *Configuration) *string { return &c.ConfigPrefix }),
+	{
+		Name:  "sysfs_root",
+		Usage: "Root folder to search for digital inputs, replaces the boards list of the config file",
+		Set: func(c *Configuration, value string) error {
+			c.SysFsRoot = value
+			c.Boards = nil
+			return nil
+		},
+		Get: func(c *Configuration) string {
+			return c.SysFsRoot
+		},
+	},
+	boolOption("simulate", "Run against a simulated board instead of the hardware, replacing the boards", func(c *Configuration) *bool { return &c.Simulate }),
+	stringOption("scenario", "Scenario file with the input changes to play on the simulated board", func(c *Configuration) *string { return &c.Simulator.Scenario }),
+	stringOption("simulator_address", "Address to serve the control API of the simulated board on, e.g. :8081 (disabled when empty)", func(c *Configuration) *string { return &c.Simulator.Address }),
+	stringOption("bindings_topic", "Topic to publish the table of direct switching bindings in effect on, as JSON (disabled when empty)", func(c *Configuration) *string { return &c.BindingsTopic }),
+	intOption("counter_interval", "Interval in seconds to publish the totals and rates of the counters at", func(c *Configuration) *int { return &c.CounterInterval }),
+	stringOption("counter_state", "File to keep the totals of the counters in across restarts", func(c *Configuration) *string { return &c.CounterState }),
+	stringOption("w1_root", "Folder with the 1-Wire devices to read the DS18B20 temperature sensors from, "+SysW1Root+" with the w1 kernel driver (disabled when empty)", func(c *Configuration) *string { return &c.W1Root }),
+	intOption("sensor_interval", "Interval in seconds to read the temperature sensors at", func(c *Configuration) *int { return &c.SensorInterval }),
+	floatOption("sensor_deadband", "Minimal change in degrees to publish a temperature again (any change when 0)", func(c *Configuration) *float64 { return &c.SensorDeadband }),
+	stringOption("record", "Trace file to append the input triggers, output commands and broker connection events to (disabled when empty)", func(c *Configuration) *string { return &c.Record }),
+	stringOption("replay", "Trace file to replay on the simulated board or a fake sys fs, exiting when done", func(c *Configuration) *string { return &c.Replay }),
+	intOption("replay_speed", "Speed-up factor to replay the trace with, 1 for real time (0 for no waiting between the entries)", func(c *Configuration) *int { return &c.ReplaySpeed }),
+	intOption("polling_interval", "Polling interval per digital input in millis", func(c *Configuration) *int { return &c.PollingInterval }),
+	stringOption("payload", "Default MQTT message payload", func(c *Configuration) *string { return &c.Payload }),
+	stringOption("modbus_address", "Address to serve the digital inputs and outputs over Modbus TCP on, e.g. :502 (disabled when empty)", func(c *Configuration) *string { return &c.ModbusAddress }),
+	stringOption("health_address", "Address to serve the HTTP liveness and readiness checks on, e.g. :8080 (disabled when empty)", func(c *Configuration) *string { return &c.HealthAddress }),
+	intOption("config_watch_interval", "Interval in seconds to check the config file for changes and reload it (disabled when 0)", func(c *Configuration) *int { return &c.ConfigWatchInterval }),
+	stringOption("log_level", "Default log level: debug, info, warn or error", func(c *Configuration) *string { return &c.Logging.Level }),
+	stringOption("log_format", "Log format: logfmt or json", func(c *Configuration) *string { return &c.Logging.Format }),
+	{
+		Name:  "log_levels",
+		Usage: "Per-subsystem log levels, e.g. poller=warn,mqtt=debug, for the subsystems poller, mqtt, outputs, config, health, modbus, counter, sensor and trace",
+		Set: func(c *Configuration, value string) error {
+			levels, err := ParseLevels(value)
+			if err != nil {
+				return err
+			}
+			if c.Logging.Levels == nil {
+				c.Logging.Levels = make(map[string]string)
+			}
+			for subsystem, level := range levels {
+				c.Logging.Levels[subsystem] = level
+			}
+			return nil
+		},
+		Get: func(c *Configuration) string {
+			pairs := make([]string, 0, len(c.Logging.Levels))
+			for subsystem, level := range c.Logging.Levels {
+				pairs = append(pairs, subsystem+"="+level)
+			}
+			sort.Strings(pairs)
+			return strings.Join(pairs, ",")
+		},
+	},
+}
+
+// DefaultConfiguration returns the configuration used when nothing else is given
+func DefaultConfiguration() Configuration {
+	return Configuration{
+		Broker:          DefaultBroker,
+		BrokerMode:      BrokerModeFailover,
+		ClientID:        DefaultClientID,
+		SysFsRoot:       SysFsRoot,
+		PollingInterval: DefaultPollingInterval,
+		Payload:         DefaultPayload,
+		MQTTVersion:     DefaultMQTTVersion,
+		CounterInterval: DefaultCounterInterval,
+		CounterState:    DefaultCounterState,
+		SensorInterval:  DefaultSensorInterval,
+		ReplaySpeed:     DefaultReplaySpeed,
+		Logging:         LoggingConfiguration{Level: LevelInfo.String(), Format: LogFormatLogfmt},
+	}
+}
+
+// LoadConfiguration resolves the configuration from, in increasing order of precedence: the defaults, the config file (if any), the environment variables and the given overrides (e.g. from flags), keyed by option name
+func LoadConfiguration(configFile string, overrides map[string]string) (c Configuration, err error) {
+	c = DefaultConfiguration()
+	if configFile != "" {
+		configLog.Info("Reading configuration file", "file", configFile)
+		if c, err = configFromFile(configFile); err != nil {
+			return
+		}
+	}
+	for _, option := range Options {
+		if value, ok := os.LookupEnv(option.Env()); ok {
+			if err = option.Set(&c, value); err != nil {
+				return c, fmt.Errorf("environment variable %s: %s", option.Env(), err)
+			}
+		}
+	}
+	for _, option := range Options {
+		if value, ok := overrides[option.Name]; ok {
+			if err = option.Set(&c, value); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,108 @@
+package unipitt
+
+import (
+	"os"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestOptionEnv(t *testing.T) {
+	o := Option{Name: "client_id"}
+	if o.Env() != "UNIPITT_CLIENT_ID" {
+		t.Fatalf("Expected environment variable %s, got %s\n", "UNIPITT_CLIENT_ID", o.Env())
+	}
+}
+
+func TestOptionsRoundTrip(t *testing.T) {
+	c := DefaultConfiguration()
+	values := map[string]string{
+		"broker":           "tcp://foo:1883",
+		"polling_interval": "100",
+		"log_levels":       "mqtt=debug,poller=warn",
+	}
+	for _, option := range Options {
+		value, ok := values[option.Name]
+		if !ok {
+			continue
+		}
+		if err := option.Set(&c, value); err != nil {
+			t.Fatal(err)
+		}
+		if option.Get(&c) != value {
+			t.Fatalf("Expected option %s to be %s, got %s\n", option.Name, value, option.Get(&c))
+		}
+	}
+}
+
+func TestLoadConfigurationDefaults(t *testing.T) {
+	c, err := LoadConfiguration("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Broker != DefaultBroker || c.PollingInterval != DefaultPollingInterval || c.SysFsRoot != SysFsRoot {
+		t.Fatalf("Expected the default configuration, got %v\n", c)
+	}
+}
+
+func TestLoadConfigurationPrecedence(t *testing.T) {
+	configFile := writeConfig(t, `
+broker: tcp://file:1883
+client_id: file
+polling_interval: 100
+payload: file
+`)
+	defer os.Remove(configFile)
+
+	os.Setenv("UNIPITT_CLIENT_ID", "env")
+	os.Setenv("UNIPITT_POLLING_INTERVAL", "200")
+	defer os.Unsetenv("UNIPITT_CLIENT_ID")
+	defer os.Unsetenv("UNIPITT_POLLING_INTERVAL")
+
+	c, err := LoadConfiguration(configFile, map[string]string{"polling_interval": "300"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		Option   string
+		Expected string
+	}{
+		{Option: "cafile", Expected: ""},
+		{Option: "sysfs_root", Expected: SysFsRoot},
+		{Option: "broker", Expected: "tcp://file:1883"},
+		{Option: "payload", Expected: "file"},
+		{Option: "client_id", Expected: "env"},
+		{Option: "polling_interval", Expected: "300"},
+	}
+	for _, testCase := range cases {
+		for _, option := range Options {
+			if option.Name == testCase.Option && option.Get(&c) != testCase.Expected {
+				t.Fatalf("Expected %s to be %s, got %s\n", testCase.Option, testCase.Expected, option.Get(&c))
+			}
+		}
+	}
+}
+
+func TestLoadConfigurationInvalidEnv(t *testing.T) {
+	os.Setenv("UNIPITT_POLLING_INTERVAL", "foo")
+	defer os.Unsetenv("UNIPITT_POLLING_INTERVAL")
+	if _, err := LoadConfiguration("", nil); err == nil {
+		t.Fatal("Expected an error for an invalid environment variable, got none")
+	}
+}
+
+func TestConfigurationDump(t *testing.T) {
+	c := DefaultConfiguration()
+	c.Topics = map[string]string{"di_1_01": "kitchen switch"}
+	out, err := c.Dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result Configuration
+	if err := yaml.UnmarshalStrict(out, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Broker != c.Broker || result.Topic("di_1_01") != "kitchen switch" {
+		t.Fatalf("Expected the dumped configuration to read back, got %v\n", result)
+	}
+}
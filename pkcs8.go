@@ -0,0 +1,141 @@
+package unipitt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PBKDF2MaxIterations bounds the iteration count of an encrypted key, so a bad key file cannot hang startup
+const PBKDF2MaxIterations = 1000000
+
+// The object identifiers of the PKCS#5 v2 algorithms supported for encrypted keys
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// ErrKeyPassword is returned for an encrypted key which does not decrypt with the password given
+var ErrKeyPassword = errors.New("wrong key password")
+
+// encryptedPrivateKeyInfo is the ASN.1 structure of a PKCS#8 encrypted private key
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params are the parameters of the PBES2 encryption scheme of PKCS#5 v2
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are the parameters of the PBKDF2 key derivation, the PRF defaulting to HMAC-SHA1
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// pbes2Cipher sets up the block cipher of the encryption scheme, with the key derived from the password
+func pbes2Cipher(params pbes2Params, password []byte) (block cipher.Block, iv []byte, err error) {
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("unsupported key derivation %s, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, nil, fmt.Errorf("invalid PBKDF2 parameters: %s", err)
+	}
+	h := sha1.New
+	switch {
+	case kdf.PRF.Algorithm == nil || kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		h = sha256.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported PBKDF2 PRF %s, only HMAC-SHA1 and HMAC-SHA256 are supported", kdf.PRF.Algorithm)
+	}
+	if kdf.IterationCount < 1 || kdf.IterationCount > PBKDF2MaxIterations {
+		return nil, nil, fmt.Errorf("PBKDF2 iteration count %d is not between 1 and %d", kdf.IterationCount, PBKDF2MaxIterations)
+	}
+	if _, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, fmt.Errorf("invalid IV: %s", err)
+	}
+	scheme := params.EncryptionScheme.Algorithm
+	newCipher, length := aes.NewCipher, 0
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		length = 16
+	case scheme.Equal(oidAES192CBC):
+		length = 24
+	case scheme.Equal(oidAES256CBC):
+		length = 32
+	case scheme.Equal(oidDESEDE3CBC):
+		newCipher, length = des.NewTripleDESCipher, 24
+	default:
+		return nil, nil, fmt.Errorf("unsupported cipher %s, only AES-CBC and DES-EDE3-CBC are supported", scheme)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != length {
+		return nil, nil, fmt.Errorf("PBKDF2 key length %d does not match the %d bytes of cipher %s", kdf.KeyLength, length, scheme)
+	}
+	block, err = newCipher(pbkdf2.Key(password, kdf.Salt, kdf.IterationCount, length, h))
+	if err == nil && len(iv) != block.BlockSize() {
+		err = fmt.Errorf("IV of %d bytes for a block size of %d", len(iv), block.BlockSize())
+	}
+	return
+}
+
+// decryptPKCS8 decrypts a PKCS#8 encrypted private key with the password, returning the unencrypted PKCS#8 key. Only PBES2 is supported, as used by openssl by default.
+func decryptPKCS8(der []byte, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("invalid PKCS#8 encrypted key: %s", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported encryption %s, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("invalid PBES2 parameters: %s", err)
+	}
+	block, iv, err := pbes2Cipher(params, password)
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("encrypted key of %d bytes is not a multiple of the block size", len(data))
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	// A wrong password shows as bad padding, or otherwise as garbage
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, ErrKeyPassword
+	}
+	for _, b := range plain[len(plain)-padding:] {
+		if int(b) != padding {
+			return nil, ErrKeyPassword
+		}
+	}
+	plain = plain[:len(plain)-padding]
+	if _, err := x509.ParsePKCS8PrivateKey(plain); err != nil {
+		return nil, ErrKeyPassword
+	}
+	return plain, nil
+}
@@ -0,0 +1,203 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// PwmDutyFilename holds the duty cycle of a digital output in percent, next to the do_value file; the output is switched as usual at 0
+	PwmDutyFilename = "pwm_duty"
+	// PwmFrequencyFilename holds the PWM frequency in Hz of a digital output, from which the driver sets the prescale
+	PwmFrequencyFilename = "pwm_freq"
+	// PwmDutySuffix is appended to the (command) topic of an output to receive its duty cycle on
+	PwmDutySuffix = "/duty"
+	// PwmStateSuffix is appended to the topic of an output to publish its PWM state on
+	PwmStateSuffix = "/pwm"
+)
+
+// PwmConfiguration sets up a digital output for PWM
+type PwmConfiguration struct {
+	// Frequency is the PWM frequency in Hz, left as is when 0
+	Frequency int `yaml:"frequency"`
+}
+
+// PwmState is the PWM state of an output, as published
+type PwmState struct {
+	Duty      float64 `json:"duty"`
+	Frequency int     `json:"frequency"`
+}
+
+// pwmOutput is implemented by the digital outputs which can do PWM
+type pwmOutput interface {
+	SetDuty(duty float64) error
+	SetFrequency(frequency int) error
+	Pwm() (PwmState, error)
+}
+
+// SetDuty sets the duty cycle in percent
+func (d *DigitalOutputWriter) SetDuty(duty float64) error {
+	err := ioutil.WriteFile(path.Join(d.Path, PwmDutyFilename), []byte(strconv.FormatFloat(duty, 'f', -1, 64)+"\n"), 0644)
+	if err == nil {
+		outputsLog.Info("Updated duty cycle of digital output", "name", d.Name, "duty", duty)
+	}
+	return err
+}
+
+// SetFrequency sets the PWM frequency in Hz, unless it has it already
+func (d *DigitalOutputWriter) SetFrequency(frequency int) error {
+	previous, err := applyFile(d.Path, PwmFrequencyFilename, strconv.Itoa(frequency))
+	if err == nil && previous != strconv.Itoa(frequency) {
+		outputsLog.Info("Updated PWM frequency of digital output", "name", d.Name, "frequency", frequency, "previous", previous)
+	}
+	return err
+}
+
+// Pwm reads back the duty cycle and frequency
+func (d *DigitalOutputWriter) Pwm() (state PwmState, err error) {
+	duty, err := readSetting(d.Path, PwmDutyFilename)
+	if err != nil {
+		return
+	}
+	if state.Duty, err = strconv.ParseFloat(duty, 64); err != nil {
+		return
+	}
+	frequency, err := readSetting(d.Path, PwmFrequencyFilename)
+	if err != nil {
+		return
+	}
+	state.Frequency, err = strconv.Atoi(frequency)
+	return
+}
+
+// clearDuty stops PWM on the output if running, so it is switched as a plain output again
+func (d *DigitalOutputWriter) clearDuty() error {
+	duty, err := readSetting(d.Path, PwmDutyFilename)
+	if err != nil || duty == "" || duty == "0" {
+		// Outputs without PWM support have no duty cycle to clear
+		return nil
+	}
+	return d.SetDuty(0)
+}
+
+// ParseDuty parses a duty cycle command, in percent
+func ParseDuty(payload []byte) (float64, error) {
+	duty, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	if err != nil || duty < 0 || duty > 100 {
+		return 0, fmt.Errorf("invalid duty cycle %q, should be 0 to 100", payload)
+	}
+	return duty, nil
+}
+
+// pwmProblems checks the PWM frequencies
+func (c *Configuration) pwmProblems() (problems []Problem) {
+	for _, name := range sortedKeys(c.Pwm) {
+		if frequency := c.Pwm[name].Frequency; frequency < 0 {
+			problems = append(problems, Problem{Key: name, Section: "pwm", Message: fmt.Sprintf("PWM output %s: frequency %d should not be negative", name, frequency)})
+		}
+	}
+	return
+}
+
+// dutyName finds the PWM output for a duty cycle topic: <command prefix>/<name or mapped topic>/duty/set with a command prefix, otherwise <name or mapped topic>/duty
+func (c *Configuration) dutyName(topic string) (name string, ok bool) {
+	if len(c.commandPrefixes()) > 0 {
+		if path, ok := c.commandPath(topic, PwmDutySuffix+CommandSuffix); ok {
+			name = c.Name(path)
+		}
+	} else if strings.HasSuffix(topic, PwmDutySuffix) {
+		name = c.Name(strings.TrimSuffix(topic, PwmDutySuffix))
+	}
+	_, ok = c.Pwm[name]
+	return
+}
+
+// dutySubscriptions lists the topics to subscribe to for the duty cycles of the PWM outputs, given a configuration; none without PWM outputs, nor with a command prefix, as the command filters take them
+func (c *Configuration) dutySubscriptions() map[string]bool {
+	topics := make(map[string]bool)
+	if len(c.Pwm) == 0 || len(c.commandPrefixes()) > 0 {
+		return topics
+	}
+	for _, name := range sortedKeys(c.Pwm) {
+		topics[c.prefixed(name)+PwmDutySuffix] = true
+		topics[c.Topic(name)+PwmDutySuffix] = true
+	}
+	return topics
+}
+
+// setupPwm sets the configured PWM frequencies
+func (h *Handler) setupPwm(c *Configuration) {
+	for _, name := range sortedKeys(c.Pwm) {
+		output, ok := h.writerMap[name].(pwmOutput)
+		if !ok {
+			outputsLog.Error("Error setting up PWM", "name", name, "err", fmt.Sprintf("no sys fs digital output %s", name))
+			continue
+		}
+		if frequency := c.Pwm[name].Frequency; frequency > 0 {
+			if err := output.SetFrequency(frequency); err != nil {
+				outputsLog.Error("Error setting PWM frequency", "name", name, "frequency", frequency, "err", err)
+			}
+		}
+	}
+}
+
+// duty sets the duty cycle of a PWM output as received on the topic, recording it when tracing, and publishes the state it got
+func (h *Handler) duty(name string, topic string, payload []byte) {
+	var message string
+	defer func() {
+		h.record(TraceEntry{Kind: TraceOutput, Name: name, Topic: topic, Payload: string(payload), Error: message})
+	}()
+	output, ok := h.writerMap[name].(pwmOutput)
+	if !ok {
+		message = fmt.Sprintf("no sys fs digital output %s", name)
+		outputsLog.Warn("Error matching a PWM output for given topic", "topic", topic)
+		return
+	}
+	duty, err := ParseDuty(payload)
+	if err == nil {
+		err = output.SetDuty(duty)
+	}
+	if err != nil {
+		message = err.Error()
+		outputsLog.Warn("Error setting duty cycle", "name", name, "topic", topic, "err", err)
+		return
+	}
+	h.send(topic, func(client mqtt.Client) error {
+		return h.publishPwm(client, name)
+	})
+}
+
+// publishPwm publishes the PWM state of an output as JSON (retained) on its topic with PwmStateSuffix
+func (h *Handler) publishPwm(client mqtt.Client, name string) error {
+	output, ok := h.writerMap[name].(pwmOutput)
+	if !ok {
+		return nil
+	}
+	state, err := output.Pwm()
+	if err != nil {
+		outputsLog.Error("Error reading back PWM state", "name", name, "err", err)
+		return nil
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	token := client.Publish(h.configuration().Topic(name)+PwmStateSuffix, 0, true, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// publishPwmStates publishes the PWM states of all PWM outputs on the client, e.g. on connect
+func (h *Handler) publishPwmStates(client mqtt.Client) {
+	for _, name := range sortedKeys(h.configuration().Pwm) {
+		if err := h.publishPwm(client, name); err != nil {
+			mqttLog.Error("Error publishing PWM state", "name", name, "err", err)
+		}
+	}
+}
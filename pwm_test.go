@@ -0,0 +1,113 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDuty(t *testing.T) {
+	cases := []struct {
+		Payload  string
+		Expected float64
+		Error    bool
+	}{
+		{Payload: "50", Expected: 50},
+		{Payload: " 37.5\n", Expected: 37.5},
+		{Payload: "0", Expected: 0},
+		{Payload: "100", Expected: 100},
+		{Payload: "101", Error: true},
+		{Payload: "-1", Error: true},
+		{Payload: "ON", Error: true},
+	}
+	for _, testCase := range cases {
+		duty, err := ParseDuty([]byte(testCase.Payload))
+		if (err != nil) != testCase.Error || duty != testCase.Expected {
+			t.Fatalf("Expected %g (error %t) for %q, got %g (%v)\n", testCase.Expected, testCase.Error, testCase.Payload, duty, err)
+		}
+	}
+}
+
+func TestDutyName(t *testing.T) {
+	cases := []struct {
+		CommandPrefix string
+		Topic         string
+		Name          string
+		OK            bool
+	}{
+		{Topic: "do_1_01/duty", Name: "do_1_01", OK: true},
+		{Topic: "living/strip/duty", Name: "do_1_02", OK: true},
+		{Topic: "do_1_03/duty"},
+		{Topic: "do_1_01"},
+		{CommandPrefix: "unipitt", Topic: "unipitt/living/strip/duty/set", Name: "do_1_02", OK: true},
+		{CommandPrefix: "unipitt", Topic: "unipitt/duty/set"},
+		{CommandPrefix: "unipitt", Topic: "unipitt/do_1_01/duty/set", Name: "do_1_01", OK: true},
+		{CommandPrefix: "unipitt", Topic: "do_1_01/duty"},
+	}
+	for _, testCase := range cases {
+		c := Configuration{
+			CommandPrefix: testCase.CommandPrefix,
+			Topics:        map[string]string{"do_1_02": "living/strip"},
+			Pwm:           map[string]PwmConfiguration{"do_1_01": {}, "do_1_02": {}},
+		}
+		name, ok := c.dutyName(testCase.Topic)
+		if ok != testCase.OK || (ok && name != testCase.Name) {
+			t.Fatalf("Expected %s (%t) for %s, got %s (%t)\n", testCase.Name, testCase.OK, testCase.Topic, name, ok)
+		}
+	}
+}
+
+func TestPwm(t *testing.T) {
+	root := makeBoard(t, "do_1_01")
+	defer os.RemoveAll(root)
+	folder := filepath.Join(root, "do_1_01")
+	for file, content := range map[string]string{DoFilename: DoFalseValue, PwmDutyFilename: "0\n", PwmFrequencyFilename: "100\n"} {
+		if err := ioutil.WriteFile(filepath.Join(folder, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, outputs, _, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfiguration()
+	c.Pwm = map[string]PwmConfiguration{"do_1_01": {Frequency: 200}}
+	client := newFakeClient()
+	h := &Handler{writerMap: outputs, config: c, brokers: []*broker{{name: "fake", client: client}}}
+	h.setupPwm(&c)
+	h.subscribe(client, h.subscriptions(&c))
+
+	cases := []struct {
+		Topic    string
+		Payload  string
+		Duty     string
+		Value    string
+		Expected string
+	}{
+		{Topic: "do_1_01/duty", Payload: "37.5", Duty: "37.5", Value: "0", Expected: `{"duty":37.5,"frequency":200}`},
+		{Topic: "do_1_01/duty", Payload: "150", Duty: "37.5", Value: "0"},
+		// Plain commands keep working, stopping PWM
+		{Topic: "do_1_01", Payload: MsgTrueValue, Duty: "0", Value: "1", Expected: `{"duty":0,"frequency":200}`},
+	}
+	for _, testCase := range cases {
+		client.published = nil
+		if !client.deliver(testCase.Topic, testCase.Payload) {
+			t.Fatalf("Expected a subscription for %s\n", testCase.Topic)
+		}
+		for file, expected := range map[string]string{PwmDutyFilename: testCase.Duty, DoFilename: testCase.Value} {
+			if value, err := readSetting(folder, file); err != nil || value != expected {
+				t.Fatalf("Expected %s to be %s after %q on %s, got %s (%v)\n", file, expected, testCase.Payload, testCase.Topic, value, err)
+			}
+		}
+		if testCase.Expected == "" {
+			if len(client.published) != 0 {
+				t.Fatalf("Expected nothing to be published after %q, got %v\n", testCase.Payload, client.published)
+			}
+			continue
+		}
+		if len(client.published) != 1 || client.published[0].topic != "do_1_01/pwm" || string(client.published[0].payload) != testCase.Expected {
+			t.Fatalf("Expected %s to be published after %q, got %v\n", testCase.Expected, testCase.Payload, client.published)
+		}
+	}
+}
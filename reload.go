@@ -0,0 +1,153 @@
+package unipitt
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+// Reload reads the configuration file again and swaps it in when valid. Only output topics which changed are (un)subscribed; the sys fs handles are left untouched. Reloads triggered at the same time (e.g. by SIGHUP and the config watch) are applied one after the other.
+func (h *Handler) Reload() error {
+	if h.configFile == "" {
+		return fmt.Errorf("no configuration file to reload")
+	}
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	configLog.Info("Reloading configuration file", "file", h.configFile)
+	c, err := LoadConfiguration(h.configFile, h.overrides)
+	if err != nil {
+		configLog.Error("Error reading config file, keeping the current one", "file", h.configFile, "err", err)
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		configLog.Error("Invalid configuration, keeping the current one", "file", h.configFile, "err", err)
+		return err
+	}
+
+	h.mu.Lock()
+	previous := h.config
+	h.config = c
+	h.mu.Unlock()
+
+	h.apply(&previous, &c)
+	configLog.Info("Reloaded configuration file", "file", h.configFile)
+	return nil
+}
+
+// reloadable lists the options which are applied on reload, all others require a restart
+var reloadable = map[string]bool{
+	"broker_mode":     true,
+	"command_prefix":  true,
+	"config_prefix":   true,
+	"topic_prefix":    true,
+	"board_id":        true,
+	"log_level":       true,
+	"log_format":      true,
+	"log_levels":      true,
+	"sensor_deadband": true,
+}
+
+// apply brings the running handler in line with a new configuration
+func (h *Handler) apply(previous *Configuration, c *Configuration) {
+	for _, option := range Options {
+		if !reloadable[option.Name] && option.Get(previous) != option.Get(c) {
+			configLog.Warn("Changed setting requires a restart to take effect", "option", option.Name)
+		}
+	}
+	if !reflect.DeepEqual(previous.Brokers, c.Brokers) {
+		configLog.Warn("Changed setting requires a restart to take effect", "option", "brokers")
+	}
+	if !reflect.DeepEqual(previous.Boards, c.Boards) {
+		configLog.Warn("Changed setting requires a restart to take effect", "option", "boards")
+	}
+	if !reflect.DeepEqual(previous.StatusLeds, c.StatusLeds) {
+		configLog.Warn("Changed setting requires a restart to take effect", "option", "status_leds")
+	}
+	if !reflect.DeepEqual(previous.ModbusAddresses, c.ModbusAddresses) {
+		configLog.Warn("Changed setting requires a restart to take effect", "option", "modbus_addresses")
+	}
+	if !reflect.DeepEqual(previous.Counters, c.Counters) {
+		configLog.Warn("Changed setting requires a restart to take effect", "option", "counters")
+	}
+	if !reflect.DeepEqual(previous.Simulator.Groups, c.Simulator.Groups) {
+		configLog.Warn("Changed setting requires a restart to take effect", "option", "simulator")
+	}
+	if err := ConfigureLogging(c.Logging); err != nil {
+		configLog.Error("Error applying logging configuration", "err", err)
+	}
+	if !reflect.DeepEqual(previous.Inputs, c.Inputs) {
+		h.setupInputSettings(c)
+	}
+	if !reflect.DeepEqual(previous.Pwm, c.Pwm) {
+		h.setupPwm(c)
+	}
+	if !reflect.DeepEqual(previous.Bindings, c.Bindings) {
+		h.applyBindings(previous, c)
+		for _, b := range h.brokers {
+			if b.connected() {
+				h.publishBindings(b.client)
+			}
+		}
+	}
+
+	before, after := h.subscriptions(previous), h.subscriptions(c)
+	var removed []string
+	for _, topic := range sortedKeys(before) {
+		if !after[topic] {
+			removed = append(removed, topic)
+		}
+	}
+	added := make(map[string]bool)
+	for topic := range after {
+		if !before[topic] {
+			added[topic] = true
+		}
+	}
+	// Without a connection, the new subscriptions are made on (re)connect
+	for _, b := range h.brokers {
+		if !b.connected() {
+			continue
+		}
+		if len(removed) > 0 {
+			if token := b.client.Unsubscribe(removed...); token.Wait() && token.Error() != nil {
+				mqttLog.Error("Error unsubscribing", "broker", b.name, "topics", removed, "err", token.Error())
+			}
+		}
+		h.subscribe(b.client, added)
+		mqttLog.Info("Updated subscriptions", "broker", b.name, "removed", len(removed), "added", len(added))
+	}
+}
+
+// WatchConfig checks the configuration file for changes at the given interval and reloads it when modified (blocking)
+func (h *Handler) WatchConfig(done chan bool, interval time.Duration) {
+	if h.configFile == "" {
+		return
+	}
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(h.configFile); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(h.configFile)
+			if err != nil {
+				configLog.Warn("Error checking configuration file", "file", h.configFile, "err", err)
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			configLog.Info("Configuration file changed", "file", h.configFile)
+			h.Reload()
+		case <-done:
+			return
+		}
+	}
+}
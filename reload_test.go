@@ -0,0 +1,259 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeConfig writes the configuration contents to a temporary file
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestReloadNoConfigFile(t *testing.T) {
+	h := &Handler{}
+	if err := h.Reload(); err == nil {
+		t.Fatal("Expected an error reloading without a config file, got none")
+	}
+}
+
+func TestReload(t *testing.T) {
+	configFile := writeConfig(t, `
+topics:
+  do_2_01: kitchen light
+  do_2_02: living light
+`)
+	defer os.Remove(configFile)
+
+	client := newFakeClient()
+	h := &Handler{
+		configFile: configFile,
+		brokers:    []*broker{{name: "test", client: client}},
+		writerMap: map[string]DigitalOutput{
+			"do_2_01": &DigitalOutputWriter{Name: "do_2_01"},
+			"do_2_02": &DigitalOutputWriter{Name: "do_2_02"},
+		},
+		config: Configuration{Topics: map[string]string{
+			"do_2_01": "kitchen light",
+			"do_2_02": "hall light",
+		}},
+	}
+	h.subscribe(client, h.subscriptions(h.configuration()))
+
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if topic := h.configuration().Topic("do_2_02"); topic != "living light" {
+		t.Fatalf("Expected reloaded topic to be %s, got %s\n", "living light", topic)
+	}
+	expected := []string{"do_2_01", "do_2_02", "kitchen light", "living light"}
+	if len(client.subscriptions) != len(expected) {
+		t.Fatalf("Expected %d subscriptions, got %v\n", len(expected), client.subscriptions)
+	}
+	for _, topic := range expected {
+		if _, ok := client.subscriptions[topic]; !ok {
+			t.Fatalf("Expected a subscription on %s\n", topic)
+		}
+	}
+}
+
+func TestReloadConcurrent(t *testing.T) {
+	configFile := writeConfig(t, "topics:\n  do_2_01: kitchen light\n")
+	defer os.Remove(configFile)
+
+	client := newFakeClient()
+	h := &Handler{
+		configFile: configFile,
+		brokers:    []*broker{{name: "test", client: client}},
+		writerMap:  map[string]DigitalOutput{"do_2_01": &DigitalOutputWriter{Name: "do_2_01"}},
+		config:     Configuration{Topics: map[string]string{"do_2_01": "hall light"}},
+	}
+	h.subscribe(client, h.subscriptions(h.configuration()))
+
+	// As from SIGHUP and the config watch at the same time
+	var wg sync.WaitGroup
+	for k := 0; k < 2; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.Reload(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	expected := []string{"do_2_01", "kitchen light"}
+	if len(client.subscriptions) != len(expected) {
+		t.Fatalf("Expected %d subscriptions, got %v\n", len(expected), client.subscriptions)
+	}
+	for _, topic := range expected {
+		if _, ok := client.subscriptions[topic]; !ok {
+			t.Fatalf("Expected a subscription on %s\n", topic)
+		}
+	}
+}
+
+func TestReloadCommandPrefix(t *testing.T) {
+	configFile := writeConfig(t, `
+command_prefix: unipitt/board1
+topics:
+  do_2_01: kitchen light
+`)
+	defer os.Remove(configFile)
+	folder, err := ioutil.TempDir("", "do_2_01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	client := newFakeClient()
+	h := &Handler{
+		configFile: configFile,
+		brokers:    []*broker{{name: "test", client: client}},
+		writerMap:  map[string]DigitalOutput{"do_2_01": &DigitalOutputWriter{Name: "do_2_01", Path: folder}, "do_2_02": &DigitalOutputWriter{Name: "do_2_02"}},
+		config:     Configuration{Topics: map[string]string{"do_2_01": "kitchen light"}},
+	}
+	h.subscribe(client, h.subscriptions(h.configuration()))
+	if len(client.subscriptions) != 3 {
+		t.Fatalf("Expected 3 subscriptions, got %v\n", client.subscriptions)
+	}
+
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := client.subscriptions["unipitt/board1/#"]; !ok || len(client.subscriptions) != 1 {
+		t.Fatalf("Expected a single wildcard subscription, got %v\n", client.subscriptions)
+	}
+	if !client.deliver("unipitt/board1/kitchen light/set", "ON") {
+		t.Fatal("Expected the command to be routed through the wildcard subscription")
+	}
+	if value, err := ioutil.ReadFile(filepath.Join(folder, DoFilename)); err != nil || string(value) != DoTrueValue {
+		t.Fatalf("Expected the digital output to be updated, got %q (%v)\n", value, err)
+	}
+}
+
+func TestReloadBindings(t *testing.T) {
+	root := makeBoard(t, "di_1_01", "di_1_02", "do_1_01", "do_1_02")
+	defer os.RemoveAll(root)
+	for _, name := range []string{"di_1_01", "di_1_02"} {
+		for file, content := range map[string]string{DiFilename: "0", DirectSwitchEnableFilename: "0\n", DirectSwitchToggleFilename: "0\n", DirectSwitchPolarityFilename: "0\n"} {
+			if err := ioutil.WriteFile(filepath.Join(root, name, file), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	configFile := writeConfig(t, `
+bindings:
+  - {input: di_1_01, output: do_1_01}
+`)
+	defer os.Remove(configFile)
+	inputs, outputs, backends, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfiguration()
+	c.Bindings = []Binding{{Input: "di_1_01", Output: "do_1_01"}, {Input: "di_1_02", Output: "do_1_02"}}
+	h := &Handler{configFile: configFile, inputs: inputs, writerMap: outputs, backends: backends, config: c}
+	defer h.Close()
+	h.applyBindings(nil, &c)
+
+	// The binding removed from the configuration no longer switches the output
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"di_1_01": "1", "di_1_02": "0"} {
+		if enabled, err := readSetting(filepath.Join(root, name), DirectSwitchEnableFilename); err != nil || enabled != expected {
+			t.Fatalf("Expected the binding of %s to be enabled %s, got %s (%v)\n", name, expected, enabled, err)
+		}
+	}
+}
+
+func TestReloadBindingsRemoved(t *testing.T) {
+	root := makeBoard(t, "di_1_01", "di_1_02", "do_1_01", "do_1_02")
+	defer os.RemoveAll(root)
+	for _, name := range []string{"di_1_01", "di_1_02"} {
+		for file, content := range map[string]string{DiFilename: "0", DirectSwitchEnableFilename: "1\n"} {
+			if err := ioutil.WriteFile(filepath.Join(root, name, file), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	configFile := writeConfig(t, "polling_interval: 50\n")
+	defer os.Remove(configFile)
+	inputs, outputs, backends, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfiguration()
+	c.Bindings = []Binding{{Input: "di_1_01", Output: "do_1_01"}}
+	h := &Handler{configFile: configFile, inputs: inputs, writerMap: outputs, backends: backends, config: c}
+	defer h.Close()
+
+	// The binding programmed before is disabled, the one set by hand is left
+	if err := h.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"di_1_01": "0", "di_1_02": "1"} {
+		if enabled, err := readSetting(filepath.Join(root, name), DirectSwitchEnableFilename); err != nil || enabled != expected {
+			t.Fatalf("Expected the binding of %s to be enabled %s, got %s (%v)\n", name, expected, enabled, err)
+		}
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	configFile := writeConfig(t, `
+topics:
+  do_2_01: light
+  do_2_02: light
+`)
+	defer os.Remove(configFile)
+
+	h := &Handler{
+		configFile: configFile,
+		config:     Configuration{Topics: map[string]string{"do_2_01": "kitchen light"}},
+	}
+	if err := h.Reload(); err == nil {
+		t.Fatal("Expected an error reloading an invalid config file, got none")
+	}
+	if topic := h.configuration().Topic("do_2_01"); topic != "kitchen light" {
+		t.Fatalf("Expected the previous configuration to be kept, got topic %s\n", topic)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	configFile := writeConfig(t, "topics:\n  di_1_01: kitchen switch\n")
+	defer os.Remove(configFile)
+
+	h := &Handler{configFile: configFile}
+	done := make(chan bool)
+	defer close(done)
+	go h.WatchConfig(done, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	if err := ioutil.WriteFile(configFile, []byte("topics:\n  di_1_01: hall switch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for k := 0; k < 100; k++ {
+		if h.configuration().Topic("di_1_01") == "hall switch" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected the changed config file to be reloaded")
+}
@@ -0,0 +1,446 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// BackendSimulator provides a virtual board, with the inputs flipped by a scenario or the control API
+	BackendSimulator = "simulator"
+	// SimulatorInputsPath is the control API path to list the inputs, or to flip one below it
+	SimulatorInputsPath = "/inputs/"
+	// SimulatorOutputsPath is the control API path to list the outputs
+	SimulatorOutputsPath = "/outputs"
+	// SimulatorToggleValue toggles an input through the control API
+	SimulatorToggleValue = "TOGGLE"
+	// DefaultBurstInterval is the maximum interval between the toggles of a burst
+	DefaultBurstInterval = "500ms"
+	// SimulatorEdgeBuffer is the number of rising edges kept per simulated input while its watcher is busy, enough for a burst
+	SimulatorEdgeBuffer = 16
+)
+
+// SimulatorConfiguration represents the simulated board used instead of the hardware with simulate
+type SimulatorConfiguration struct {
+	// Groups is the number of digital inputs, outputs and relays per group, named like the Neuron ones; defaults to a Neuron S103
+	Groups []ModbusGroup `yaml:"groups"`
+	// Scenario is the file with the input changes to play
+	Scenario string `yaml:"scenario"`
+	// Address is the address to serve the control API on, e.g. :8081 (disabled when empty)
+	Address string `yaml:"address"`
+}
+
+// Scenario is a script of timed input changes
+type Scenario struct {
+	// Seed makes the random bursts reproducible, a random one is used when 0
+	Seed int64 `yaml:"seed"`
+	// Repeat starts over after the last step
+	Repeat bool           `yaml:"repeat"`
+	Steps  []ScenarioStep `yaml:"steps"`
+}
+
+// ScenarioStep changes an input after a delay: sets it, toggles it, or toggles it a number of times at random intervals
+type ScenarioStep struct {
+	// After is the delay since the previous step, e.g. 1.5s
+	After string `yaml:"after"`
+	Input string `yaml:"input"`
+	// Value sets the input on or off, toggles it when omitted
+	Value *bool `yaml:"value"`
+	// Burst toggles the input this many times, at random intervals between min_interval and max_interval
+	Burst       int    `yaml:"burst"`
+	MinInterval string `yaml:"min_interval"`
+	MaxInterval string `yaml:"max_interval"`
+	after       time.Duration
+	minInterval time.Duration
+	maxInterval time.Duration
+}
+
+// parse parses the durations of the step
+func (s *ScenarioStep) parse() (err error) {
+	if s.after, err = parseDuration(s.After); err != nil {
+		return fmt.Errorf("after: %s", err)
+	}
+	if s.Burst < 0 {
+		return fmt.Errorf("burst should not be negative")
+	}
+	if s.minInterval, err = parseDuration(s.MinInterval); err != nil {
+		return fmt.Errorf("min_interval: %s", err)
+	}
+	maxInterval := s.MaxInterval
+	if maxInterval == "" {
+		maxInterval = DefaultBurstInterval
+	}
+	if s.maxInterval, err = parseDuration(maxInterval); err != nil {
+		return fmt.Errorf("max_interval: %s", err)
+	}
+	if s.maxInterval < s.minInterval {
+		return fmt.Errorf("max_interval should not be less than min_interval")
+	}
+	return nil
+}
+
+// parseDuration parses a non-negative duration, zero when empty
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("duration %s should not be negative", value)
+	}
+	return d, err
+}
+
+// LoadScenario reads and checks a scenario file
+func LoadScenario(file string) (scenario Scenario, err error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if err = yaml.UnmarshalStrict(content, &scenario); err != nil {
+		return
+	}
+	for k := range scenario.Steps {
+		if err = scenario.Steps[k].parse(); err != nil {
+			return scenario, fmt.Errorf("step %d: %s", k+1, err)
+		}
+	}
+	return
+}
+
+// SimulatorBackend implements a virtual board: the inputs keep their value until flipped by the scenario or the control API, the outputs keep the value written
+type SimulatorBackend struct {
+	Prefix   string
+	Groups   []ModbusGroup
+	Scenario *Scenario
+	// mu guards the values of the inputs and outputs
+	mu      sync.Mutex
+	inputs  map[string]*simulatedInput
+	outputs map[string]*simulatedOutput
+	playing sync.Once
+	closed  chan bool
+}
+
+// NewSimulatorBackend sets up a simulated board, loading its scenario if any
+func NewSimulatorBackend(b BoardConfiguration) (Backend, error) {
+	s := &SimulatorBackend{Prefix: b.Prefix, Groups: b.Groups, closed: make(chan bool)}
+	if len(s.Groups) == 0 {
+		s.Groups = DefaultModbusGroups
+	}
+	if b.Scenario != "" {
+		scenario, err := LoadScenario(b.Scenario)
+		if err != nil {
+			return nil, fmt.Errorf("scenario %s: %s", b.Scenario, err)
+		}
+		s.Scenario = &scenario
+	}
+	return s, nil
+}
+
+// Discover creates the channels of the groups, checking the scenario only flips existing inputs
+func (s *SimulatorBackend) Discover() (inputs map[string]DigitalInput, outputs map[string]DigitalOutput, err error) {
+	inputs = make(map[string]DigitalInput)
+	outputs = make(map[string]DigitalOutput)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inputs = make(map[string]*simulatedInput)
+	s.outputs = make(map[string]*simulatedOutput)
+	for g, group := range s.Groups {
+		for k := 0; k < group.DI; k++ {
+			name := groupInputName(s.Prefix, g, k)
+			s.inputs[name] = &simulatedInput{backend: s, name: name, edges: make(chan bool, SimulatorEdgeBuffer)}
+			inputs[name] = s.inputs[name]
+		}
+		for k := 0; k < group.DO+group.RO; k++ {
+			name := groupOutputName(s.Prefix, g, group, k)
+			s.outputs[name] = &simulatedOutput{backend: s, name: name}
+			outputs[name] = s.outputs[name]
+		}
+	}
+	if s.Scenario != nil {
+		for k, step := range s.Scenario.Steps {
+			if _, ok := s.inputs[step.Input]; !ok {
+				return inputs, outputs, fmt.Errorf("scenario step %d: no simulated input %q", k+1, step.Input)
+			}
+		}
+	}
+	pollerLog.Info("Created simulated digital inputs", "count", len(inputs), "outputs", len(outputs))
+	return
+}
+
+// Channels lists the names of the simulated groups, checking the scenario only flips existing inputs
+func (s *SimulatorBackend) Channels() (names []string, err error) {
+	names = groupChannels(s.Prefix, s.Groups)
+	if s.Scenario == nil {
+		return
+	}
+	inputs := make(map[string]bool)
+	for g, group := range s.Groups {
+		for k := 0; k < group.DI; k++ {
+			inputs[groupInputName(s.Prefix, g, k)] = true
+		}
+	}
+	for k, step := range s.Scenario.Steps {
+		if !inputs[step.Input] {
+			return names, fmt.Errorf("scenario step %d: no simulated input %q", k+1, step.Input)
+		}
+	}
+	return
+}
+
+// Set sets a simulated input, or toggles it, returning the new value
+func (s *SimulatorBackend) Set(name string, value *bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	input, ok := s.inputs[name]
+	if !ok {
+		return false, fmt.Errorf("no simulated input %q", name)
+	}
+	next := !input.value
+	if value != nil {
+		next = *value
+	}
+	input.set(next)
+	pollerLog.Debug("Simulated digital input", "name", name, "value", next)
+	return next, nil
+}
+
+// values lists the current values of the inputs or outputs
+func (s *SimulatorBackend) values(outputs bool) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string]bool)
+	if outputs {
+		for name, output := range s.outputs {
+			values[name] = output.value
+		}
+		return values
+	}
+	for name, input := range s.inputs {
+		values[name] = input.value
+	}
+	return values
+}
+
+// play runs the scenario until its last step, or forever when repeating, stopping when closed
+func (s *SimulatorBackend) play() {
+	seed := s.Scenario.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	random := rand.New(rand.NewSource(seed))
+	wait := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-s.closed:
+			return false
+		}
+	}
+	pollerLog.Info("Playing scenario", "steps", len(s.Scenario.Steps), "seed", seed)
+	for {
+		for _, step := range s.Scenario.Steps {
+			if !wait(step.after) {
+				return
+			}
+			if step.Burst == 0 {
+				s.Set(step.Input, step.Value)
+				continue
+			}
+			for k := 0; k < step.Burst; k++ {
+				if k > 0 && !wait(step.minInterval+time.Duration(random.Int63n(int64(step.maxInterval-step.minInterval)+1))) {
+					return
+				}
+				s.Set(step.Input, nil)
+			}
+		}
+		if !s.Scenario.Repeat || len(s.Scenario.Steps) == 0 {
+			pollerLog.Info("Scenario done")
+			return
+		}
+	}
+}
+
+// Close stops playing the scenario
+func (s *SimulatorBackend) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	return nil
+}
+
+// simulatedInput is a digital input of a simulated board
+type simulatedInput struct {
+	backend *SimulatorBackend
+	name    string
+	// value is guarded by the mutex of the backend
+	value bool
+	edges chan bool
+}
+
+// set updates the value, queueing a rising edge for the watcher
+func (i *simulatedInput) set(value bool) {
+	rising := !i.value && value
+	i.value = value
+	if !rising {
+		return
+	}
+	select {
+	case i.edges <- true:
+	default:
+		pollerLog.Warn("Dropped rising edge of digital input", "name", i.name)
+	}
+}
+
+// pulse switches the input on, queueing a rising edge, and off again after the hold time
+func (i *simulatedInput) pulse(hold time.Duration) error {
+	i.backend.mu.Lock()
+	defer i.backend.mu.Unlock()
+	i.set(true)
+	time.AfterFunc(hold, func() {
+		i.backend.mu.Lock()
+		defer i.backend.mu.Unlock()
+		i.set(false)
+	})
+	return nil
+}
+
+// Read returns the simulated value
+func (i *simulatedInput) Read() (bool, error) {
+	i.backend.mu.Lock()
+	defer i.backend.mu.Unlock()
+	return i.value, nil
+}
+
+// Watch sends an event for every simulated rising edge until done, starting the scenario of the board if not playing yet
+func (i *simulatedInput) Watch(events chan<- Event, interval int, done <-chan bool) {
+	if i.backend.Scenario != nil {
+		i.backend.playing.Do(func() {
+			go i.backend.play()
+		})
+	}
+	for {
+		select {
+		case <-i.edges:
+			select {
+			case events <- Event{Name: i.name, Value: true}:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Close is a no-op
+func (i *simulatedInput) Close() error {
+	return nil
+}
+
+// simulatedOutput is a digital output or relay of a simulated board
+type simulatedOutput struct {
+	backend *SimulatorBackend
+	name    string
+	// value is guarded by the mutex of the backend
+	value bool
+}
+
+// Update keeps the value
+func (o *simulatedOutput) Update(value bool) error {
+	o.backend.mu.Lock()
+	o.value = value
+	o.backend.mu.Unlock()
+	outputsLog.Info("Updated value of digital output", "name", o.name, "value", value)
+	return nil
+}
+
+// Read returns the value last written
+func (o *simulatedOutput) Read() (bool, error) {
+	o.backend.mu.Lock()
+	defer o.backend.mu.Unlock()
+	return o.value, nil
+}
+
+// simulators lists the simulated boards of the handler
+func (h *Handler) simulators() (simulators []*SimulatorBackend) {
+	for _, backend := range h.backends {
+		if s, ok := backend.(*SimulatorBackend); ok {
+			simulators = append(simulators, s)
+		}
+	}
+	return
+}
+
+// SimulatorMux serves the control API of the simulated boards: GET /inputs and /outputs list the values, POST /inputs/<name> with ON, OFF or TOGGLE flips an input
+func (h *Handler) SimulatorMux() *http.ServeMux {
+	writeValues := func(w http.ResponseWriter, outputs bool) {
+		values := make(map[string]string)
+		for _, s := range h.simulators() {
+			for name, value := range s.values(outputs) {
+				values[name] = formatValue(value)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(values)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(SimulatorOutputsPath, func(w http.ResponseWriter, r *http.Request) {
+		writeValues(w, true)
+	})
+	mux.HandleFunc(SimulatorInputsPath, func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, SimulatorInputsPath)
+		if name == "" && r.Method == http.MethodGet {
+			writeValues(w, false)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var value *bool
+		switch strings.ToUpper(strings.TrimSpace(string(body))) {
+		case MsgTrueValue:
+			value = new(bool)
+			*value = true
+		case MsgFalseValue:
+			value = new(bool)
+		case SimulatorToggleValue, "":
+		default:
+			http.Error(w, fmt.Sprintf("value should be %s, %s or %s", MsgTrueValue, MsgFalseValue, SimulatorToggleValue), http.StatusBadRequest)
+			return
+		}
+		for _, s := range h.simulators() {
+			if current, err := s.Set(name, value); err == nil {
+				fmt.Fprintln(w, formatValue(current))
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("no simulated input %q", name), http.StatusNotFound)
+	})
+	return mux
+}
+
+// ServeSimulator serves the control API of the simulated boards on the address
+func (h *Handler) ServeSimulator(address string) error {
+	pollerLog.Info("Serving simulator control API", "address", address)
+	return http.ListenAndServe(address, h.SimulatorMux())
+}
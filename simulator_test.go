@@ -0,0 +1,201 @@
+package unipitt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadScenario(t *testing.T) {
+	cases := []struct {
+		Content string
+		Error   string
+	}{
+		{Content: "steps:\n  - {after: 1s, input: di_1_01, value: true}\n  - {after: 500ms, input: di_1_02, burst: 5, min_interval: 10ms, max_interval: 20ms}\n"},
+		{Content: "steps:\n  - {after: -1s, input: di_1_01}\n", Error: "step 1: after"},
+		{Content: "steps:\n  - {input: di_1_01, burst: 2, min_interval: 1s, max_interval: 10ms}\n", Error: "max_interval"},
+		{Content: "steps:\n  - {input: di_1_01, pulse: 1s}\n", Error: "pulse"},
+	}
+	for _, testCase := range cases {
+		file := writeConfig(t, testCase.Content)
+		scenario, err := LoadScenario(file)
+		os.Remove(file)
+		if testCase.Error == "" && err != nil {
+			t.Fatalf("Expected no error for %q, got %s\n", testCase.Content, err)
+		}
+		if testCase.Error != "" && (err == nil || !strings.Contains(err.Error(), testCase.Error)) {
+			t.Fatalf("Expected an error mentioning %q for %q, got %v\n", testCase.Error, testCase.Content, err)
+		}
+		if err == nil && (len(scenario.Steps) != 2 || scenario.Steps[1].maxInterval != 20*time.Millisecond) {
+			t.Fatalf("Expected the parsed steps, got %v\n", scenario.Steps)
+		}
+	}
+}
+
+func TestConfigurationSimulate(t *testing.T) {
+	c := DefaultConfiguration()
+	c.Boards = []BoardConfiguration{{Root: "/sys/devices/platform/unipi_plc"}}
+	c.BoardID = "neuron"
+	c.Simulate = true
+	c.Simulator.Groups = []ModbusGroup{{DI: 2, DO: 2}, {DI: 8, RO: 8}}
+	boards := c.BoardList()
+	if len(boards) != 1 || boards[0].Backend != BackendSimulator || len(boards[0].Groups) != 2 || boards[0].Alias != "neuron" {
+		t.Fatalf("Expected the simulated board only, got %v\n", boards)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// simulate sets up a simulated board with a handler for it
+func simulate(t *testing.T, board BoardConfiguration) (*Handler, *SimulatorBackend) {
+	board.Backend = BackendSimulator
+	inputs, outputs, backends, problems, err := FindBoards([]BoardConfiguration{board})
+	if err != nil || len(problems) != 0 {
+		t.Fatalf("Expected the simulated board to be set up, got %v (%v)\n", err, problems)
+	}
+	return &Handler{inputs: inputs, writerMap: outputs, backends: backends}, backends[0].(*SimulatorBackend)
+}
+
+func TestSimulatorBackend(t *testing.T) {
+	h, simulator := simulate(t, BoardConfiguration{Groups: []ModbusGroup{{DI: 2, DO: 1, RO: 1}}})
+	defer h.Close()
+	if len(h.inputs) != 2 || len(h.writerMap) != 2 {
+		t.Fatalf("Expected 2 inputs and 2 outputs, got %v and %v\n", h.inputs, h.writerMap)
+	}
+	if ack := execute("ro_1_01", h.writerMap["ro_1_01"], true); !ack.Success {
+		t.Fatalf("Expected the simulated relay to switch, got %v\n", ack)
+	}
+
+	events := make(chan Event)
+	done := make(chan bool)
+	defer close(done)
+	go h.inputs["di_1_02"].Watch(events, 50, done)
+	on := true
+	simulator.Set("di_1_02", &on)
+	simulator.Set("di_1_02", &on)
+	simulator.Set("di_1_02", nil)
+	simulator.Set("di_1_02", nil)
+	for k := 0; k < 2; k++ {
+		select {
+		case e := <-events:
+			if e.Name != "di_1_02" {
+				t.Fatalf("Expected a rising edge on %s, got %v\n", "di_1_02", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 2 rising edges, got %d\n", k)
+		}
+	}
+	if _, err := simulator.Set("di_9_01", nil); err == nil {
+		t.Fatal("Expected an error for an unknown input, got none")
+	}
+}
+
+func TestSimulatedInputPulse(t *testing.T) {
+	h, _ := simulate(t, BoardConfiguration{})
+	defer h.Close()
+	input := h.inputs["di_1_01"]
+	if err := pulseInput(input, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := input.Read(); !value {
+		t.Fatal("Expected the pulsed input to read on during the hold time")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if value, _ := input.Read(); value {
+		t.Fatal("Expected the pulsed input to read off after the hold time")
+	}
+}
+
+func TestSimulatorScenario(t *testing.T) {
+	file := writeConfig(t, `
+seed: 42
+steps:
+  - {after: 10ms, input: di_1_01, value: true}
+  - {after: 10ms, input: di_1_01, value: false}
+  - {after: 10ms, input: di_1_02, burst: 6, min_interval: 1ms, max_interval: 5ms}
+`)
+	defer os.Remove(file)
+	h, _ := simulate(t, BoardConfiguration{Scenario: file})
+	defer h.Close()
+
+	events := make(chan Event)
+	done := make(chan bool)
+	defer close(done)
+	for _, input := range h.inputs {
+		go input.Watch(events, 50, done)
+	}
+	counts := make(map[string]int)
+	for k := 0; k < 4; k++ {
+		select {
+		case e := <-events:
+			counts[e.Name]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 4 rising edges, got %v\n", counts)
+		}
+	}
+	if counts["di_1_01"] != 1 || counts["di_1_02"] != 3 {
+		t.Fatalf("Expected 1 rising edge on di_1_01 and 3 on di_1_02, got %v\n", counts)
+	}
+}
+
+func TestSimulatorScenarioUnknownInput(t *testing.T) {
+	file := writeConfig(t, "steps:\n  - {input: di_3_01}\n")
+	defer os.Remove(file)
+	_, _, _, _, err := FindBoards([]BoardConfiguration{{Backend: BackendSimulator, Scenario: file}})
+	if err == nil || !strings.Contains(err.Error(), "di_3_01") {
+		t.Fatalf("Expected an error for the unknown input, got %v\n", err)
+	}
+}
+
+func TestSimulatorMux(t *testing.T) {
+	h, _ := simulate(t, BoardConfiguration{})
+	defer h.Close()
+	server := httptest.NewServer(h.SimulatorMux())
+	defer server.Close()
+
+	cases := []struct {
+		Path     string
+		Body     string
+		Expected int
+		Value    string
+	}{
+		{Path: "/inputs/di_1_01", Body: "ON", Expected: http.StatusOK, Value: "ON"},
+		{Path: "/inputs/di_1_01", Body: "toggle", Expected: http.StatusOK, Value: "OFF"},
+		{Path: "/inputs/di_1_01", Body: "", Expected: http.StatusOK, Value: "ON"},
+		{Path: "/inputs/di_1_01", Body: "maybe", Expected: http.StatusBadRequest},
+		{Path: "/inputs/di_9_01", Body: "ON", Expected: http.StatusNotFound},
+	}
+	for _, testCase := range cases {
+		resp, err := http.Post(server.URL+testCase.Path, "text/plain", strings.NewReader(testCase.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body [16]byte
+		n, _ := resp.Body.Read(body[:])
+		resp.Body.Close()
+		if resp.StatusCode != testCase.Expected {
+			t.Fatalf("Expected status %d for %s %q, got %d\n", testCase.Expected, testCase.Path, testCase.Body, resp.StatusCode)
+		}
+		if testCase.Value != "" && strings.TrimSpace(string(body[:n])) != testCase.Value {
+			t.Fatalf("Expected value %s for %s %q, got %s\n", testCase.Value, testCase.Path, testCase.Body, body[:n])
+		}
+	}
+
+	resp, err := http.Get(server.URL + SimulatorInputsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var values map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 4 || values["di_1_01"] != MsgTrueValue || values["di_1_02"] != MsgFalseValue {
+		t.Fatalf("Expected the values of the 4 inputs, got %v\n", values)
+	}
+}
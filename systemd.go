@@ -0,0 +1,105 @@
+package unipitt
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// SdReady is the systemd notification sent once the handler is ready
+	SdReady = "READY=1"
+	// SdWatchdog is the systemd notification to keep the watchdog from firing
+	SdWatchdog = "WATCHDOG=1"
+	// SdStopping is the systemd notification sent when shutting down
+	SdStopping = "STOPPING=1"
+	// sdReadyCheckInterval is the interval to recheck readiness before notifying systemd
+	sdReadyCheckInterval = 500 * time.Millisecond
+)
+
+// sdNotify sends a state notification to systemd. Returns false without error when not running under systemd.
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	conn, err := net.DialUnix(addr.Net, nil, addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sdWatchdogInterval reads the watchdog interval systemd expects from the environment, zero if disabled
+func sdWatchdogInterval() (time.Duration, error) {
+	value := os.Getenv("WATCHDOG_USEC")
+	if value == "" {
+		return 0, nil
+	}
+	// Only consider the watchdog when it was meant for this process
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// Watchdog notifies systemd when the handler becomes ready, and keeps pinging the systemd watchdog as long as the handler is live (blocking)
+func (h *Handler) Watchdog(done chan bool) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	interval, err := sdWatchdogInterval()
+	if err != nil {
+		healthLog.Error("Error reading systemd watchdog interval", "err", err)
+	}
+
+	// Wait for readiness
+	ticker := time.NewTicker(sdReadyCheckInterval)
+	for !h.Readiness().Healthy {
+		select {
+		case <-ticker.C:
+		case <-done:
+			ticker.Stop()
+			return
+		}
+	}
+	ticker.Stop()
+	if _, err := sdNotify(SdReady); err != nil {
+		healthLog.Error("Error notifying systemd", "err", err)
+	}
+	healthLog.Info("Notified systemd the handler is ready")
+	if interval == 0 {
+		<-done
+		sdNotify(SdStopping)
+		return
+	}
+
+	// Ping at half the interval, as recommended by systemd; stop pinging when no longer live
+	ticker = time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s := h.Liveness(); !s.Healthy {
+				healthLog.Warn("Handler not live, skipping systemd watchdog", "checks", s.Checks)
+				continue
+			}
+			if _, err := sdNotify(SdWatchdog); err != nil {
+				healthLog.Error("Error notifying systemd watchdog", "err", err)
+			}
+		case <-done:
+			sdNotify(SdStopping)
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSdNotifyNoSocket(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	sent, err := sdNotify(SdReady)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent {
+		t.Fatal("Expected no notification to be sent without a socket")
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	sent, err := sdNotify(SdWatchdog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sent {
+		t.Fatal("Expected a notification to be sent")
+	}
+	b := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != SdWatchdog {
+		t.Fatalf("Expected notification %s, got %s\n", SdWatchdog, string(b[:n]))
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	cases := []struct {
+		Usec     string
+		Pid      string
+		Expected time.Duration
+		HasError bool
+	}{
+		{Usec: "", Expected: 0},
+		{Usec: "2000000", Expected: 2 * time.Second},
+		{Usec: "2000000", Pid: "1", Expected: 0},
+		{Usec: "foo", HasError: true},
+	}
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	for _, testCase := range cases {
+		os.Setenv("WATCHDOG_USEC", testCase.Usec)
+		os.Setenv("WATCHDOG_PID", testCase.Pid)
+		interval, err := sdWatchdogInterval()
+		if (err != nil) != testCase.HasError {
+			t.Fatalf("Expected error %t, got %v\n", testCase.HasError, err)
+		}
+		if interval != testCase.Expected {
+			t.Fatalf("Expected interval %s, got %s\n", testCase.Expected, interval)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package unipitt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceInput marks the trigger of a digital input in a trace
+	TraceInput = "input"
+	// TraceOutput marks an output command in a trace
+	TraceOutput = "output"
+	// TraceConnect marks a connection to an MQTT broker in a trace
+	TraceConnect = "connect"
+	// TraceDisconnect marks a lost connection to an MQTT broker in a trace
+	TraceDisconnect = "disconnect"
+	// DefaultReplaySpeed replays a trace in real time
+	DefaultReplaySpeed = 1
+)
+
+// TraceEntry is a single line of a trace: an input trigger, an output command with the topic it came in on, or a broker connection event
+type TraceEntry struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name,omitempty"`
+	Topic   string    `json:"topic,omitempty"`
+	Payload string    `json:"payload,omitempty"`
+	Broker  string    `json:"broker,omitempty"`
+	Error   string    `json:"err,omitempty"`
+}
+
+// Recorder appends the trace entries to a file, one JSON object per line
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewRecorder opens the trace file for appending, creating it if needed
+func NewRecorder(file string) (*Recorder, error) {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{f: f}, nil
+}
+
+// Record writes the entry, timestamped now unless it has a time already
+func (r *Recorder) Record(entry TraceEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.f.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the trace file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// ReadTrace reads the entries of a trace file, in order
+func ReadTrace(file string) (entries []TraceEntry, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry TraceEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, fmt.Errorf("%s:%d: %s", file, line, err)
+		}
+		switch entry.Kind {
+		case TraceInput, TraceOutput, TraceConnect, TraceDisconnect:
+		default:
+			return entries, fmt.Errorf("%s:%d: unknown kind %q", file, line, entry.Kind)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// record writes the entry to the trace, if recording
+func (h *Handler) record(entry TraceEntry) {
+	if h.recorder == nil {
+		return
+	}
+	if err := h.recorder.Record(entry); err != nil {
+		traceLog.Error("Error recording trace", "kind", entry.Kind, "err", err)
+	}
+}
+
+// pulser is implemented by the simulated inputs, which can be made to trigger
+type pulser interface {
+	// pulse switches the input on and off again, keeping it on for at least the hold time if it is polled
+	pulse(hold time.Duration) error
+}
+
+// pulseInput triggers an input to replay a trace on: a simulated input, or a sys fs input by writing its di_value file, which replayable limits to a fake sys fs
+func pulseInput(input DigitalInput, hold time.Duration) error {
+	switch i := input.(type) {
+	case pulser:
+		return i.pulse(hold)
+	case *DigitalInputReader:
+		file := path.Join(i.Path, DiFilename)
+		if err := ioutil.WriteFile(file, []byte(DiTrueValue), 0644); err != nil {
+			return err
+		}
+		time.AfterFunc(hold, func() {
+			if err := ioutil.WriteFile(file, []byte("0"), 0644); err != nil {
+				traceLog.Error("Error switching off digital input", "name", i.Name, "err", err)
+			}
+		})
+		return nil
+	}
+	return fmt.Errorf("cannot trigger a %T", input)
+}
+
+// hardwareRoot checks whether the sys fs root is /sys, under it or above it, once made absolute and with the symlinks resolved
+func hardwareRoot(root string) bool {
+	resolved, err := filepath.Abs(root)
+	if err != nil {
+		return true
+	}
+	if real, err := filepath.EvalSymlinks(resolved); err == nil {
+		resolved = real
+	}
+	return resolved == "/" || resolved == "/sys" || strings.HasPrefix(resolved, "/sys/")
+}
+
+// replayable checks the inputs and outputs are simulated or on a fake sys fs, so a replay doesn't switch any real hardware
+func (h *Handler) replayable() error {
+	for _, backend := range h.backends {
+		switch b := backend.(type) {
+		case *SimulatorBackend:
+		case *SysFsBackend:
+			if hardwareRoot(b.Root) {
+				return fmt.Errorf("cannot replay on the hardware under %s, only on a fake sys fs", b.Root)
+			}
+		default:
+			return fmt.Errorf("cannot replay on a %T, only on the simulator or a fake sys fs", backend)
+		}
+	}
+	return nil
+}
+
+// Replay feeds a trace back through the handler: the inputs are triggered, so their triggers are published by Poll, and the output commands are handled as if received on their topics. The time between the entries is divided by the speed; at speed 0, the entries follow each other immediately.
+func (h *Handler) Replay(entries []TraceEntry, speed int, done <-chan bool) error {
+	if err := h.replayable(); err != nil {
+		return err
+	}
+	// Keep the inputs on for two polling intervals, so they are picked up
+	hold := 2 * time.Duration(h.configuration().PollingInterval) * time.Millisecond
+	// pulsed holds when each input was last pulsed: it has to be off for a hold again before the next pulse, or the rising edge gets lost
+	pulsed := make(map[string]time.Time)
+	traceLog.Info("Replaying trace", "entries", len(entries), "speed", speed)
+	for k, entry := range entries {
+		if k > 0 && speed > 0 {
+			select {
+			case <-time.After(entry.Time.Sub(entries[k-1].Time) / time.Duration(speed)):
+			case <-done:
+				return nil
+			}
+		}
+		switch entry.Kind {
+		case TraceInput:
+			input, ok := h.inputs[entry.Name]
+			if !ok {
+				traceLog.Warn("No digital input to replay trigger on", "name", entry.Name)
+				continue
+			}
+			if wait := 2*hold - time.Since(pulsed[entry.Name]); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-done:
+					return nil
+				}
+			}
+			traceLog.Debug("Replaying trigger", "name", entry.Name)
+			if err := pulseInput(input, hold); err != nil {
+				traceLog.Error("Error replaying trigger", "name", entry.Name, "err", err)
+			}
+			pulsed[entry.Name] = time.Now()
+		case TraceOutput:
+			traceLog.Debug("Replaying command", "name", entry.Name, "topic", entry.Topic)
+			if entry.Topic == "" {
+				// Received over Modbus
+				h.output(entry.Name, entry.Topic, []byte(entry.Payload), entry.Payload == MsgTrueValue)
+			} else if name, ok := h.configuration().dutyName(entry.Topic); ok {
+				h.duty(name, entry.Topic, []byte(entry.Payload))
+			} else {
+				h.command(entry.Topic, []byte(entry.Payload))
+			}
+		default:
+			traceLog.Info("Recorded broker connection event", "kind", entry.Kind, "broker", entry.Broker, "err", entry.Error)
+		}
+	}
+	// Let the last triggers be picked up
+	select {
+	case <-time.After(hold):
+	case <-done:
+	}
+	traceLog.Info("Replayed trace", "entries", len(entries))
+	return nil
+}
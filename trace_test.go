@@ -0,0 +1,210 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	file := writeConfig(t, "")
+	defer os.Remove(file)
+	r, err := NewRecorder(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	entries := []TraceEntry{
+		{Time: start, Kind: TraceConnect, Broker: "tcp://localhost:1883"},
+		{Time: start.Add(time.Second), Kind: TraceInput, Name: "di_1_01", Topic: "kitchen/switch"},
+		{Time: start.Add(2 * time.Second), Kind: TraceOutput, Name: "do_1_01", Topic: "living light", Payload: MsgTrueValue},
+	}
+	for _, entry := range entries {
+		if err := r.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	read, err := ReadTrace(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(entries) {
+		t.Fatalf("Expected %d entries, got %v\n", len(entries), read)
+	}
+	for k, entry := range entries {
+		if !read[k].Time.Equal(entry.Time) || read[k].Kind != entry.Kind || read[k].Topic != entry.Topic || read[k].Payload != entry.Payload {
+			t.Fatalf("Expected entry %v, got %v\n", entry, read[k])
+		}
+	}
+}
+
+func TestReadTraceErrors(t *testing.T) {
+	cases := []struct {
+		Content string
+		Error   string
+	}{
+		{Content: `{"time": "2026-10-18T12:00:00Z", "kind": "input", "name": "di_1_01"}` + "\n\nnot json\n", Error: ":3:"},
+		{Content: `{"time": "2026-10-18T12:00:00Z", "kind": "pulse"}`, Error: `unknown kind "pulse"`},
+	}
+	for _, testCase := range cases {
+		file := writeConfig(t, testCase.Content)
+		_, err := ReadTrace(file)
+		os.Remove(file)
+		if err == nil || !strings.Contains(err.Error(), testCase.Error) {
+			t.Fatalf("Expected an error mentioning %q, got %v\n", testCase.Error, err)
+		}
+	}
+}
+
+// replay replays the entries at the speed on a handler polling its inputs, publishing on a fake client and recording a new trace
+func replay(t *testing.T, h *Handler, entries []TraceEntry, speed int) (*fakeClient, []TraceEntry) {
+	file := writeConfig(t, "")
+	defer os.Remove(file)
+	var err error
+	if h.recorder, err = NewRecorder(file); err != nil {
+		t.Fatal(err)
+	}
+	client := newFakeClient()
+	h.brokers = []*broker{{name: "fake", client: client}}
+	h.config = DefaultConfiguration()
+	h.config.PollingInterval = 10
+
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		h.Poll(done, h.config.PollingInterval, DefaultPayload)
+		close(stopped)
+	}()
+	err = h.Replay(entries, speed, done)
+	// Stop polling before looking at what got published
+	close(done)
+	<-stopped
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, err := ReadTrace(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, recorded
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Now()
+	entries := []TraceEntry{
+		{Time: start, Kind: TraceConnect, Broker: "tcp://localhost:1883"},
+		{Time: start.Add(time.Second), Kind: TraceInput, Name: "di_1_02"},
+		{Time: start.Add(2 * time.Second), Kind: TraceOutput, Name: "do_1_01", Topic: "do_1_01", Payload: MsgTrueValue},
+	}
+
+	// Simulated board
+	h, simulator := simulate(t, BoardConfiguration{})
+	defer h.Close()
+	began := time.Now()
+	client, recorded := replay(t, h, entries, 100)
+	if elapsed := time.Since(began); elapsed < 20*time.Millisecond {
+		t.Fatalf("Expected the replay to take 1/100 of the trace, took %s\n", elapsed)
+	}
+	if !simulator.values(true)["do_1_01"] {
+		t.Fatalf("Expected the replayed command to switch on %s\n", "do_1_01")
+	}
+	if len(client.published) != 1 || client.published[0].topic != "di_1_02" {
+		t.Fatalf("Expected the replayed trigger to be published, got %v\n", client.published)
+	}
+	if len(recorded) != 2 || recorded[0].Kind != TraceInput || recorded[1].Kind != TraceOutput || recorded[1].Payload != MsgTrueValue {
+		t.Fatalf("Expected the replay to be recorded, got %v\n", recorded)
+	}
+
+	// Fake sys fs
+	root := makeBoard(t, "di_1_02", "do_1_01")
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "di_1_02", DiFilename), []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "do_1_01", DoFilename), []byte(DoFalseValue), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inputs, outputs, backends, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = &Handler{inputs: inputs, writerMap: outputs, backends: backends}
+	defer h.Close()
+	client, _ = replay(t, h, entries, 100)
+	if value, err := outputs["do_1_01"].Read(); err != nil || !value {
+		t.Fatalf("Expected the replayed command to switch on %s, got %t (%v)\n", "do_1_01", value, err)
+	}
+	if len(client.published) != 1 || client.published[0].topic != "di_1_02" {
+		t.Fatalf("Expected the replayed trigger to be published, got %v\n", client.published)
+	}
+}
+
+func TestReplayHardware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	link := filepath.Join(dir, "board")
+	if err := os.Symlink("/sys/devices", link); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := filepath.Rel(wd, "/sys/devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Backend  Backend
+		Expected string
+	}{
+		{Backend: &SysFsBackend{Root: SysFsRoot}, Expected: "hardware"},
+		{Backend: &SysFsBackend{Root: "/sys"}, Expected: "hardware"},
+		{Backend: &SysFsBackend{Root: "//sys/devices"}, Expected: "hardware"},
+		{Backend: &SysFsBackend{Root: "/tmp/../sys/devices"}, Expected: "hardware"},
+		{Backend: &SysFsBackend{Root: relative}, Expected: "hardware"},
+		{Backend: &SysFsBackend{Root: link}, Expected: "hardware"},
+		{Backend: &SysFsBackend{Root: "/"}, Expected: "hardware"},
+		{Backend: &ModbusBackend{}, Expected: "ModbusBackend"},
+	}
+	for _, testCase := range cases {
+		h := &Handler{backends: []Backend{testCase.Backend}}
+		if err := h.Replay(nil, 0, nil); err == nil || !strings.Contains(err.Error(), testCase.Expected) {
+			t.Fatalf("Expected an error mentioning %q, got %v\n", testCase.Expected, err)
+		}
+	}
+}
+
+func TestReplayRepeated(t *testing.T) {
+	start := time.Now()
+	// Triggered twice within the hold time, as replayed at speed 0
+	entries := []TraceEntry{
+		{Time: start, Kind: TraceInput, Name: "di_1_02"},
+		{Time: start, Kind: TraceInput, Name: "di_1_02"},
+	}
+
+	root := makeBoard(t, "di_1_02")
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "di_1_02", DiFilename), []byte("0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inputs, outputs, backends, _, err := FindBoards([]BoardConfiguration{{Root: root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{inputs: inputs, writerMap: outputs, backends: backends}
+	defer h.Close()
+	client, _ := replay(t, h, entries, 0)
+	if len(client.published) != 2 {
+		t.Fatalf("Expected both replayed triggers to be published, got %v\n", client.published)
+	}
+}
@@ -1,9 +1,10 @@
 package unipitt
 
 import (
-	"log"
+	"fmt"
+	"sync"
+	"sync/atomic"
 
-	"github.com/cenkalti/backoff"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
@@ -12,6 +13,12 @@ const (
 	SysFsRoot = "/sys/devices/platform/unipi_plc"
 	// MsgTrueValue is the MQTT true value to check for
 	MsgTrueValue = "ON"
+	// MsgFalseValue is the MQTT false value
+	MsgFalseValue = "OFF"
+	// CommandSuffix ends the command topics when subscribing with a command prefix
+	CommandSuffix = "/set"
+	// BoardPlaceholder is replaced by the board ID in the topic and command prefixes
+	BoardPlaceholder = "{board}"
 )
 
 // Unipitt defines the interface with unipi board
@@ -22,132 +29,280 @@ type Unipitt interface {
 
 // Handler implements handles all unipi to MQTT interactions
 type Handler struct {
-	readers   []DigitalInputReader
-	writerMap map[string]DigitalOutputWriter
-	client    mqtt.Client
-	config    Configuration
+	inputs    map[string]DigitalInput
+	writerMap map[string]DigitalOutput
+	// backends talk to the boards the inputs and outputs are on
+	backends []Backend
+	// brokers holds the connections to the MQTT brokers, in order of preference
+	brokers []*broker
+	// mu guards the config, which gets swapped on reload; reloadMu serializes the reloads
+	mu         sync.RWMutex
+	reloadMu   sync.Mutex
+	config     Configuration
+	configFile string
+	overrides  map[string]string
+	sysFsRoots []string
+	// statusLeds show the status instead of being controlled over MQTT, by name
+	statusLeds map[string]DigitalOutput
+	// flash is set after publishing a trigger, to flash the status LEDs; accessed atomically
+	flash int32
+	// counters meter the pulses on the inputs with a hardware counter, by name
+	counters map[string]*Counter
+	// sensors are the temperature sensors found on the 1-Wire bus, by ID; sensorMu guards them against the health checks
+	sensorMu sync.Mutex
+	sensors  map[string]*Sensor
+	// recorder writes the trace, when recording
+	recorder *Recorder
+	// interval holds the polling interval in millis, accessed atomically
+	interval int64
 }
 
-// NewHandler prepares and sets up an entire unipitt handler
+// NewHandler prepares and sets up an entire unipitt handler. The given arguments take precedence over the environment and the config file.
 func NewHandler(broker string, clientID string, caFile string, sysFsRoot string, configFile string) (h *Handler, err error) {
-	h = &Handler{}
+	overrides := map[string]string{"broker": broker, "client_id": clientID, "sysfs_root": sysFsRoot}
+	if caFile != "" {
+		overrides["cafile"] = caFile
+	}
+	return NewHandlerFromConfig(configFile, overrides)
+}
 
-	// Check if there's a mapping to be read
-	if configFile != "" {
-		log.Printf("Reading configuration file %s\n", configFile)
-		c, err := configFromFile(configFile)
-		if err != nil {
-			log.Printf("Error reading config file %s: %s\n", configFile, err)
-		} else {
-			h.config = c
+// NewHandlerFromConfig prepares and sets up an entire unipitt handler from the configuration resolved by LoadConfiguration
+func NewHandlerFromConfig(configFile string, overrides map[string]string) (h *Handler, err error) {
+	h = &Handler{configFile: configFile, overrides: overrides}
+
+	c, err := LoadConfiguration(configFile, overrides)
+	if err != nil {
+		configLog.Error("Error reading config file", "file", configFile, "err", err)
+		return h, err
+	}
+	if err = c.Validate(); err != nil {
+		configLog.Error("Invalid configuration", "file", configFile, "err", err)
+		return h, err
+	}
+	h.config = c
+	ConfigureLogging(c.Logging)
+	if c.Record != "" {
+		if h.recorder, err = NewRecorder(c.Record); err != nil {
+			traceLog.Error("Error opening trace file", "file", c.Record, "err", err)
+			return
+		}
+	}
+	boards := c.BoardList()
+	for _, b := range boards {
+		if b.backendName() == BackendSysFs {
+			h.sysFsRoots = append(h.sysFsRoots, b.Root)
 		}
 	}
 
-	// Digital writer setup
-	h.writerMap, err = FindDigitalOutputWriters(sysFsRoot)
+	// Digital input and output setup, for all boards
+	var problems []Problem
+	h.inputs, h.writerMap, h.backends, problems, err = FindBoards(boards)
+	for _, problem := range problems {
+		configLog.Error("Name collision between boards", "err", problem)
+	}
 	if err != nil {
-		log.Printf("Error creating a map of digital output writers: %s\n", err)
+		return
+	}
+	h.setupStatusLeds(&c)
+	h.setupInputSettings(&c)
+	h.applyBindings(nil, &c)
+	h.setupPwm(&c)
+	if err = h.setupCounters(&c); err != nil {
+		counterLog.Error("Error setting up counters", "err", err)
+		return
 	}
 
-	// MQTT setup
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID(clientID)
-	if caFile != "" {
-		tlsConfig, err := NewTLSConfig(caFile)
+	// MQTT setup; a failed connection is retried on publish, so just continue
+	for _, bc := range c.BrokerList() {
+		b, err := h.newBroker(&c, bc)
 		if err != nil {
-			log.Printf("Error reading MQTT CA file %s: %s\n", caFile, err)
 			return h, err
 		}
-		opts.SetTLSConfig(tlsConfig)
+		h.brokers = append(h.brokers, b)
+	}
+	for _, b := range h.brokers {
+		b.connect()
 	}
 
-	// Callbacks for subscribe
-	var cb mqtt.MessageHandler = func(c mqtt.Client, msg mqtt.Message) {
-		log.Printf("Handling message on topic %s\n", msg.Topic())
-		// Find corresponding writer
-		if writer, ok := h.writerMap[h.config.Name(msg.Topic())]; ok {
-			err := writer.Update(string(msg.Payload()) == MsgTrueValue)
-			if err != nil {
-				log.Printf("Error updating digital output with name %s: %s\n", writer.Name, err)
-			}
-		} else {
-			log.Printf("Error matching a writer for given name %s\n", msg.Topic())
-		}
+	// Mapped names without a channel are likely typos, but could be hardware which is (temporarily) missing
+	channels := make(map[string]bool)
+	for name := range h.inputs {
+		channels[name] = true
 	}
-	opts.OnConnect = func(c mqtt.Client) {
-		for name := range h.writerMap {
-			if token := c.Subscribe(name, 0, cb); token.Wait() && token.Error() != nil {
-				log.Print(err)
-			}
-			// Also subscribe any given mapped topic for the names
-			topic := h.config.Topic(name)
-			if topic != name {
-				if token := c.Subscribe(topic, 0, cb); token.Wait() && token.Error() != nil {
-					log.Print(err)
-				}
-			}
-		}
+	for name := range h.writerMap {
+		channels[name] = true
 	}
-
-	h.client = mqtt.NewClient(opts)
-	err = h.connect()
-	if err != nil {
-		log.Printf("Error connecting to MQTT broker: %s\n ...", err)
+	for name := range h.statusLeds {
+		channels[name] = true
 	}
-
-	// Digital Input reader setup
-	h.readers, err = FindDigitalInputReaders(sysFsRoot)
-	if err != nil {
-		return
+	sensors, _ := FindSensors(c.W1Root)
+	for _, id := range sensors {
+		channels[id] = true
+	}
+	for _, problem := range h.config.UnknownNames(channels) {
+		configLog.Warn("Unknown name in config file", "file", configFile, "err", problem)
 	}
-	log.Printf("Created %d digital input reader instances from path %s\n", len(h.readers), sysFsRoot)
 
 	return
 }
 
 // Poll starts the actual polling and pushing to MQTT
 func (h *Handler) Poll(done chan bool, interval int, payload string) (err error) {
-	events := make(chan *DigitalInputReader)
+	events := make(chan Event)
+	atomic.StoreInt64(&h.interval, int64(interval))
 
-	// Start polling
-	log.Printf("Initiate polling for %d readers\n", len(h.readers))
-	for k := range h.readers {
-		go h.readers[k].Poll(events, interval)
+	// Start watching
+	pollerLog.Info("Initiate polling", "inputs", len(h.inputs))
+	for _, input := range h.inputs {
+		go input.Watch(events, interval, done)
 	}
 
 	// Publish on a trigger
 	for {
 		select {
-		case d := <-events:
-			if d.Err != nil {
-				log.Printf("Found error %s for name %s\n", d.Err, d.Name)
+		case e := <-events:
+			if e.Err != nil {
+				pollerLog.Error("Found error for digital input", "name", e.Name, "err", e.Err)
 			} else {
 				// Determine topic from config
-				log.Printf("Trigger for name %s, using topic %s\n", d.Name, h.config.Topic(d.Name))
-				if token := h.client.Publish(h.config.Topic(d.Name), 0, false, payload); token.Wait() && token.Error() != nil {
-					go backoff.Retry(h.connect, backoff.NewExponentialBackOff())
-				}
+				topic := h.configuration().Topic(e.Name)
+				pollerLog.Info("Trigger for digital input", "name", e.Name, "topic", topic)
+				h.record(TraceEntry{Kind: TraceInput, Name: e.Name, Topic: topic})
+				h.publish(topic, payload, e)
+				atomic.StoreInt32(&h.flash, 1)
 			}
 		case <-done:
-			log.Println("Handler done polling, coming back ...")
+			pollerLog.Info("Handler done polling, coming back ...")
 			return
 		}
 	}
 }
 
-// reconnect tries to reconnect the MQTT client to the broker
-func (h *Handler) connect() error {
-	log.Println("Error connecting to MQTT broker ...")
-	token := h.client.Connect()
+// publishTrigger publishes the trigger for a digital input on the client. Over MQTT 5, the trigger carries the channel, edge and board serial as user properties and is published with QoS 1, so rejections are reported.
+func (h *Handler) publishTrigger(client mqtt.Client, topic string, payload string, e Event) error {
+	publisher, ok := client.(PropertiesPublisher)
+	if !ok {
+		token := client.Publish(topic, 0, false, payload)
+		token.Wait()
+		return token.Error()
+	}
+	c := h.configuration()
+	properties := &PublishProperties{
+		MessageExpiry:  uint32(c.MessageExpiry),
+		UserProperties: []UserProperty{{Key: "channel", Value: e.Name}, {Key: "edge", Value: "rising"}},
+	}
+	if c.BoardSerial != "" {
+		properties.UserProperties = append(properties.UserProperties, UserProperty{Key: "board_serial", Value: c.BoardSerial})
+	}
+	token := publisher.PublishWithProperties(topic, 1, false, payload, properties)
 	token.Wait()
 	return token.Error()
 }
 
+// Config returns the resolved configuration the handler currently runs with
+func (h *Handler) Config() Configuration {
+	return *h.configuration()
+}
+
+// configuration returns a copy of the current configuration
+func (h *Handler) configuration() *Configuration {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	c := h.config
+	return &c
+}
+
+// onMessage handles an incoming MQTT message by changing an input setting or the duty cycle of a PWM output, or by updating the corresponding digital output, acknowledging the command when asked for
+func (h *Handler) onMessage(c mqtt.Client, msg mqtt.Message) {
+	mqttLog.Debug("Handling message", "topic", msg.Topic())
+	if name, ok := h.configuration().dutyName(msg.Topic()); ok {
+		h.duty(name, msg.Topic(), msg.Payload())
+		return
+	}
+	if name, setting, ok := h.configuration().settingTopic(msg.Topic()); ok {
+		h.onSetting(name, setting, msg.Payload())
+		return
+	}
+	// The command filters take the acknowledgements under the command prefix as well
+	if c := h.configuration(); len(c.commandPrefixes()) > 0 {
+		if _, ok := c.commandPath(msg.Topic(), CommandSuffix); !ok {
+			mqttLog.Debug("Ignoring message which is no command", "topic", msg.Topic())
+			return
+		}
+	}
+	command, ack := h.command(msg.Topic(), msg.Payload())
+	h.acknowledge(c, msg, command, ack)
+}
+
+// command updates the digital output for the command received on the topic, recording it when tracing
+func (h *Handler) command(topic string, payload []byte) (command Command, ack Ack) {
+	name := h.configuration().CommandName(topic)
+	command, err := ParseCommand(payload)
+	if err != nil {
+		outputsLog.Warn("Invalid command", "topic", topic, "err", err)
+		ack = Ack{CorrelationID: command.CorrelationID, Name: name, Error: err.Error()}
+		h.record(TraceEntry{Kind: TraceOutput, Name: name, Topic: topic, Payload: string(payload), Error: ack.Error})
+		return
+	}
+	ack = h.output(name, topic, payload, command.Value)
+	ack.CorrelationID = command.CorrelationID
+	return
+}
+
+// output updates the digital output for a command, received on the topic or over Modbus without topic, recording it when tracing
+func (h *Handler) output(name string, topic string, payload []byte, value bool) (ack Ack) {
+	if writer, ok := h.writerMap[name]; ok {
+		ack = execute(name, writer, value)
+		// Switching a PWM output stops PWM
+		if _, pwm := h.configuration().Pwm[name]; pwm && ack.Success {
+			h.send(h.configuration().Topic(name), func(client mqtt.Client) error {
+				return h.publishPwm(client, name)
+			})
+		}
+	} else {
+		outputsLog.Warn("Error matching a writer for given topic", "topic", topic)
+		ack = Ack{Name: name, Error: fmt.Sprintf("no digital output for topic %s", topic)}
+	}
+	h.record(TraceEntry{Kind: TraceOutput, Name: name, Topic: topic, Payload: string(payload), Error: ack.Error})
+	return
+}
+
+// subscriptions lists the topics to subscribe to for the digital outputs and input settings, given a configuration: the config filters and duty cycle topics, a single wildcard filter per board with a command prefix, otherwise the (prefixed) names themselves as well as any mapped topics
+func (h *Handler) subscriptions(config *Configuration) map[string]bool {
+	topics := make(map[string]bool)
+	for _, filter := range config.ConfigFilters() {
+		topics[filter] = true
+	}
+	for topic := range config.dutySubscriptions() {
+		topics[topic] = true
+	}
+	if filters := config.CommandFilters(); len(filters) > 0 {
+		for _, filter := range filters {
+			topics[filter] = true
+		}
+		return topics
+	}
+	for name := range h.writerMap {
+		topics[config.prefixed(name)] = true
+		topics[config.Topic(name)] = true
+	}
+	return topics
+}
+
+// subscribe subscribes the message handler to the given topics
+func (h *Handler) subscribe(c mqtt.Client, topics map[string]bool) {
+	for _, topic := range sortedKeys(topics) {
+		if token := c.Subscribe(topic, 0, h.onMessage); token.Wait() && token.Error() != nil {
+			mqttLog.Error("Error subscribing", "topic", topic, "err", token.Error())
+		}
+	}
+}
+
 // Close loose ends
 func (h *Handler) Close() {
-	// Close the readers
-	for k := range h.readers {
-		h.readers[k].Close()
+	// Close the inputs and the backends providing them
+	closeBackends(h.inputs, h.backends)
+	if h.recorder != nil {
+		h.recorder.Close()
 	}
 }
@@ -3,7 +3,6 @@ package unipitt
 import (
 	"bytes"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"testing"
@@ -58,9 +57,9 @@ func TestHandler(t *testing.T) {
 
 	// Setup log monitoring
 	var buf bytes.Buffer
-	log.SetOutput(&buf)
+	SetLogOutput(&buf)
 	defer func() {
-		log.SetOutput(os.Stderr)
+		SetLogOutput(os.Stderr)
 	}()
 
 	// Start polling (blocking)
@@ -69,19 +68,19 @@ func TestHandler(t *testing.T) {
 	go func() {
 		// Trigger a send
 		f.Seek(0, 0)
-		_, err = f.WriteString("1\n")
+		_, err := f.WriteString("1\n")
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 		// Some ugly waiting until everything has settled ...
 		time.Sleep(1 * time.Second)
 		done <- true
 	}()
 	handler.Poll(done, pollingInterval, payload)
-	if !bytes.Contains(buf.Bytes(), []byte("Trigger for name di_1_01")) {
+	if !bytes.Contains(buf.Bytes(), []byte(`msg="Trigger for digital input" name=di_1_01`)) {
 		t.Fatal("Expected a trigger to be captured in the log, found none")
 	}
-	if !bytes.Contains(buf.Bytes(), []byte("Error connecting to MQTT broker ...")) {
+	if !bytes.Contains(buf.Bytes(), []byte(`msg="Error connecting to MQTT broker"`)) {
 		t.Fatal("Expected a reconnect for MQTT broker, did not find one")
 	}
 }
@@ -215,14 +214,14 @@ func TestHandlerConfigUnmarshalIssue(t *testing.T) {
 
 	// Setup log monitoring
 	var buf bytes.Buffer
-	log.SetOutput(&buf)
+	SetLogOutput(&buf)
 	defer func() {
-		log.SetOutput(os.Stderr)
+		SetLogOutput(os.Stderr)
 	}()
 
 	handler, err := NewHandler(broker, clientID, caFile, sysFsRoot, configFile.Name())
-	if err != nil {
-		t.Fatal(err)
+	if err == nil {
+		t.Fatal("Expected an error for an invalid config file, got none")
 	}
 	defer handler.Close()
 
@@ -3,7 +3,9 @@ package unipitt
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 )
 
 // findPathsByRegex find matching paths where a regex matches (on the name of a given oflder, not full path)
@@ -22,3 +24,12 @@ func findPathsByRegex(root string, pattern string) (paths []string, err error) {
 		})
 	return
 }
+
+// sortedKeys returns the keys of a map with string keys in sorted order, whatever its values
+func sortedKeys(m interface{}) (keys []string) {
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return
+}
@@ -0,0 +1,277 @@
+package unipitt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// MaxTopicLength is the maximum length in bytes of an MQTT topic
+	MaxTopicLength = 65535
+)
+
+// yamlLineRegex extracts the line number from a yaml error message
+var yamlLineRegex = regexp.MustCompile(`line (\d+): (.*)`)
+
+// Problem describes an issue found validating a configuration, optionally pointing at the line in the file
+type Problem struct {
+	Line int
+	Key  string
+	// Section is the top-level key the key is nested under, for the names which can be in more than one section
+	Section string
+	Message string
+}
+
+// Error formats the problem with its line number, when known
+func (p Problem) Error() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("line %d: %s", p.Line, p.Message)
+	}
+	return p.Message
+}
+
+// ValidateTopic checks a topic can be used to publish on: non-empty, valid UTF-8, no wildcards or null characters and not too long
+func ValidateTopic(topic string) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("empty topic")
+	case len(topic) > MaxTopicLength:
+		return fmt.Errorf("topic longer than %d bytes", MaxTopicLength)
+	case !utf8.ValidString(topic):
+		return fmt.Errorf("topic %q is not valid UTF-8", topic)
+	case strings.ContainsAny(topic, "+#"):
+		return fmt.Errorf("topic %q contains a wildcard character", topic)
+	case strings.ContainsRune(topic, 0):
+		return fmt.Errorf("topic %q contains a null character", topic)
+	}
+	return nil
+}
+
+// Problems lists everything preventing the configuration from being applied: missing or duplicate brokers, inconsistent TLS or credentials, invalid intervals or MQTT version, invalid or duplicate topics and invalid logging setup
+func (c *Configuration) Problems() (problems []Problem) {
+	problems = append(problems, c.brokerProblems()...)
+	problems = append(problems, c.boardProblems()...)
+	if c.PollingInterval <= 0 {
+		problems = append(problems, Problem{Key: "polling_interval", Message: fmt.Sprintf("polling interval %d should be positive", c.PollingInterval)})
+	}
+	if c.ConfigWatchInterval < 0 {
+		problems = append(problems, Problem{Key: "config_watch_interval", Message: fmt.Sprintf("config watch interval %d should not be negative", c.ConfigWatchInterval)})
+	}
+	problems = append(problems, c.inputSettingProblems()...)
+	problems = append(problems, c.bindingProblems()...)
+	problems = append(problems, c.pwmProblems()...)
+	problems = append(problems, c.modbusProblems()...)
+	if len(c.Counters) > 0 && c.CounterInterval <= 0 {
+		problems = append(problems, Problem{Key: "counter_interval", Message: fmt.Sprintf("counter interval %d should be positive", c.CounterInterval)})
+	}
+	for _, name := range sortedKeys(c.Counters) {
+		if factor := c.Counters[name].Factor; factor <= 0 {
+			problems = append(problems, Problem{Key: name, Section: "counters", Message: fmt.Sprintf("counter %s: factor %g should be positive", name, factor)})
+		}
+		if topic := c.Counters[name].Topic; topic != "" {
+			if err := ValidateTopic(topic); err != nil {
+				problems = append(problems, Problem{Key: name, Section: "counters", Message: fmt.Sprintf("counter %s: %s", name, err)})
+			}
+		}
+	}
+	if c.W1Root != "" && c.SensorInterval <= 0 {
+		problems = append(problems, Problem{Key: "sensor_interval", Message: fmt.Sprintf("sensor interval %d should be positive", c.SensorInterval)})
+	}
+	if c.SensorDeadband < 0 {
+		problems = append(problems, Problem{Key: "sensor_deadband", Message: fmt.Sprintf("sensor deadband %g should not be negative", c.SensorDeadband)})
+	}
+	if c.ReplaySpeed < 0 {
+		problems = append(problems, Problem{Key: "replay_speed", Message: fmt.Sprintf("replay speed %d should not be negative", c.ReplaySpeed)})
+	}
+	if c.MQTTVersion < 3 || c.MQTTVersion > MQTTVersion5 {
+		problems = append(problems, Problem{Key: "mqtt_version", Message: fmt.Sprintf("MQTT version %d should be 3, 4 or 5", c.MQTTVersion)})
+	}
+	if c.MessageExpiry < 0 {
+		problems = append(problems, Problem{Key: "message_expiry", Message: fmt.Sprintf("message expiry %d should not be negative", c.MessageExpiry)})
+	}
+	if c.MessageExpiry > 0 && c.MQTTVersion != MQTTVersion5 {
+		problems = append(problems, Problem{Key: "message_expiry", Message: "message expiry requires mqtt_version 5"})
+	}
+	if strings.ContainsAny(c.BoardID, "/+#") {
+		problems = append(problems, Problem{Key: "board_id", Message: fmt.Sprintf("board ID %q should not contain /, + or #", c.BoardID)})
+	}
+	for _, prefix := range []struct{ Key, Value string }{{"topic_prefix", c.TopicPrefix}, {"command_prefix", c.CommandPrefix}, {"config_prefix", c.ConfigPrefix}} {
+		if prefix.Value == "" {
+			continue
+		}
+		for _, b := range c.BoardList() {
+			if strings.Contains(prefix.Value, BoardPlaceholder) && b.Alias == "" {
+				problems = append(problems, Problem{Key: prefix.Key, Message: fmt.Sprintf("%s %s uses %s without board_id or board alias for %s", prefix.Key, prefix.Value, BoardPlaceholder, b.label())})
+			} else if err := ValidateTopic(expand(prefix.Value, b.Alias)); err != nil {
+				problems = append(problems, Problem{Key: prefix.Key, Message: fmt.Sprintf("%s: %s", prefix.Key, err)})
+			}
+		}
+	}
+	names := make(map[string]string)
+	for _, name := range sortedKeys(c.Topics) {
+		topic := c.Topics[name]
+		if err := ValidateTopic(topic); err != nil {
+			problems = append(problems, Problem{Key: name, Section: "topics", Message: fmt.Sprintf("name %s: %s", name, err)})
+			continue
+		}
+		if other, ok := names[topic]; ok {
+			problems = append(problems, Problem{Key: name, Section: "topics", Message: fmt.Sprintf("topic %s used for both %s and %s", topic, other, name)})
+			continue
+		}
+		names[topic] = name
+	}
+	problems = append(problems, c.AuthConfiguration.Problems()...)
+	if err := c.Logging.Validate(); err != nil {
+		problems = append(problems, Problem{Key: "logging", Message: fmt.Sprintf("logging: %s", err)})
+	}
+	return
+}
+
+// UnknownNames lists the problems for mapped names not matching any of the given channels
+func (c *Configuration) UnknownNames(channels map[string]bool) (problems []Problem) {
+	for _, name := range sortedKeys(c.Topics) {
+		if !channels[name] {
+			problems = append(problems, Problem{Key: name, Section: "topics", Message: fmt.Sprintf("name %s does not match any discovered di_/do_ channel or 1-Wire sensor", name)})
+		}
+	}
+	for _, name := range sortedKeys(c.Counters) {
+		if !channels[name] {
+			problems = append(problems, Problem{Key: name, Section: "counters", Message: fmt.Sprintf("counter %s does not match any discovered di_ channel", name)})
+		}
+	}
+	for _, name := range sortedKeys(c.Pwm) {
+		if !channels[name] {
+			problems = append(problems, Problem{Key: name, Section: "pwm", Message: fmt.Sprintf("PWM output %s does not match any discovered do_ channel", name)})
+		}
+	}
+	for _, name := range c.StatusLeds {
+		if !channels[name] {
+			problems = append(problems, Problem{Key: name, Message: fmt.Sprintf("status LED %s does not match any discovered led_ channel", name)})
+		}
+	}
+	for _, b := range c.Bindings {
+		for _, name := range []string{b.Input, b.Output} {
+			if !channels[name] {
+				problems = append(problems, Problem{Key: name, Message: fmt.Sprintf("binding %s does not match any discovered di_/do_ channel", name)})
+			}
+		}
+	}
+	for _, name := range sortedKeys(c.ModbusAddresses) {
+		if !channels[name] {
+			problems = append(problems, Problem{Key: name, Section: "modbus_addresses", Message: fmt.Sprintf("Modbus address of %s does not match any discovered channel", name)})
+		}
+	}
+	for _, name := range sortedKeys(c.Inputs) {
+		if !channels[name] {
+			problems = append(problems, Problem{Key: name, Section: "inputs", Message: fmt.Sprintf("input %s does not match any discovered di_ channel", name)})
+		}
+	}
+	return
+}
+
+// DiscoverChannels finds the names of all digital input and output channels and user LEDs under the sys fs root
+func DiscoverChannels(root string) (channels map[string]bool, err error) {
+	channels = make(map[string]bool)
+	for _, pattern := range []string{DiFolderRegex, DoFolderRegex, LedFolderRegex} {
+		paths, err := findPathsByRegex(root, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, folder := range paths {
+			channels[path.Base(folder)] = true
+		}
+	}
+	return
+}
+
+// CheckConfig strictly validates a configuration file: syntax, unknown keys, topics and names against the channels discovered on the boards, or in the given sys fs root without boards list. Problems are sorted by line.
+func CheckConfig(configFile string, sysFsRoot string) (problems []Problem, err error) {
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return
+	}
+
+	c := DefaultConfiguration()
+	if err := yaml.UnmarshalStrict(content, &c); err != nil {
+		return yamlProblems(err), nil
+	}
+	problems = c.Problems()
+
+	if len(c.Boards) == 0 {
+		c.SysFsRoot = sysFsRoot
+	}
+	channels, collisions, err := DiscoverBoardChannels(c.BoardList())
+	if err != nil {
+		problems = append(problems, Problem{Message: err.Error()})
+	} else {
+		problems = append(problems, collisions...)
+		sensors, _ := FindSensors(c.W1Root)
+		for _, id := range sensors {
+			channels[id] = true
+		}
+		problems = append(problems, c.UnknownNames(channels)...)
+	}
+
+	for k := range problems {
+		if problems[k].Key != "" {
+			problems[k].Line = lineOf(content, problems[k].Section, problems[k].Key)
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return problems, nil
+}
+
+// yamlProblems converts a yaml error into problems, extracting the line numbers
+func yamlProblems(err error) (problems []Problem) {
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+	for _, message := range messages {
+		p := Problem{Message: message}
+		if match := yamlLineRegex.FindStringSubmatch(message); match != nil {
+			p.Line, _ = strconv.Atoi(match[1])
+			p.Message = match[2]
+		}
+		problems = append(problems, p)
+	}
+	return
+}
+
+// keyRegex matches the line defining the key, quoted or not, at any indentation
+func keyRegex(key string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(key)
+	return regexp.MustCompile(`^\s*(` + quoted + `|"` + quoted + `"|'` + quoted + `')\s*:`)
+}
+
+// topLevelRegex matches the lines starting a top-level key
+var topLevelRegex = regexp.MustCompile(`^[^\s#-]`)
+
+// lineOf finds the (1-based) line number on which the given key is defined, within the top-level section if given, zero if not found
+func lineOf(content []byte, section string, key string) int {
+	regex := keyRegex(key)
+	inSection := section == ""
+	var sectionRegex *regexp.Regexp
+	if !inSection {
+		sectionRegex = keyRegex(section)
+	}
+	for k, line := range bytes.Split(content, []byte("\n")) {
+		if sectionRegex != nil && topLevelRegex.Match(line) {
+			inSection = sectionRegex.Match(line)
+			continue
+		}
+		if inSection && regex.Match(line) {
+			return k + 1
+		}
+	}
+	return 0
+}
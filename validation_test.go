@@ -0,0 +1,123 @@
+package unipitt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateTopic(t *testing.T) {
+	cases := []struct {
+		Topic    string
+		HasError bool
+	}{
+		{Topic: "home/kitchen/light"},
+		{Topic: "kitchen switch"},
+		{Topic: "", HasError: true},
+		{Topic: "home/+/light", HasError: true},
+		{Topic: "home/#", HasError: true},
+		{Topic: "home\x00light", HasError: true},
+		{Topic: "\xff", HasError: true},
+		{Topic: strings.Repeat("a", MaxTopicLength+1), HasError: true},
+	}
+	for _, testCase := range cases {
+		err := ValidateTopic(testCase.Topic)
+		if (err != nil) != testCase.HasError {
+			t.Fatalf("Expected error %t for topic %q, got %v\n", testCase.HasError, testCase.Topic, err)
+		}
+	}
+}
+
+func TestConfigurationUnknownNames(t *testing.T) {
+	c := Configuration{Topics: map[string]string{"di_1_01": "kitchen switch", "di_1_1": "hall switch"}}
+	problems := c.UnknownNames(map[string]bool{"di_1_01": true})
+	if len(problems) != 1 || problems[0].Key != "di_1_1" {
+		t.Fatalf("Expected a single problem for di_1_1, got %v\n", problems)
+	}
+}
+
+func TestDiscoverChannels(t *testing.T) {
+	root, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, folder := range []string{"di_1_01", "do_2_01", "foo"} {
+		if err := os.Mkdir(filepath.Join(root, folder), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	channels, err := DiscoverChannels(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 2 || !channels["di_1_01"] || !channels["do_2_01"] {
+		t.Fatalf("Expected channels di_1_01 and do_2_01, got %v\n", channels)
+	}
+	if _, err := DiscoverChannels("foo"); err == nil {
+		t.Fatal("Expected an error discovering a non-existing root, got none")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	root, err := ioutil.TempDir("", "unipitt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, folder := range []string{"di_1_01", "do_2_01"} {
+		if err := os.Mkdir(filepath.Join(root, folder), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		Content  string
+		Expected []Problem
+	}{
+		{
+			Content: "topics:\n  di_1_01: kitchen switch\n  do_2_01: kitchen light\n",
+		},
+		{
+			Content:  "topics:\n  di_1_01: kitchen switch\ntopcs:\n  do_2_01: kitchen light\n",
+			Expected: []Problem{{Line: 3}},
+		},
+		{
+			Content:  "topics:\n  di_1_01: kitchen\n  do_2_01: kitchen\n",
+			Expected: []Problem{{Line: 3, Key: "do_2_01"}},
+		},
+		{
+			Content:  "topics:\n  di_1_01: kitchen/+\n  \"di_1_02\": hall switch\n",
+			Expected: []Problem{{Line: 2, Key: "di_1_01"}, {Line: 3, Key: "di_1_02"}},
+		},
+		{
+			Content:  "topics:\n  di_1_01: kitchen switch\n# Metering\ncounters:\n  # Water\n  di_1_01:\n    factor: -1\n",
+			Expected: []Problem{{Line: 6, Key: "di_1_01"}},
+		},
+	}
+	for _, testCase := range cases {
+		configFile := writeConfig(t, testCase.Content)
+		problems, err := CheckConfig(configFile, root)
+		os.Remove(configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) != len(testCase.Expected) {
+			t.Fatalf("Expected %d problems for %q, got %v\n", len(testCase.Expected), testCase.Content, problems)
+		}
+		for k, problem := range problems {
+			if problem.Line != testCase.Expected[k].Line || problem.Key != testCase.Expected[k].Key {
+				t.Fatalf("Expected problem %v, got %v\n", testCase.Expected[k], problem)
+			}
+		}
+	}
+}
+
+func TestCheckConfigNonExisting(t *testing.T) {
+	if _, err := CheckConfig("foo", "foo"); err == nil {
+		t.Fatal("Expected an error checking a non-existing file, got none")
+	}
+}